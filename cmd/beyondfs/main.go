@@ -2,6 +2,8 @@ package main
 
 import (
 	"os"
+	"strconv"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -9,11 +11,29 @@ import (
 	"github.com/beyondstorage/beyond-fs/vfs"
 )
 
+// statsInterval is the interval of logging statistics.
+const statsInterval = time.Minute
+
 func main() {
 	logger, _ := zap.NewDevelopment()
 
 	cfg := &vfs.Config{
-		StoragePath: os.Getenv("BEYONDFS_UNDER_PATH"),
+		StoragePath:      os.Getenv("BEYONDFS_UNDER_PATH"),
+		CacheStoragePath: os.Getenv("BEYONDFS_CACHE_PATH"),
+		MetaPath:         os.Getenv("BEYONDFS_META_PATH"),
+		PersistAttr:      os.Getenv("BEYONDFS_PERSIST_ATTR") == "true",
+		StagingDir:       os.Getenv("BEYONDFS_STAGING_PATH"),
+		ChunkSize:        getEnvUint64("BEYONDFS_CHUNK_SIZE", 0),
+		CacheDirtyLimit:  getEnvUint64("BEYONDFS_CACHE_DIRTY_LIMIT", 0),
+		CachePartSize:    getEnvUint64("BEYONDFS_CACHE_PART_SIZE", 0),
+
+		UploadConcurrency: getEnvUint64("BEYONDFS_UPLOAD_CONCURRENCY", 0),
+		MultipartMaxAge:   getEnvDuration("BEYONDFS_MULTIPART_MAX_AGE", 0),
+
+		BlockCacheDir:  os.Getenv("BEYONDFS_BLOCK_CACHE_PATH"),
+		BlockCacheSize: getEnvUint64("BEYONDFS_BLOCK_CACHE_SIZE", 0),
+
+		BlockCachePolicy: os.Getenv("BEYONDFS_BLOCK_CACHE_POLICY"),
 
 		Logger: logger,
 	}
@@ -27,12 +47,83 @@ func main() {
 	srv, err := hanwen.New(&hanwen.Config{
 		FileSystem: fs,
 		MountPoint: os.Getenv("BEYONDFS_MOUNT_PATH"),
-		Logger:     logger,
+		Uid:        getEnvUint32("BEYONDFS_UID", 1000),
+		Gid:        getEnvUint32("BEYONDFS_GID", 1000),
+		FileMode:   getEnvMode("BEYONDFS_FILE_MODE", 0644),
+		DirMode:    getEnvMode("BEYONDFS_DIR_MODE", 0755),
+		Umask:      getEnvMode("BEYONDFS_UMASK", 0),
+		CallerOwns: os.Getenv("BEYONDFS_CALLER_OWNS") == "true",
+
+		DefaultPermissions: os.Getenv("BEYONDFS_DEFAULT_PERMISSIONS") == "true",
+		AllowOther:         os.Getenv("BEYONDFS_ALLOW_OTHER") == "true",
+
+		Logger: logger,
 	})
 	if err != nil {
 		logger.Error("new hanwen fuse", zap.Error(err))
 		return
 	}
 
+	go logStats(fs, logger)
+
 	srv.Serve()
+
+	err = fs.Close()
+	if err != nil {
+		logger.Error("close fs", zap.Error(err))
+	}
+}
+
+// logStats logs statistics periodically, so that the dirty limit and eviction
+// policies could be tuned.
+func logStats(fs *vfs.FS, logger *zap.Logger) {
+	for range time.Tick(statsInterval) {
+		logger.Info("write cache stats",
+			zap.Int64("dirty", fs.DirtyBytes()))
+
+		stats, ok := fs.BlockCacheStats()
+		if !ok {
+			continue
+		}
+		logger.Info("block cache stats",
+			zap.String("policy", stats.Policy),
+			zap.Uint64("hits", stats.Hits),
+			zap.Uint64("misses", stats.Misses),
+			zap.Int("blocks", stats.Blocks),
+			zap.Uint64("size", stats.Size))
+	}
+}
+
+func getEnvUint64(key string, def uint64) uint64 {
+	v, err := strconv.ParseUint(os.Getenv(key), 10, 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+func getEnvUint32(key string, def uint32) uint32 {
+	v, err := strconv.ParseUint(os.Getenv(key), 10, 32)
+	if err != nil {
+		return def
+	}
+	return uint32(v)
+}
+
+// getEnvDuration parses the duration like 24h.
+func getEnvDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// getEnvMode parses the mode in octal, like 0644.
+func getEnvMode(key string, def uint32) uint32 {
+	v, err := strconv.ParseUint(os.Getenv(key), 8, 32)
+	if err != nil {
+		return def
+	}
+	return uint32(v)
 }
@@ -0,0 +1,212 @@
+package hanwen
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/beyondstorage/go-storage/v4/services"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"go.uber.org/zap"
+
+	"github.com/beyondstorage/beyond-fs/vfs"
+)
+
+// checkAccess checks whether caller has the permission in mask on this inode.
+//
+// Kernel will do the checks by itself if mounted with default_permissions, so
+// all checks will be skipped.
+//
+// FUSE only sends the primary group of caller, supplementary groups will be
+// read from procfs if the primary one doesn't match.
+func (fs *FS) checkAccess(i *vfs.Inode, caller *fuse.Caller, mask uint32) fuse.Status {
+	if fs.defaultPermissions {
+		return fuse.OK
+	}
+
+	mode := fs.formatMode(i)
+	uid, gid := fs.formatOwner(i, caller)
+
+	if caller.Uid == 0 {
+		// Root could do anything, except executing a file without any execute bit.
+		if mask&fuse.X_OK == 0 || mode&syscall.S_IFMT == syscall.S_IFDIR || mode&0111 != 0 {
+			return fuse.OK
+		}
+		return fuse.EACCES
+	}
+
+	var perm uint32
+	switch {
+	case caller.Uid == uid:
+		perm = mode >> 6
+	case caller.Gid == gid || fs.inGroup(caller, gid):
+		perm = mode >> 3
+	default:
+		perm = mode
+	}
+	if perm&mask != mask {
+		return fuse.EACCES
+	}
+	return fuse.OK
+}
+
+// checkDelete checks whether caller could delete the entry name in dir, or
+// replace it by rename.
+//
+// Besides write permission on dir, only the owner of the entry or dir could do
+// that if dir is sticky, see unlink(2).
+func (fs *FS) checkDelete(dir *vfs.Inode, name string, caller *fuse.Caller) fuse.Status {
+	if code := fs.checkAccess(dir, caller, fuse.W_OK|fuse.X_OK); !code.Ok() {
+		return code
+	}
+	if fs.defaultPermissions || fs.formatMode(dir)&syscall.S_ISVTX == 0 {
+		return fuse.OK
+	}
+
+	i, err := fs.fs.GetEntry(dir.ID, name)
+	if err != nil && errors.Is(err, services.ErrObjectNotExist) {
+		// Leave it to the operation itself.
+		return fuse.OK
+	}
+	if err != nil {
+		fs.logger.Error("get entry", zap.Error(err))
+		return fuse.EAGAIN
+	}
+	if i == nil {
+		return fuse.OK
+	}
+	return fs.checkSticky(dir, i, caller)
+}
+
+// checkSticky checks whether caller could delete inode i from the sticky dir.
+func (fs *FS) checkSticky(dir, i *vfs.Inode, caller *fuse.Caller) fuse.Status {
+	if fs.defaultPermissions || caller.Uid == 0 || fs.formatMode(dir)&syscall.S_ISVTX == 0 {
+		return fuse.OK
+	}
+
+	dirUid, _ := fs.formatOwner(dir, caller)
+	uid, _ := fs.formatOwner(i, caller)
+	if caller.Uid != dirUid && caller.Uid != uid {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// inGroup checks whether gid is one of the supplementary groups of caller.
+func (fs *FS) inGroup(caller *fuse.Caller, gid uint32) bool {
+	groups, err := fs.groups(caller.Pid)
+	if err != nil {
+		// Process may have exited, treat it as not in group.
+		fs.logger.Warn("get groups", zap.Uint32("pid", caller.Pid), zap.Error(err))
+		return false
+	}
+	for _, g := range groups {
+		if g == gid {
+			return true
+		}
+	}
+	return false
+}
+
+// procGroups returns the supplementary groups of process from procfs.
+func procGroups(pid uint32) (groups []uint32, err error) {
+	bs, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(bs), "\n") {
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+		for _, f := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			g, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("parse groups: %w", err)
+			}
+			groups = append(groups, uint32(g))
+		}
+		return groups, nil
+	}
+	return nil, fmt.Errorf("groups of process %d not found", pid)
+}
+
+// checkOwner checks whether caller is the owner of this inode or root.
+func (fs *FS) checkOwner(i *vfs.Inode, caller *fuse.Caller) fuse.Status {
+	if fs.defaultPermissions || caller.Uid == 0 {
+		return fuse.OK
+	}
+
+	uid, _ := fs.formatOwner(i, caller)
+	if caller.Uid != uid {
+		return fuse.EPERM
+	}
+	return fuse.OK
+}
+
+// checkSetAttr checks permissions of SetAttr, follows the rules of chmod(2),
+// chown(2), truncate(2) and utimensat(2).
+func (fs *FS) checkSetAttr(i *vfs.Inode, input *fuse.SetAttrIn) fuse.Status {
+	if fs.defaultPermissions {
+		return fuse.OK
+	}
+	caller := &input.Caller
+
+	if _, ok := input.GetMode(); ok {
+		if code := fs.checkOwner(i, caller); !code.Ok() {
+			return code
+		}
+	}
+
+	uid, hasUid := input.GetUID()
+	gid, hasGid := input.GetGID()
+	if (hasUid || hasGid) && caller.Uid != 0 {
+		curUid, curGid := fs.formatOwner(i, caller)
+		// Only root could change the owner, and the owner could only change
+		// the group into the group it belongs to.
+		if hasUid && uid != curUid {
+			return fuse.EPERM
+		}
+		if hasGid && gid != curGid && (caller.Uid != curUid || gid != caller.Gid) {
+			return fuse.EPERM
+		}
+	}
+
+	if _, ok := input.GetSize(); ok {
+		if code := fs.checkAccess(i, caller, fuse.W_OK); !code.Ok() {
+			return code
+		}
+	}
+
+	if input.Valid&(fuse.FATTR_ATIME|fuse.FATTR_MTIME) != 0 {
+		// Set times to now only requires write permission, while setting them
+		// into other values requires the ownership.
+		if input.Valid&(fuse.FATTR_ATIME_NOW|fuse.FATTR_MTIME_NOW) == 0 ||
+			!fs.checkAccess(i, caller, fuse.W_OK).Ok() {
+			if code := fs.checkOwner(i, caller); !code.Ok() {
+				return code
+			}
+		}
+	}
+	return fuse.OK
+}
+
+// parseOpenMask returns the access mask required by open flags.
+func parseOpenMask(flags uint32) uint32 {
+	var mask uint32
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		mask = fuse.R_OK
+	case syscall.O_WRONLY:
+		mask = fuse.W_OK
+	case syscall.O_RDWR:
+		mask = fuse.R_OK | fuse.W_OK
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		mask |= fuse.W_OK
+	}
+	return mask
+}
@@ -0,0 +1,152 @@
+package hanwen
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"go.uber.org/zap"
+
+	"github.com/beyondstorage/beyond-fs/vfs"
+)
+
+func newTestFS() *FS {
+	return &FS{
+		fileMode: defaultFileMode,
+		dirMode:  defaultDirMode,
+		// Process 2 has supplementary group 100.
+		groups: func(pid uint32) ([]uint32, error) {
+			if pid == 2 {
+				return []uint32{10, 100}, nil
+			}
+			if pid == 0 {
+				return nil, fmt.Errorf("process not found")
+			}
+			return nil, nil
+		},
+		logger: zap.NewNop(),
+	}
+}
+
+func newCaller(uid, gid, pid uint32) *fuse.Caller {
+	return &fuse.Caller{Owner: fuse.Owner{Uid: uid, Gid: gid}, Pid: pid}
+}
+
+func TestCheckAccess(t *testing.T) {
+	fs := newTestFS()
+	// rwx for owner, rw- for group and r-- for other.
+	file := &vfs.Inode{Mode: 0764, Uid: 1000, Gid: 100, HasMode: true, HasOwner: true}
+	noExec := &vfs.Inode{Mode: 0644, Uid: 1000, Gid: 100, HasMode: true, HasOwner: true}
+
+	var (
+		owner = newCaller(1000, 1000, 1)
+		group = newCaller(2000, 100, 1)
+		suppl = newCaller(2000, 2000, 2)
+		other = newCaller(3000, 3000, 1)
+		gone  = newCaller(3000, 3000, 0)
+		root  = newCaller(0, 0, 1)
+	)
+
+	cases := []struct {
+		name   string
+		ino    *vfs.Inode
+		caller *fuse.Caller
+		mask   uint32
+		expect fuse.Status
+	}{
+		{"owner read", file, owner, fuse.R_OK, fuse.OK},
+		{"owner write", file, owner, fuse.W_OK, fuse.OK},
+		{"owner exec", file, owner, fuse.X_OK, fuse.OK},
+		{"owner all", file, owner, fuse.R_OK | fuse.W_OK | fuse.X_OK, fuse.OK},
+		{"group read", file, group, fuse.R_OK, fuse.OK},
+		{"group write", file, group, fuse.W_OK, fuse.OK},
+		{"group exec", file, group, fuse.X_OK, fuse.EACCES},
+		{"group all", file, group, fuse.R_OK | fuse.W_OK | fuse.X_OK, fuse.EACCES},
+		{"supplementary group read", file, suppl, fuse.R_OK, fuse.OK},
+		{"supplementary group write", file, suppl, fuse.W_OK, fuse.OK},
+		{"supplementary group exec", file, suppl, fuse.X_OK, fuse.EACCES},
+		{"other read", file, other, fuse.R_OK, fuse.OK},
+		{"other write", file, other, fuse.W_OK, fuse.EACCES},
+		{"other exec", file, other, fuse.X_OK, fuse.EACCES},
+		{"exited process", file, gone, fuse.W_OK, fuse.EACCES},
+		{"root read", noExec, root, fuse.R_OK, fuse.OK},
+		{"root write", noExec, root, fuse.W_OK, fuse.OK},
+		{"root exec", file, root, fuse.X_OK, fuse.OK},
+		{"root exec without any exec bit", noExec, root, fuse.X_OK, fuse.EACCES},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			code := fs.checkAccess(tt.ino, tt.caller, tt.mask)
+			if code != tt.expect {
+				t.Errorf("expect %v, got %v", tt.expect, code)
+			}
+		})
+	}
+
+	fs.defaultPermissions = true
+	if code := fs.checkAccess(file, other, fuse.W_OK); !code.Ok() {
+		t.Errorf("expect checks skipped with default_permissions, got %v", code)
+	}
+}
+
+func TestCheckSticky(t *testing.T) {
+	fs := newTestFS()
+	dir := &vfs.Inode{Mode: uint32(os.ModeDir | os.ModeSticky | 0777), Uid: 1000, Gid: 100, HasMode: true, HasOwner: true}
+	plain := &vfs.Inode{Mode: uint32(os.ModeDir | 0777), Uid: 1000, Gid: 100, HasMode: true, HasOwner: true}
+	file := &vfs.Inode{Mode: 0666, Uid: 2000, Gid: 100, HasMode: true, HasOwner: true}
+
+	cases := []struct {
+		name   string
+		dir    *vfs.Inode
+		caller *fuse.Caller
+		expect fuse.Status
+	}{
+		{"dir owner", dir, newCaller(1000, 1000, 1), fuse.OK},
+		{"file owner", dir, newCaller(2000, 2000, 1), fuse.OK},
+		{"root", dir, newCaller(0, 0, 1), fuse.OK},
+		{"other", dir, newCaller(3000, 100, 1), fuse.EPERM},
+		{"not sticky", plain, newCaller(3000, 100, 1), fuse.OK},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			code := fs.checkSticky(tt.dir, file, tt.caller)
+			if code != tt.expect {
+				t.Errorf("expect %v, got %v", tt.expect, code)
+			}
+		})
+	}
+}
+
+func TestStickyMode(t *testing.T) {
+	fs := newTestFS()
+	perm := parsePerm(01777)
+	if perm != uint32(os.ModeSticky|0777) {
+		t.Fatalf("expect sticky bit parsed, got %o", perm)
+	}
+	ino := &vfs.Inode{Mode: uint32(os.ModeDir) | perm, HasMode: true}
+	if mode := fs.formatMode(ino); mode != fuse.S_IFDIR|01777 {
+		t.Errorf("expect %o, got %o", fuse.S_IFDIR|01777, mode)
+	}
+}
+
+func TestProcGroups(t *testing.T) {
+	expect, err := os.Getgroups()
+	if err != nil {
+		t.Skip(err)
+	}
+	groups, err := procGroups(uint32(os.Getpid()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != len(expect) {
+		t.Fatalf("expect groups %v, got %v", expect, groups)
+	}
+	for i := range groups {
+		if int(groups[i]) != expect[i] {
+			t.Errorf("expect groups %v, got %v", expect, groups)
+		}
+	}
+}
@@ -2,6 +2,25 @@ package hanwen
 
 import "math"
 
+const (
+	// xattrUserPrefix is the namespace of xattrs mapped to object user metadata.
+	xattrUserPrefix = "user."
+	// xattrBeyondfsPrefix is the read-only namespace of xattrs exposing object facts.
+	xattrBeyondfsPrefix = "beyondfs."
+
+	// Flags of setxattr, see setxattr(2).
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+
+	// releaseFlockUnlock in release flags asks to release flock locks of the
+	// lock owner, it's missing in go-fuse.
+	releaseFlockUnlock = 1 << 1
+
+	// Permission bits of inodes whose objects don't carry mode.
+	defaultFileMode = 0644
+	defaultDirMode  = 0755
+)
+
 const (
 	BlockSize     = 4096
 	MaximumSpace  = 1024 * 1024 * 1024 * 1024 * 1024 // Set total space to 1PB
@@ -1,9 +1,12 @@
 package hanwen
 
 import (
+	"bytes"
 	"errors"
-	"fmt"
 	"os"
+	"sort"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/beyondstorage/go-storage/v4/services"
@@ -16,6 +19,17 @@ import (
 type FS struct {
 	fs *vfs.FS
 
+	uid        uint32
+	gid        uint32
+	fileMode   uint32
+	dirMode    uint32
+	umask      uint32
+	callerOwns bool
+
+	defaultPermissions bool
+	// groups returns the supplementary groups of process.
+	groups func(pid uint32) ([]uint32, error)
+
 	logger *zap.Logger
 }
 
@@ -23,6 +37,26 @@ type Config struct {
 	FileSystem *vfs.FS
 	MountPoint string
 
+	// Uid and Gid are the owner of inodes whose objects don't carry ownership.
+	Uid uint32
+	Gid uint32
+	// FileMode and DirMode are the permission bits of inodes whose objects don't
+	// carry mode, 0644 and 0755 will be used if not set.
+	FileMode uint32
+	DirMode  uint32
+	// Umask will be cleared from the permission bits of all inodes.
+	Umask uint32
+	// CallerOwns makes every inode owned by the caller of each request, which
+	// is useful when the mount is shared by containers running as different uids.
+	// Kernel will not cache attributes and entries then.
+	CallerOwns bool
+
+	// DefaultPermissions makes kernel check permissions by itself via the
+	// default_permissions mount option, instead of checking in BeyondFS.
+	DefaultPermissions bool
+	// AllowOther allows users other than the one who mounted to access the mount.
+	AllowOther bool
+
 	Logger *zap.Logger
 }
 
@@ -30,16 +64,38 @@ func New(cfg *Config) (srv *fuse.Server, err error) {
 	fuseFS := &FS{
 		fs: cfg.FileSystem,
 
+		uid:        cfg.Uid,
+		gid:        cfg.Gid,
+		fileMode:   cfg.FileMode & uint32(os.ModePerm),
+		dirMode:    cfg.DirMode & uint32(os.ModePerm),
+		umask:      cfg.Umask & uint32(os.ModePerm),
+		callerOwns: cfg.CallerOwns,
+
+		defaultPermissions: cfg.DefaultPermissions,
+		groups:             procGroups,
+
 		logger: cfg.Logger,
 	}
 
+	if fuseFS.fileMode == 0 {
+		fuseFS.fileMode = defaultFileMode
+	}
+	if fuseFS.dirMode == 0 {
+		fuseFS.dirMode = defaultDirMode
+	}
+
 	if fuseFS.logger == nil {
 		fuseFS.logger, _ = zap.NewDevelopment()
 	}
 
+	var options []string
+	if cfg.DefaultPermissions {
+		options = append(options, "default_permissions")
+	}
+
 	return fuse.NewServer(fuseFS, cfg.MountPoint, &fuse.MountOptions{
-		AllowOther:               true,
-		Options:                  nil,
+		AllowOther:               cfg.AllowOther,
+		Options:                  options,
 		MaxBackground:            0,
 		MaxWrite:                 0,
 		MaxReadAhead:             0,
@@ -50,46 +106,57 @@ func New(cfg *Config) (srv *fuse.Server, err error) {
 		SingleThreaded:           false,
 		DisableXAttrs:            false,
 		Debug:                    true,
-		EnableLocks:              false,
+		EnableLocks:              true,
 		ExplicitDataCacheControl: false,
 		DirectMount:              false,
 		DirectMountFlags:         0,
 	})
 }
 
-func fillEntryOut(i *vfs.Inode, out *fuse.EntryOut) fuse.Status {
-	out.SetAttrTimeout(time.Minute)
-	out.SetEntryTimeout(10 * time.Minute)
+// timeouts returns how long kernel could cache attributes and entries.
+//
+// Owner depends on the caller of each request while CallerOwns enabled, so they
+// must not be cached, otherwise other callers will see the owner of the first one.
+func (fs *FS) timeouts() (attr, entry time.Duration) {
+	if fs.callerOwns {
+		return 0, 0
+	}
+	return time.Minute, 10 * time.Minute
+}
+
+func (fs *FS) fillEntryOut(i *vfs.Inode, out *fuse.EntryOut, caller *fuse.Caller) fuse.Status {
+	attr, entry := fs.timeouts()
+	out.SetAttrTimeout(attr)
+	out.SetEntryTimeout(entry)
 
 	out.NodeId = i.ID
 	out.Generation = 1
 	out.Ino = i.ID
 	out.Size = i.Size
-	out.Mode = parseMode(i.Mode)
+	out.Mode = fs.formatMode(i)
 
 	out.Blocks = (out.Size + 255) / 256
 	out.Nlink = 1
 
-	out.Gid = 1000
-	out.Uid = 1000
+	out.Uid, out.Gid = fs.formatOwner(i, caller)
 
 	out.SetTimes(&i.Atime, &i.Mtime, &i.Ctime)
 
 	return fuse.OK
 }
 
-func fillAttrOut(i *vfs.Inode, out *fuse.AttrOut) fuse.Status {
-	out.SetTimeout(time.Minute)
+func (fs *FS) fillAttrOut(i *vfs.Inode, out *fuse.AttrOut, caller *fuse.Caller) fuse.Status {
+	attr, _ := fs.timeouts()
+	out.SetTimeout(attr)
 
 	out.Ino = i.ID
 	out.Size = i.Size
-	out.Mode = parseMode(i.Mode)
+	out.Mode = fs.formatMode(i)
 
 	out.Blocks = (out.Size + 255) / 256
 	out.Nlink = 1
 
-	out.Gid = 1000
-	out.Uid = 1000
+	out.Uid, out.Gid = fs.formatOwner(i, caller)
 
 	out.SetTimes(&i.Atime, &i.Mtime, &i.Ctime)
 
@@ -101,12 +168,112 @@ func fillOpenOut(fh *vfs.FileHandle, out *fuse.OpenOut) fuse.Status {
 	return fuse.OK
 }
 
+// formatBeyondfsXAttrs returns the read-only xattrs exposing object facts from
+// underlying storage, facts that storage doesn't provide will be omitted.
+func formatBeyondfsXAttrs(i *vfs.Inode) map[string]string {
+	m := make(map[string]string)
+	if i.Etag != "" {
+		m[xattrBeyondfsPrefix+"etag"] = i.Etag
+	}
+	if i.ContentMd5 != "" {
+		m[xattrBeyondfsPrefix+"content_md5"] = i.ContentMd5
+	}
+	if i.ContentType != "" {
+		m[xattrBeyondfsPrefix+"content_type"] = i.ContentType
+	}
+	if i.StorageClass != "" {
+		m[xattrBeyondfsPrefix+"storage_class"] = i.StorageClass
+	}
+	if !i.LastModified.IsZero() {
+		m[xattrBeyondfsPrefix+"last_modified"] = i.LastModified.UTC().Format(time.RFC3339)
+	}
+	return m
+}
+
+// fillXAttr will copy value into dest, or return the required size with ERANGE if
+// dest is not large enough.
+func fillXAttr(value, dest []byte) (uint32, fuse.Status) {
+	if len(dest) < len(value) {
+		return uint32(len(value)), fuse.ERANGE
+	}
+	return uint32(copy(dest, value)), fuse.OK
+}
+
+func parseLock(input *fuse.LkIn) vfs.Lock {
+	if input.LkFlags&fuse.FUSE_LK_FLOCK != 0 {
+		// flock(2) locks the whole file, range from kernel is ignored.
+		return vfs.Lock{
+			Start: 0,
+			End:   vfs.LockEOF,
+			Type:  parseLockType(input.Lk.Typ),
+			Pid:   input.Lk.Pid,
+			Owner: input.Owner,
+			Flock: true,
+		}
+	}
+	return vfs.Lock{
+		Start: input.Lk.Start,
+		End:   input.Lk.End,
+		Type:  parseLockType(input.Lk.Typ),
+		Pid:   input.Lk.Pid,
+		Owner: input.Owner,
+	}
+}
+
+func parseLockType(t uint32) vfs.LockType {
+	switch t {
+	case syscall.F_RDLCK:
+		return vfs.LockRead
+	case syscall.F_WRLCK:
+		return vfs.LockWrite
+	default:
+		return vfs.LockUnlock
+	}
+}
+
+func formatLockType(t vfs.LockType) uint32 {
+	switch t {
+	case vfs.LockRead:
+		return syscall.F_RDLCK
+	case vfs.LockWrite:
+		return syscall.F_WRLCK
+	default:
+		return syscall.F_UNLCK
+	}
+}
+
 func parseError(err error) fuse.Status {
 	switch {
 	case errors.Is(err, services.ErrObjectNotExist):
 		return fuse.ENOENT
 	case errors.Is(err, services.ErrPermissionDenied):
 		return fuse.EACCES
+	case errors.Is(err, services.ErrCapabilityInsufficient):
+		return fuse.ENOSYS
+	case errors.Is(err, vfs.ErrIsDir):
+		return fuse.EISDIR
+	case errors.Is(err, vfs.ErrNotDir):
+		return fuse.ENOTDIR
+	case errors.Is(err, vfs.ErrNotEmpty):
+		return fuse.Status(syscall.ENOTEMPTY)
+	case errors.Is(err, vfs.ErrLockConflict):
+		return fuse.EAGAIN
+	case errors.Is(err, vfs.ErrLockInterrupted):
+		return fuse.EINTR
+	case errors.Is(err, vfs.ErrNoXAttr):
+		return fuse.ENOATTR
+	case errors.Is(err, vfs.ErrNotSymlink):
+		return fuse.EINVAL
+	case errors.Is(err, vfs.ErrExist):
+		return fuse.Status(syscall.EEXIST)
+	case errors.Is(err, vfs.ErrBadHandle):
+		return fuse.EBADF
+	case errors.Is(err, vfs.ErrNotSupported):
+		return fuse.ENOTSUP
+	case errors.Is(err, vfs.ErrIO):
+		return fuse.EIO
+	case errors.Is(err, vfs.ErrBusy):
+		return fuse.Status(syscall.EBUSY)
 	default:
 		return fuse.EAGAIN
 	}
@@ -117,21 +284,89 @@ func parseType(o uint32) uint32 {
 	var mode uint32
 	if osMode.IsDir() {
 		mode = fuse.S_IFDIR
+	} else if osMode&os.ModeSymlink != 0 {
+		mode = fuse.S_IFLNK
 	} else {
 		mode = fuse.S_IFREG
 	}
 	return mode
 }
 
-func parseMode(o uint32) uint32 {
-	osMode := os.FileMode(o)
-	var mode uint32
-	if osMode.IsDir() {
-		mode = fuse.S_IFDIR | 0755
+// formatMode returns the mode of inode, permission bits will fall back to the
+// configured defaults if object doesn't carry them.
+func (fs *FS) formatMode(i *vfs.Inode) uint32 {
+	osMode := os.FileMode(i.Mode)
+
+	var perm uint32
+	if osMode&os.ModeSymlink != 0 {
+		// Symlink's permission bits are ignored, follow the convention of Linux.
+		return fuse.S_IFLNK | 0777
+	} else if i.HasMode {
+		perm = uint32(osMode.Perm())
+		if osMode&os.ModeSticky != 0 {
+			perm |= syscall.S_ISVTX
+		}
+	} else if osMode.IsDir() {
+		perm = fs.dirMode
 	} else {
-		mode = fuse.S_IFREG | 0644
+		perm = fs.fileMode
 	}
-	return mode
+	return parseType(i.Mode) | perm&^fs.umask
+}
+
+// parsePerm converts the permission bits and the sticky bit of POSIX mode into
+// os.FileMode.
+func parsePerm(mode uint32) uint32 {
+	perm := mode & uint32(os.ModePerm)
+	if mode&syscall.S_ISVTX != 0 {
+		perm |= uint32(os.ModeSticky)
+	}
+	return perm
+}
+
+// formatOwner returns the owner of inode, the owner will fall back to the
+// configured defaults if object doesn't carry it.
+func (fs *FS) formatOwner(i *vfs.Inode, caller *fuse.Caller) (uid, gid uint32) {
+	if fs.callerOwns {
+		return caller.Uid, caller.Gid
+	}
+	if i.HasOwner {
+		return i.Uid, i.Gid
+	}
+	return fs.uid, fs.gid
+}
+
+func (fs *FS) parseAttrUpdate(i *vfs.Inode, input *fuse.SetAttrIn) *vfs.AttrUpdate {
+	u := &vfs.AttrUpdate{}
+	if size, ok := input.GetSize(); ok {
+		u.Size = &size
+	}
+	if mode, ok := input.GetMode(); ok {
+		mode = parsePerm(mode)
+		u.Mode = &mode
+	}
+
+	uid, hasUid := input.GetUID()
+	gid, hasGid := input.GetGID()
+	if hasUid || hasGid {
+		// chown could change only one of them, fill the other with current value.
+		curUid, curGid := fs.formatOwner(i, &input.Caller)
+		if !hasUid {
+			uid = curUid
+		}
+		if !hasGid {
+			gid = curGid
+		}
+		u.Uid, u.Gid = &uid, &gid
+	}
+
+	if atime, ok := input.GetATime(); ok {
+		u.Atime = &atime
+	}
+	if mtime, ok := input.GetMTime(); ok {
+		u.Mtime = &mtime
+	}
+	return u
 }
 
 func (fs *FS) String() string {
@@ -161,6 +396,10 @@ func (fs *FS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string,
 		return fuse.EINVAL
 	}
 
+	if code := fs.checkAccess(ino, &header.Caller, fuse.X_OK); !code.Ok() {
+		return code
+	}
+
 	node, err := fs.fs.GetEntry(ino.ID, name)
 	if err != nil && errors.Is(err, services.ErrObjectNotExist) {
 		return fuse.ENOENT
@@ -172,7 +411,7 @@ func (fs *FS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string,
 	if node == nil {
 		return fuse.ENOENT
 	}
-	return fillEntryOut(node, out)
+	return fs.fillEntryOut(node, out, &header.Caller)
 }
 
 func (fs *FS) Forget(nodeid, nlookup uint64) {
@@ -183,7 +422,7 @@ func (fs *FS) Forget(nodeid, nlookup uint64) {
 }
 
 func (fs *FS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
-	ino, err := fs.fs.GetInode(input.NodeId)
+	ino, err := fs.fs.GetAttr(input.NodeId)
 	if err != nil {
 		fs.logger.Error("internal error",
 			zap.Error(err))
@@ -195,7 +434,7 @@ func (fs *FS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.A
 		return fuse.ENOENT
 	}
 
-	return fillAttrOut(ino, out)
+	return fs.fillAttrOut(ino, out, &input.Caller)
 }
 
 func (fs *FS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) (code fuse.Status) {
@@ -211,9 +450,50 @@ func (fs *FS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.A
 		return fuse.ENOENT
 	}
 
-	// TODO: we need to update attr
+	if code := fs.checkSetAttr(ino, input); !code.Ok() {
+		return code
+	}
 
-	return fillAttrOut(ino, out)
+	u := fs.parseAttrUpdate(ino, input)
+	// ftruncate must go through the handle, otherwise data written via the
+	// handle but not flushed yet will be persisted after the truncate.
+	if fhid, ok := input.GetFh(); ok && u.Size != nil {
+		fh, _ := fs.fs.GetFileHandle(fhid)
+		if fh != nil {
+			err = fh.Truncate(*u.Size)
+			if err != nil {
+				fs.logger.Error("truncate",
+					zap.Uint64("inode", ino.ID),
+					zap.Uint64("file_handle", fhid),
+					zap.Error(err))
+				return parseError(err)
+			}
+
+			// Inode could have been updated by truncate.
+			ino, err = fs.fs.GetAttr(input.NodeId)
+			if err != nil || ino == nil {
+				fs.logger.Error("get inode after truncate",
+					zap.Uint64("inode", input.NodeId),
+					zap.Error(err))
+				return fuse.EAGAIN
+			}
+			if u.Mtime == nil {
+				now := time.Now()
+				u.Mtime = &now
+			}
+			u.Size = nil
+		}
+	}
+
+	err = fs.fs.UpdateAttr(ino, u)
+	if err != nil {
+		fs.logger.Error("update attr",
+			zap.Uint64("inode", ino.ID),
+			zap.Error(err))
+		return parseError(err)
+	}
+
+	return fs.fillAttrOut(ino, out, &input.Caller)
 }
 
 func (fs *FS) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) (code fuse.Status) {
@@ -221,7 +501,39 @@ func (fs *FS) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, ou
 }
 
 func (fs *FS) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) (code fuse.Status) {
-	return fuse.ENOSYS
+	ino, err := fs.fs.GetInode(input.NodeId)
+	if err != nil {
+		fs.logger.Error("internal error",
+			zap.Error(err))
+		return fuse.EAGAIN
+	}
+	if ino == nil {
+		fs.logger.Error("inode not found",
+			zap.Uint64("inode", input.NodeId))
+		return fuse.ENOENT
+	}
+
+	if !ino.IsDir() {
+		fs.logger.Error("parent inode is not a dir",
+			zap.Uint64("parent", input.NodeId),
+			zap.Uint32("mode", ino.Mode))
+		return fuse.ENOTDIR
+	}
+
+	if code := fs.checkAccess(ino, &input.Caller, fuse.W_OK|fuse.X_OK); !code.Ok() {
+		return code
+	}
+
+	i, err := fs.fs.CreateDir(ino.ID, name, &vfs.CreateAttr{
+		Mode: parsePerm(input.Mode &^ input.Umask),
+		Uid:  input.Caller.Uid,
+		Gid:  input.Caller.Gid,
+	})
+	if err != nil {
+		fs.logger.Error("create dir", zap.Error(err))
+		return parseError(err)
+	}
+	return fs.fillEntryOut(i, out, &input.Caller)
 }
 
 func (fs *FS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) (code fuse.Status) {
@@ -244,6 +556,10 @@ func (fs *FS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string)
 		return fuse.EINVAL
 	}
 
+	if code := fs.checkDelete(ino, name, &header.Caller); !code.Ok() {
+		return code
+	}
+
 	err = fs.fs.Delete(ino.ID, name)
 	if err != nil {
 		fs.logger.Error("internal error",
@@ -254,11 +570,79 @@ func (fs *FS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string)
 }
 
 func (fs *FS) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) (code fuse.Status) {
-	return fuse.ENOSYS
+	ino, err := fs.fs.GetInode(header.NodeId)
+	if err != nil {
+		fs.logger.Error("internal error",
+			zap.Error(err))
+		return fuse.EAGAIN
+	}
+	if ino == nil {
+		fs.logger.Error("inode not found",
+			zap.Uint64("inode", header.NodeId))
+		return fuse.ENOENT
+	}
+
+	if !ino.IsDir() {
+		fs.logger.Error("parent inode is not a dir",
+			zap.Uint64("parent", header.NodeId),
+			zap.Uint32("mode", ino.Mode))
+		return fuse.ENOTDIR
+	}
+
+	if code := fs.checkDelete(ino, name, &header.Caller); !code.Ok() {
+		return code
+	}
+
+	err = fs.fs.DeleteDir(ino.ID, name)
+	if err != nil {
+		fs.logger.Error("delete dir", zap.Error(err))
+		return parseError(err)
+	}
+	return fuse.OK
 }
 
 func (fs *FS) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) (code fuse.Status) {
-	return fuse.ENOSYS
+	// Flags of renameat2 like RENAME_NOREPLACE and RENAME_EXCHANGE could not be
+	// done atomically on storage.
+	if input.Flags != 0 {
+		return fuse.EINVAL
+	}
+
+	// Both source and the replaced destination are deleted from their dirs.
+	for _, e := range []struct {
+		dir  uint64
+		name string
+	}{{input.NodeId, oldName}, {input.Newdir, newName}} {
+		ino, err := fs.fs.GetInode(e.dir)
+		if err != nil {
+			fs.logger.Error("internal error",
+				zap.Error(err))
+			return fuse.EAGAIN
+		}
+		if ino == nil {
+			fs.logger.Error("inode not found",
+				zap.Uint64("inode", e.dir))
+			return fuse.ENOENT
+		}
+
+		if !ino.IsDir() {
+			fs.logger.Error("parent inode is not a dir",
+				zap.Uint64("parent", e.dir),
+				zap.Uint32("mode", ino.Mode))
+			return fuse.ENOTDIR
+		}
+
+		if code := fs.checkDelete(ino, e.name, &input.Caller); !code.Ok() {
+			return code
+		}
+	}
+
+	err := fs.fs.Rename(input.NodeId, oldName, input.Newdir, newName)
+	if err != nil {
+		fs.logger.Error("rename", zap.Error(err))
+		return parseError(err)
+	}
+	return fuse.OK
 }
 
 func (fs *FS) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) (code fuse.Status) {
@@ -266,31 +650,236 @@ func (fs *FS) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string,
 }
 
 func (fs *FS) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) (code fuse.Status) {
-	return fuse.ENOSYS
+	ino, err := fs.fs.GetInode(header.NodeId)
+	if err != nil {
+		fs.logger.Error("internal error",
+			zap.Error(err))
+		return fuse.EAGAIN
+	}
+	if ino == nil {
+		fs.logger.Error("inode not found",
+			zap.Uint64("inode", header.NodeId))
+		return fuse.ENOENT
+	}
+
+	if !ino.IsDir() {
+		fs.logger.Error("parent inode is not a dir",
+			zap.Uint64("parent", header.NodeId),
+			zap.Uint32("mode", ino.Mode))
+		return fuse.ENOTDIR
+	}
+
+	if code := fs.checkAccess(ino, &header.Caller, fuse.W_OK|fuse.X_OK); !code.Ok() {
+		return code
+	}
+
+	i, err := fs.fs.CreateSymlink(ino.ID, linkName, pointedTo, &vfs.CreateAttr{
+		Uid: header.Caller.Uid,
+		Gid: header.Caller.Gid,
+	})
+	if err != nil {
+		fs.logger.Error("create symlink", zap.Error(err))
+		return parseError(err)
+	}
+	return fs.fillEntryOut(i, out, &header.Caller)
 }
 
 func (fs *FS) Readlink(cancel <-chan struct{}, header *fuse.InHeader) (out []byte, code fuse.Status) {
-	return nil, fuse.ENOSYS
+	ino, err := fs.fs.GetInode(header.NodeId)
+	if err != nil {
+		fs.logger.Error("internal error",
+			zap.Error(err))
+		return nil, fuse.EAGAIN
+	}
+	if ino == nil {
+		fs.logger.Error("inode not found",
+			zap.Uint64("inode", header.NodeId))
+		return nil, fuse.ENOENT
+	}
+
+	target, err := fs.fs.Readlink(ino)
+	if err != nil {
+		fs.logger.Error("readlink", zap.Error(err))
+		return nil, parseError(err)
+	}
+	return []byte(target), fuse.OK
 }
 
 func (fs *FS) Access(cancel <-chan struct{}, input *fuse.AccessIn) (code fuse.Status) {
-	return fuse.OK
+	ino, err := fs.fs.GetInode(input.NodeId)
+	if err != nil {
+		fs.logger.Error("internal error",
+			zap.Error(err))
+		return fuse.EAGAIN
+	}
+	if ino == nil {
+		fs.logger.Error("inode not found",
+			zap.Uint64("inode", input.NodeId))
+		return fuse.ENOENT
+	}
+
+	return fs.checkAccess(ino, &input.Caller, input.Mask)
 }
 
 func (fs *FS) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (sz uint32, code fuse.Status) {
-	return 0, fuse.ENOSYS
+	if !strings.HasPrefix(attr, xattrUserPrefix) && !strings.HasPrefix(attr, xattrBeyondfsPrefix) {
+		return 0, fuse.ENOATTR
+	}
+
+	ino, err := fs.fs.GetInode(header.NodeId)
+	if err != nil {
+		fs.logger.Error("internal error",
+			zap.Error(err))
+		return 0, fuse.EAGAIN
+	}
+	if ino == nil {
+		fs.logger.Error("inode not found",
+			zap.Uint64("inode", header.NodeId))
+		return 0, fuse.ENOENT
+	}
+
+	if code := fs.checkAccess(ino, &header.Caller, fuse.R_OK); !code.Ok() {
+		return 0, code
+	}
+
+	if strings.HasPrefix(attr, xattrBeyondfsPrefix) {
+		v, ok := formatBeyondfsXAttrs(ino)[attr]
+		if !ok {
+			return 0, fuse.ENOATTR
+		}
+		return fillXAttr([]byte(v), dest)
+	}
+
+	xattrs, err := fs.fs.GetXAttrs(ino)
+	if err != nil {
+		fs.logger.Error("get xattr", zap.Error(err))
+		return 0, parseError(err)
+	}
+	v, ok := xattrs[strings.TrimPrefix(attr, xattrUserPrefix)]
+	if !ok {
+		return 0, fuse.ENOATTR
+	}
+	return fillXAttr([]byte(v), dest)
 }
 
 func (fs *FS) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
-	return 0, fuse.ENOSYS
+	ino, err := fs.fs.GetInode(header.NodeId)
+	if err != nil {
+		fs.logger.Error("internal error",
+			zap.Error(err))
+		return 0, fuse.EAGAIN
+	}
+	if ino == nil {
+		fs.logger.Error("inode not found",
+			zap.Uint64("inode", header.NodeId))
+		return 0, fuse.ENOENT
+	}
+
+	if code := fs.checkAccess(ino, &header.Caller, fuse.R_OK); !code.Ok() {
+		return 0, code
+	}
+
+	xattrs, err := fs.fs.GetXAttrs(ino)
+	if err != nil {
+		fs.logger.Error("get xattr", zap.Error(err))
+		return 0, parseError(err)
+	}
+
+	names := make([]string, 0, len(xattrs))
+	for k := range xattrs {
+		names = append(names, xattrUserPrefix+k)
+	}
+	for k := range formatBeyondfsXAttrs(ino) {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, v := range names {
+		buf.WriteString(v)
+		buf.WriteByte(0)
+	}
+	return fillXAttr(buf.Bytes(), dest)
 }
 
 func (fs *FS) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
-	return fuse.ENOSYS
+	if strings.HasPrefix(attr, xattrBeyondfsPrefix) {
+		return fuse.EPERM
+	}
+	if !strings.HasPrefix(attr, xattrUserPrefix) {
+		return fuse.ENOTSUP
+	}
+
+	ino, err := fs.fs.GetInode(input.NodeId)
+	if err != nil {
+		fs.logger.Error("internal error",
+			zap.Error(err))
+		return fuse.EAGAIN
+	}
+	if ino == nil {
+		fs.logger.Error("inode not found",
+			zap.Uint64("inode", input.NodeId))
+		return fuse.ENOENT
+	}
+
+	if code := fs.checkAccess(ino, &input.Caller, fuse.W_OK); !code.Ok() {
+		return code
+	}
+
+	name := strings.TrimPrefix(attr, xattrUserPrefix)
+	if input.Flags&(xattrCreate|xattrReplace) != 0 {
+		xattrs, err := fs.fs.GetXAttrs(ino)
+		if err != nil {
+			fs.logger.Error("get xattr", zap.Error(err))
+			return parseError(err)
+		}
+		_, ok := xattrs[name]
+		if ok && input.Flags&xattrCreate != 0 {
+			return fuse.Status(syscall.EEXIST)
+		}
+		if !ok && input.Flags&xattrReplace != 0 {
+			return fuse.ENOATTR
+		}
+	}
+
+	err = fs.fs.SetXAttr(ino, name, string(data))
+	if err != nil {
+		fs.logger.Error("set xattr", zap.Error(err))
+		return parseError(err)
+	}
+	return fuse.OK
 }
 
 func (fs *FS) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) (code fuse.Status) {
-	return fuse.ENOSYS
+	if strings.HasPrefix(attr, xattrBeyondfsPrefix) {
+		return fuse.EPERM
+	}
+	if !strings.HasPrefix(attr, xattrUserPrefix) {
+		return fuse.ENOATTR
+	}
+
+	ino, err := fs.fs.GetInode(header.NodeId)
+	if err != nil {
+		fs.logger.Error("internal error",
+			zap.Error(err))
+		return fuse.EAGAIN
+	}
+	if ino == nil {
+		fs.logger.Error("inode not found",
+			zap.Uint64("inode", header.NodeId))
+		return fuse.ENOENT
+	}
+
+	if code := fs.checkAccess(ino, &header.Caller, fuse.W_OK); !code.Ok() {
+		return code
+	}
+
+	err = fs.fs.RemoveXAttr(ino, strings.TrimPrefix(attr, xattrUserPrefix))
+	if err != nil {
+		fs.logger.Error("remove xattr", zap.Error(err))
+		return parseError(err)
+	}
+	return fuse.OK
 }
 
 func (fs *FS) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) (code fuse.Status) {
@@ -313,15 +902,23 @@ func (fs *FS) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string,
 		return fuse.EINVAL
 	}
 
-	i, fh, err := fs.fs.Create(ino.ID, name)
+	if code := fs.checkAccess(ino, &input.Caller, fuse.W_OK|fuse.X_OK); !code.Ok() {
+		return code
+	}
+
+	i, fh, err := fs.fs.Create(ino.ID, name, &vfs.CreateAttr{
+		Mode: parsePerm(input.Mode &^ input.Umask),
+		Uid:  input.Caller.Uid,
+		Gid:  input.Caller.Gid,
+	}, int(input.Flags))
 	if err != nil {
 		fs.logger.Error("create", zap.Error(err))
-		return fuse.EAGAIN
+		return parseError(err)
 	}
 	fs.logger.Info("start fill open out")
 	fillOpenOut(fh, &out.OpenOut)
 	fs.logger.Info("start fill entry out")
-	fillEntryOut(i, &out.EntryOut)
+	fs.fillEntryOut(i, &out.EntryOut, &input.Caller)
 	return fuse.OK
 }
 
@@ -338,16 +935,14 @@ func (fs *FS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut
 		return fuse.ENOENT
 	}
 
-	fh, err := fs.fs.CreateFileHandle(ino)
-	if err != nil {
-		fs.logger.Error("create file handle", zap.Error(err))
-		return
+	if code := fs.checkAccess(ino, &input.Caller, parseOpenMask(input.Flags)); !code.Ok() {
+		return code
 	}
-	if input.Flags&uint32(os.O_WRONLY) != 0 {
-		err = fh.PrepareForWrite()
-		if err != nil {
-			panic(fmt.Errorf("prepare for write: %v", err))
-		}
+
+	fh, err := fs.fs.OpenFileHandle(ino, int(input.Flags))
+	if err != nil {
+		fs.logger.Error("open file handle", zap.Error(err))
+		return parseError(err)
 	}
 	return fillOpenOut(fh, out)
 }
@@ -362,7 +957,7 @@ func (fs *FS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse
 	n, err := fh.Read(input.Offset, buf)
 	if err != nil {
 		fs.logger.Error("read", zap.Error(err))
-		return nil, fuse.EAGAIN
+		return nil, parseError(err)
 	}
 	return fuse.ReadResultData(buf[:n]), fuse.OK
 }
@@ -372,19 +967,55 @@ func (fs *FS) Lseek(cancel <-chan struct{}, in *fuse.LseekIn, out *fuse.LseekOut
 }
 
 func (fs *FS) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) (code fuse.Status) {
-	return fuse.ENOSYS
+	lk, err := fs.fs.GetLock(input.NodeId, parseLock(input))
+	if err != nil {
+		fs.logger.Error("get lock", zap.Error(err))
+		return parseError(err)
+	}
+
+	out.Lk = fuse.FileLock{
+		Start: lk.Start,
+		End:   lk.End,
+		Typ:   formatLockType(lk.Type),
+		Pid:   lk.Pid,
+	}
+	return fuse.OK
 }
 
 func (fs *FS) SetLk(cancel <-chan struct{}, input *fuse.LkIn) (code fuse.Status) {
-	return fuse.ENOSYS
+	err := fs.fs.SetLock(input.NodeId, parseLock(input))
+	if err != nil {
+		return parseError(err)
+	}
+	return fuse.OK
 }
 
 func (fs *FS) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) (code fuse.Status) {
-	return fuse.ENOSYS
+	err := fs.fs.SetLockWait(cancel, input.NodeId, parseLock(input))
+	if err != nil {
+		return parseError(err)
+	}
+	return fuse.OK
 }
 
 func (fs *FS) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
-	err := fs.fs.DeleteFileHandle(input.Fh)
+	err := fs.fs.ReleaseLocks(input.NodeId, input.LockOwner, false)
+	if err != nil {
+		fs.logger.Error("release locks",
+			zap.Uint64("inode", input.NodeId),
+			zap.Error(err))
+	}
+	// flock locks are held until the last fd of the open file closed.
+	if input.ReleaseFlags&releaseFlockUnlock != 0 {
+		err = fs.fs.ReleaseLocks(input.NodeId, input.LockOwner, true)
+		if err != nil {
+			fs.logger.Error("release flock",
+				zap.Uint64("inode", input.NodeId),
+				zap.Error(err))
+		}
+	}
+
+	err = fs.fs.DeleteFileHandle(input.Fh)
 	if err != nil {
 		fs.logger.Error("release",
 			zap.Uint64("file_handle", input.Fh),
@@ -401,8 +1032,8 @@ func (fs *FS) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (w
 
 	n, err := fh.Write(input.Offset, data)
 	if err != nil {
-		fs.logger.Error("read", zap.Error(err))
-		return uint32(n), fuse.EAGAIN
+		fs.logger.Error("write", zap.Error(err))
+		return uint32(n), parseError(err)
 	}
 	return uint32(n), fuse.OK
 }
@@ -412,11 +1043,52 @@ func (fs *FS) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn)
 }
 
 func (fs *FS) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
-	// FIXME: maybe we need to write data here.
+	// POSIX locks will be released while any fd of the file closed by the owner.
+	err := fs.fs.ReleaseLocks(input.NodeId, input.LockOwner, false)
+	if err != nil {
+		fs.logger.Error("release locks",
+			zap.Uint64("inode", input.NodeId),
+			zap.Error(err))
+	}
+
+	fh, err := fs.fs.GetFileHandle(input.Fh)
+	if err != nil {
+		fs.logger.Error("get file handle", zap.Error(err))
+		return fuse.EAGAIN
+	}
+	if fh == nil {
+		return fuse.OK
+	}
+
+	err = fh.Flush()
+	if err != nil {
+		fs.logger.Error("flush",
+			zap.Uint64("file_handle", input.Fh),
+			zap.Error(err))
+		return fuse.EIO
+	}
 	return fuse.OK
 }
 
 func (fs *FS) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) (code fuse.Status) {
+	fh, err := fs.fs.GetFileHandle(input.Fh)
+	if err != nil {
+		fs.logger.Error("get file handle", zap.Error(err))
+		return fuse.EAGAIN
+	}
+	if fh == nil {
+		return fuse.OK
+	}
+
+	err = fh.Flush()
+	if err != nil {
+		// Data failed to be uploaded is reported as EIO like close, callers
+		// should not retry on it.
+		fs.logger.Error("fsync",
+			zap.Uint64("file_handle", input.Fh),
+			zap.Error(err))
+		return fuse.EIO
+	}
 	return fuse.OK
 }
 
@@ -444,6 +1116,10 @@ func (fs *FS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.Open
 		return fuse.EINVAL
 	}
 
+	if code := fs.checkAccess(ino, &input.Caller, fuse.R_OK); !code.Ok() {
+		return code
+	}
+
 	dh, err := fs.fs.CreateDirHandle(ino)
 	if err != nil {
 		fs.logger.Error("open dir",
@@ -474,7 +1150,7 @@ func (fs *FS) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirE
 		}
 
 		ok := out.AddDirEntry(fuse.DirEntry{
-			Mode: parseMode(node.Mode),
+			Mode: parseType(node.Mode),
 			Name: node.Name,
 			Ino:  node.ID,
 		})
@@ -503,14 +1179,19 @@ func (fs *FS) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.
 		}
 
 		entry := out.AddDirLookupEntry(fuse.DirEntry{
-			Mode: parseMode(node.Mode),
+			Mode: parseType(node.Mode),
 			Name: node.Name,
 			Ino:  node.ID,
 		})
 		if entry == nil {
 			break
 		}
-		fillEntryOut(node, entry)
+		if node.Incomplete {
+			// Leave the entry empty so that kernel will look it up to get
+			// attributes carried by object.
+			continue
+		}
+		fs.fillEntryOut(node, entry, &input.Caller)
 	}
 	return fuse.OK
 }
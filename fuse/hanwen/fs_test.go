@@ -0,0 +1,173 @@
+package hanwen
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+
+	memory "github.com/beyondstorage/go-service-memory"
+	"github.com/beyondstorage/go-storage/v4/services"
+	"github.com/beyondstorage/go-storage/v4/types"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"go.uber.org/zap"
+
+	"github.com/beyondstorage/beyond-fs/vfs"
+)
+
+// failWriteType is the memory storage failing writes of data.
+const failWriteType = "failwrite"
+
+func init() {
+	services.RegisterSchema(failWriteType, map[string]string{})
+	services.RegisterStorager(failWriteType, newFailWriteStorage)
+}
+
+// failWriteStorage only exposes basic operations of memory storage, so data
+// written will be uploaded via Write while flushing.
+type failWriteStorage struct {
+	types.Storager
+}
+
+func newFailWriteStorage(ps ...types.Pair) (types.Storager, error) {
+	store, err := memory.NewStorager()
+	if err != nil {
+		return nil, err
+	}
+	return &failWriteStorage{Storager: store}, nil
+}
+
+func (st *failWriteStorage) Write(path string, r io.Reader, size int64, ps ...types.Pair) (n int64, err error) {
+	if size == 0 {
+		// Memory storage fails on empty reader.
+		_, err = st.Storager.Write(path, r, size, ps...)
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		return 0, err
+	}
+	// Not retryable, and not mapped by parseError either.
+	return 0, services.ErrRestrictionDissatisfied
+}
+
+// newTestVFS returns a vfs over storagePath and the id of its root dir, which
+// is only the root of fuse in the first vfs of process.
+func newTestVFS(t *testing.T, storagePath string) (*vfs.FS, uint64) {
+	vfsFS, err := vfs.NewFS(&vfs.Config{
+		StoragePath: storagePath,
+		Logger:      zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = vfsFS.Close() })
+
+	root := &vfs.Inode{ID: vfs.NextInodeID(), Mode: uint32(os.ModeDir)}
+	err = vfsFS.SetInode(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return vfsFS, root.ID
+}
+
+func TestFsyncUploadFailed(t *testing.T) {
+	fs := newTestFS()
+	vfsFS, root := newTestVFS(t, failWriteType+"://")
+	fs.fs = vfsFS
+
+	_, fh, err := vfsFS.Create(root, "a", &vfs.CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Random writes go through staging file, which is uploaded while flushing.
+	_, err = fh.Write(4, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := fs.Fsync(nil, &fuse.FsyncIn{Fh: fh.ID})
+	if code != fuse.EIO {
+		t.Errorf("expect EIO, got %v", code)
+	}
+}
+
+func TestParseLockFlock(t *testing.T) {
+	input := &fuse.LkIn{
+		Owner: 1,
+		Lk:    fuse.FileLock{Start: 10, End: 20, Typ: syscall.F_WRLCK},
+	}
+	lk := parseLock(input)
+	if lk.Flock || lk.Start != 10 || lk.End != 20 {
+		t.Errorf("expect fcntl lock of [10, 20], got %+v", lk)
+	}
+
+	// flock locks the whole file.
+	input.LkFlags = fuse.FUSE_LK_FLOCK
+	lk = parseLock(input)
+	if !lk.Flock || lk.Start != 0 || lk.End != vfs.LockEOF || lk.Type != vfs.LockWrite {
+		t.Errorf("expect flock of whole file, got %+v", lk)
+	}
+}
+
+func TestParseErrorBadHandle(t *testing.T) {
+	// Writes to read only handles fail with EBADF like write(2).
+	code := parseError(fmt.Errorf("write: %w", vfs.ErrBadHandle))
+	if code != fuse.EBADF {
+		t.Errorf("expect EBADF, got %v", code)
+	}
+}
+
+func TestGetAttrDefaults(t *testing.T) {
+	dir := t.TempDir()
+	fs := newTestFS()
+	vfsFS, root := newTestVFS(t, "fs://"+dir)
+	fs.fs = vfsFS
+	fs.uid, fs.gid, fs.umask = 1001, 1002, 0027
+
+	// Objects written by others carry no attributes.
+	err := ioutil.WriteFile(dir+"/a", []byte("hello"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Mkdir(dir+"/d", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, fh, err := vfsFS.Create(root, "b", &vfs.CreateAttr{Mode: 0660, Uid: 5, Gid: 6}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = vfsFS.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name     string
+		mode     uint32
+		uid, gid uint32
+	}{
+		{"a", syscall.S_IFREG | 0640, 1001, 1002},
+		{"d", syscall.S_IFDIR | 0750, 1001, 1002},
+		// Umask applies to attributes carried by objects as well.
+		{"b", syscall.S_IFREG | 0640, 5, 6},
+	}
+	for _, tt := range cases {
+		ino, err := vfsFS.GetEntry(root, tt.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := &fuse.AttrOut{}
+		code := fs.GetAttr(nil, &fuse.GetAttrIn{InHeader: fuse.InHeader{NodeId: ino.ID}}, out)
+		if !code.Ok() {
+			t.Fatalf("%s: expect ok, got %v", tt.name, code)
+		}
+		if out.Mode != tt.mode || out.Uid != tt.uid || out.Gid != tt.gid {
+			t.Errorf("%s: expect mode %o owned by %d:%d, got %o owned by %d:%d",
+				tt.name, tt.mode, tt.uid, tt.gid, out.Mode, out.Uid, out.Gid)
+		}
+	}
+}
@@ -4,6 +4,8 @@ go 1.15
 
 require (
 	github.com/Xuanwo/go-bufferpool v0.2.0
+	github.com/aws/aws-sdk-go v1.40.58
+	github.com/beyondstorage/go-endpoint v1.1.0
 	github.com/beyondstorage/go-service-fs/v3 v3.5.0
 	github.com/beyondstorage/go-service-memory v0.3.0
 	github.com/beyondstorage/go-service-s3/v2 v2.5.0
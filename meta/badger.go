@@ -10,11 +10,14 @@ type badgerDB struct {
 	db *badger.DB
 }
 
-func NewBadger() (Service, error) {
-	db, err := badger.Open(badger.DefaultOptions("").
+// NewBadger will create a badger based meta service.
+//
+// Data will be persisted under path, or kept in memory if path is empty.
+func NewBadger(path string) (Service, error) {
+	db, err := badger.Open(badger.DefaultOptions(path).
 		WithLogger(nil).
 		WithMetricsEnabled(false).
-		WithInMemory(true))
+		WithInMemory(path == ""))
 	if err != nil {
 		return nil, fmt.Errorf("new pebble: %w", err)
 	}
@@ -71,45 +74,61 @@ func (db badgerDB) PrefixDelete(prefix []byte) (err error) {
 	it := txn.NewIterator(badger.IteratorOptions{
 		Prefix: prefix,
 	})
-	defer it.Close()
 
 	for it.Rewind(); it.Valid(); it.Next() {
 		item := it.Item()
-		err = txn.Delete(item.Key())
+		err = txn.Delete(item.KeyCopy(nil))
 		if err != nil {
+			it.Close()
 			return err
 		}
 	}
+	// Txn could not be committed with iterators open.
+	it.Close()
 
 	return txn.Commit()
 }
 
 func (db badgerDB) Scan(prefix []byte) Iterator {
+	// txn will be discarded while iterator closed.
 	txn := db.db.NewTransaction(false)
-	defer txn.Discard()
 
 	it := txn.NewIterator(badger.IteratorOptions{
 		Prefix: prefix,
 	})
 	it.Rewind()
 
-	return badgerIterator{it: it}
+	return &badgerIterator{txn: txn, it: it, positioned: true}
+}
+
+func (db badgerDB) Close() (err error) {
+	return db.db.Close()
 }
 
 type badgerIterator struct {
-	it *badger.Iterator
+	txn *badger.Txn
+	it  *badger.Iterator
+
+	// positioned means the iterator already points to the entry that should be
+	// returned after next Next call.
+	positioned bool
 }
 
-func (b badgerIterator) Next() bool {
-	b.it.Next()
+func (b *badgerIterator) Next() bool {
+	if b.positioned {
+		b.positioned = false
+	} else {
+		b.it.Next()
+	}
 	return b.it.Valid()
 }
 
-func (b badgerIterator) Seek(key []byte) {
+func (b *badgerIterator) Seek(key []byte) {
 	b.it.Seek(key)
+	b.positioned = true
 }
 
-func (b badgerIterator) Entry() (key, value []byte, err error) {
+func (b *badgerIterator) Entry() (key, value []byte, err error) {
 	item := b.it.Item()
 
 	key = item.KeyCopy(nil)
@@ -117,7 +136,8 @@ func (b badgerIterator) Entry() (key, value []byte, err error) {
 	return
 }
 
-func (b badgerIterator) Close() {
+func (b *badgerIterator) Close() {
 	b.it.Close()
 	b.it = nil
+	b.txn.Discard()
 }
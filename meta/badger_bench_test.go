@@ -6,7 +6,7 @@ import (
 )
 
 func BenchmarkGet(b *testing.B) {
-	srv, err := NewBadger()
+	srv, err := NewBadger("")
 	if err != nil {
 		b.Error(err)
 		return
@@ -27,7 +27,7 @@ func BenchmarkGet(b *testing.B) {
 }
 
 func BenchmarkSet(b *testing.B) {
-	srv, err := NewBadger()
+	srv, err := NewBadger("")
 	if err != nil {
 		b.Error(err)
 		return
@@ -9,8 +9,26 @@ var (
 	inodePrefix = []byte("i:")
 	// d:<ino>:<name> => Inode
 	dirPrefix = []byte("d:")
+	// r:<id> => RenameJournal
+	renamePrefix = []byte("r:")
+	// m:<ino> => Manifest
+	manifestPrefix = []byte("m:")
+	// u:<path> => Metadata
+	metadataPrefix = []byte("u:")
+	// p:<multipart id> => first seen time
+	multipartPrefix = []byte("p:")
 )
 
+// InodePrefix returns the prefix of all inode keys.
+func InodePrefix() []byte {
+	return inodePrefix
+}
+
+// DirPrefix returns the prefix of all entry keys.
+func DirPrefix() []byte {
+	return dirPrefix
+}
+
 func InodeKey(id uint64) []byte {
 	buf := pool.Get()
 	defer buf.Free()
@@ -43,3 +61,68 @@ func EntryPrefix(id uint64) []byte {
 
 	return buf.BytesCopy()
 }
+
+func RenameKey(id uint64) []byte {
+	buf := pool.Get()
+	defer buf.Free()
+
+	buf.AppendBytes(renamePrefix)
+	buf.AppendUint(id)
+
+	return buf.BytesCopy()
+}
+
+// RenamePrefix returns the prefix of all rename journal keys.
+func RenamePrefix() []byte {
+	return renamePrefix
+}
+
+func ManifestKey(id uint64) []byte {
+	buf := pool.Get()
+	defer buf.Free()
+
+	buf.AppendBytes(manifestPrefix)
+	buf.AppendUint(id)
+
+	return buf.BytesCopy()
+}
+
+// ManifestPrefix returns the prefix of all manifest keys.
+func ManifestPrefix() []byte {
+	return manifestPrefix
+}
+
+// MetadataKey returns the key of object's user metadata.
+//
+// Metadata is keyed by object path instead of inode id, so that it will be
+// kept across mounts.
+func MetadataKey(path string) []byte {
+	buf := pool.Get()
+	defer buf.Free()
+
+	buf.AppendBytes(metadataPrefix)
+	buf.AppendString(path)
+
+	return buf.BytesCopy()
+}
+
+// MetadataPrefix returns the prefix of all metadata keys.
+func MetadataPrefix() []byte {
+	return metadataPrefix
+}
+
+// MultipartKey returns the key of the time an incomplete multipart first seen.
+func MultipartKey(id string) []byte {
+	buf := pool.Get()
+	defer buf.Free()
+
+	buf.AppendBytes(multipartPrefix)
+	buf.AppendString(id)
+
+	return buf.BytesCopy()
+}
+
+// MultipartPrefix returns the prefix of all multipart keys.
+func MultipartPrefix() []byte {
+	return multipartPrefix
+}
@@ -9,9 +9,14 @@ type Service interface {
 	Delete(key []byte) (err error)
 	PrefixDelete(prefix []byte) (err error)
 	Scan(prefix []byte) Iterator
+	// Close will release the service, data will be flushed if persisted.
+	Close() (err error)
 }
 
 type Iterator interface {
+	// Next will move to the next entry, and returns false if no entries left.
+	//
+	// Next must be called before reading the first entry.
 	Next() bool
 	Seek(key []byte)
 	Entry() (key, value []byte, err error)
@@ -0,0 +1,139 @@
+package vfs
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/beyondstorage/go-storage/v4/services"
+	"github.com/beyondstorage/go-storage/v4/types"
+	"go.uber.org/zap"
+)
+
+// appendCopySize is the size of pieces while copying existing data for appending.
+const appendCopySize = 4 * 1024 * 1024
+
+// PrepareForAppend prepares the file handle for appending, all writes will
+// happen at the end of file.
+//
+// Appendable objects will be appended via Appender directly. Otherwise, the
+// existing data will be copied into the write session before appending.
+func (fh *FileHandle) PrepareForAppend() (err error) {
+	fh.mu.Lock()
+	fh.append = true
+	chunked := fh.manifest != nil
+	fh.mu.Unlock()
+
+	// Chunked file supports writes at any offset already.
+	if chunked {
+		return nil
+	}
+
+	if a, ok := fh.fs.s.(types.Appender); ok {
+		o, err := fh.fs.s.Stat(fh.ino.Path)
+		if err != nil && !errors.Is(err, services.ErrObjectNotExist) {
+			return err
+		}
+		if err == nil && o.Mode.IsAppend() {
+			fh.mu.Lock()
+			defer fh.mu.Unlock()
+
+			fh.appender = a
+			fh.appendObject = o
+			if n, ok := o.GetContentLength(); ok {
+				fh.size = uint64(n)
+			}
+			return nil
+		}
+	}
+
+	err = fh.PrepareForWrite()
+	if err != nil {
+		return
+	}
+	// New file is stored in chunked layout.
+	if fh.manifest != nil {
+		return nil
+	}
+
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+	return fh.copyForAppend()
+}
+
+// copyForAppend copies the existing data into the write session.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) copyForAppend() (err error) {
+	// Batch small reads into bigger pieces.
+	sw := &sessionWriter{fh: fh}
+	w := bufio.NewWriterSize(sw, appendCopySize)
+	_, err = fh.fs.s.Read(fh.ino.Path, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil && !errors.Is(err, services.ErrObjectNotExist) {
+		// Existing data must not be replaced by the partial copy.
+		fh.cache.abortWrite(fh.ID)
+		fh.writing = false
+		return
+	}
+
+	fh.fs.logger.Info("copy for append",
+		zap.String("path", fh.ino.Path),
+		zap.Uint64("size", fh.offset))
+	fh.size = fh.offset
+	return nil
+}
+
+// writeAppend appends data via Appender.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) writeAppend(buf []byte) (n int, err error) {
+	written, err := fh.appender.WriteAppend(fh.appendObject, bytes.NewReader(buf), int64(len(buf)))
+	if err != nil {
+		return
+	}
+
+	fh.dirty = true
+	fh.size += uint64(written)
+	fh.offset = fh.size
+	return int(written), nil
+}
+
+// commitAppend commits the appended data and updates the inode.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) commitAppend() (err error) {
+	if !fh.dirty {
+		return nil
+	}
+
+	err = fh.appender.CommitAppend(fh.appendObject)
+	if err != nil {
+		return
+	}
+	fh.dirty = false
+	fh.fs.invalidateBlocks(fh.ino.Path)
+
+	fh.ino.Size = fh.size
+	fh.ino.Mtime = time.Now()
+	fh.fs.refreshObject(fh.ino)
+	return fh.fs.SetInode(fh.ino)
+}
+
+// sessionWriter writes data into the write session of file handle.
+type sessionWriter struct {
+	fh *FileHandle
+}
+
+func (w *sessionWriter) Write(p []byte) (n int, err error) {
+	written, err := w.fh.cache.write(w.fh.ID, p)
+	if err != nil {
+		return
+	}
+	w.fh.idx += 1
+	w.fh.offset += uint64(written)
+	return int(written), nil
+}
@@ -0,0 +1,135 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/beyondstorage/go-storage/v4/types"
+)
+
+func TestAppendAppender(t *testing.T) {
+	fs, root := newTestFS(t, "memory://", "")
+	defer fs.Close()
+
+	a := fs.s.(types.Appender)
+	o, err := a.CreateAppend("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.WriteAppend(o, bytes.NewReader([]byte("hello")), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.CommitAppend(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ino, err := fs.GetEntry(root, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, err := fs.OpenFileHandle(ino, os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fh.appendObject == nil {
+		t.Fatal("expect appendable object appended via Appender")
+	}
+	// Offset from kernel is ignored while appending.
+	_, err = fh.Write(0, []byte(" world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fh.writing {
+		t.Error("expect no write session started")
+	}
+	writeFile(t, fs, fh, 0, "!")
+
+	var buf bytes.Buffer
+	_, err = fs.s.Read("a", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hello world!" {
+		t.Errorf("expect hello world!, got %q", buf.String())
+	}
+	if ino, err = fs.GetInode(ino.ID); err != nil || ino.Size != 12 {
+		t.Errorf("expect size 12, got %+v, %v", ino, err)
+	}
+}
+
+func TestAppendCopy(t *testing.T) {
+	fs, root := newTestFS(t, flatType+"://", "")
+	defer fs.Close()
+
+	ino, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, fh, 0, "hello")
+
+	// Storage without Appender copies existing data before appending.
+	fh, err = fs.OpenFileHandle(ino, os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fh.appendObject != nil || fh.size != 5 {
+		t.Errorf("expect existing data copied, got size %d", fh.size)
+	}
+	writeFile(t, fs, fh, 0, " world")
+
+	var buf bytes.Buffer
+	_, err = fs.s.Read("a", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hello world" {
+		t.Errorf("expect hello world, got %q", buf.String())
+	}
+}
+
+func TestAppendCopyFailed(t *testing.T) {
+	fs, root := newTestFS(t, flatType+"://", "")
+	defer fs.Close()
+
+	ino, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, fh, 0, "hello")
+
+	st := fs.s.(*flatStorage)
+	readErr := errors.New("read failed")
+	st.mu.Lock()
+	st.readErr = readErr
+	st.mu.Unlock()
+	_, err = fs.OpenFileHandle(ino, os.O_WRONLY|os.O_APPEND)
+	if !errors.Is(err, readErr) {
+		t.Errorf("expect read failed, got %v", err)
+	}
+	st.mu.Lock()
+	st.readErr = nil
+	st.mu.Unlock()
+
+	// Partial copy is aborted instead of replacing the object.
+	fs.cache.chunkLock.Lock()
+	sessions := len(fs.cache.chunks)
+	fs.cache.chunkLock.Unlock()
+	if sessions != 0 {
+		t.Errorf("expect session aborted, got %d sessions", sessions)
+	}
+	if n := fs.DirtyBytes(); n != 0 {
+		t.Errorf("expect no dirty bytes, got %d", n)
+	}
+	var buf bytes.Buffer
+	_, err = fs.s.Read("a", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hello" {
+		t.Errorf("expect hello kept, got %q", buf.String())
+	}
+}
@@ -0,0 +1,210 @@
+package vfs
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/beyondstorage/go-storage/v4/pairs"
+	"github.com/beyondstorage/go-storage/v4/types"
+)
+
+// permBits are the bits of mode that could be changed by chmod, including the
+// sticky bit which restricts deletion in a dir.
+const permBits = uint32(os.ModePerm | os.ModeSticky)
+
+// AttrUpdate is the attributes to be updated, nil fields will be left untouched.
+type AttrUpdate struct {
+	Size *uint64
+	// Mode only contains the permission bits and the sticky bit.
+	Mode  *uint32
+	Uid   *uint32
+	Gid   *uint32
+	Atime *time.Time
+	Mtime *time.Time
+}
+
+// CreateAttr is the attributes of a newly created inode, which will be stored
+// in object's user metadata.
+type CreateAttr struct {
+	// Mode only contains the permission bits and the sticky bit.
+	Mode uint32
+	Uid  uint32
+	Gid  uint32
+}
+
+// formatMetadata returns the user metadata of object with the file type.
+func (a *CreateAttr) formatMetadata(typ os.FileMode, mtime time.Time) Metadata {
+	ino := &Inode{
+		Mode:     uint32(typ) | a.Mode&permBits,
+		Uid:      a.Uid,
+		Gid:      a.Gid,
+		Mtime:    mtime,
+		HasMode:  true,
+		HasOwner: true,
+	}
+
+	m := make(Metadata)
+	formatAttrMetadata(ino, m)
+	return m
+}
+
+// UpdateAttr will apply the update on inode.
+//
+// Size change will rewrite the object. Other changes will be persisted in inode,
+// and in object's user metadata if PersistAttr enabled.
+func (fs *FS) UpdateAttr(ino *Inode, u *AttrUpdate) (err error) {
+	now := time.Now()
+	changed := false
+
+	if u.Mode != nil {
+		ino.Mode = ino.Mode&^permBits | *u.Mode&permBits
+		ino.HasMode = true
+		changed = true
+	}
+	if u.Uid != nil && u.Gid != nil {
+		ino.Uid = *u.Uid
+		ino.Gid = *u.Gid
+		ino.HasOwner = true
+		changed = true
+	}
+	if u.Atime != nil {
+		ino.Atime = *u.Atime
+		changed = true
+	}
+	if u.Mtime != nil {
+		ino.Mtime = *u.Mtime
+		changed = true
+	}
+
+	// Dir could be a virtual one without object, only keep the attr in inode.
+	if u.Size != nil && !ino.IsDir() && *u.Size != ino.Size {
+		err = fs.truncate(ino, *u.Size)
+		if err != nil {
+			return
+		}
+		ino.Size = *u.Size
+		if u.Mtime == nil {
+			ino.Mtime = now
+		}
+		changed = true
+	}
+	if changed && fs.persistAttr {
+		err = fs.persistAttrMetadata(ino)
+		if err != nil {
+			return
+		}
+	}
+
+	ino.Ctime = now
+	return fs.SetInode(ino)
+}
+
+// persistAttrMetadata will store the attributes of inode into object's user metadata.
+func (fs *FS) persistAttrMetadata(ino *Inode) (err error) {
+	m, err := fs.getMetadata(ino.Path)
+	if err != nil {
+		return
+	}
+	if m == nil {
+		m = make(Metadata)
+	}
+	formatAttrMetadata(ino, m)
+	return fs.updateMetadata(ino, m)
+}
+
+// truncate will rewrite the object with new size, user metadata will be kept.
+//
+// Truncate to zero doesn't need to read anything, so an empty object will be written.
+func (fs *FS) truncate(ino *Inode, size uint64) (err error) {
+	if ino.Chunked {
+		return fs.truncateManifest(ino, size)
+	}
+	err = fs.rewriteObject(ino.Path, int64(size))
+	if err != nil {
+		return
+	}
+	fs.refreshObject(ino)
+	return nil
+}
+
+// rewriteObject will rewrite the object in place with new size.
+//
+// Data will be truncated or padded with zero. go-storage doesn't have an API to
+// truncate objects, so we have to read the object and write it back. Data will
+// be spooled into a temp file under staging dir first, because some storage
+// truncates the object while opening it for writing.
+func (fs *FS) rewriteObject(path string, size int64) (err error) {
+	o, err := fs.s.Stat(path)
+	if err != nil {
+		return
+	}
+	current, _ := o.GetContentLength()
+
+	f, err := ioutil.TempFile(fs.stagingDir, "beyondfs-rewrite-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	n := size
+	if n > current {
+		n = current
+	}
+	if n > 0 {
+		_, err = fs.s.Read(path, f, pairs.WithSize(n))
+		if err != nil {
+			return
+		}
+	}
+	// Truncate will fill the extended part with zero.
+	err = f.Truncate(size)
+	if err != nil {
+		return
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+
+	// Keep content type, it's used to recognise manifests.
+	var ps []types.Pair
+	if v, ok := o.GetContentType(); ok {
+		ps = append(ps, pairs.WithContentType(v))
+	}
+
+	_, err = fs.writeObject(path, f, size, nil, ps...)
+	return err
+}
+
+// writeObject will write object and replace its user metadata with m, user
+// metadata will be kept if m is nil.
+func (fs *FS) writeObject(path string, r io.Reader, size int64, m Metadata, ps ...types.Pair) (n int64, err error) {
+	defer fs.invalidateBlocks(path)
+
+	ms, ok := fs.s.(metadataStorer)
+	if !ok {
+		n, err = fs.s.Write(path, r, size, ps...)
+		if err != nil || m == nil {
+			return
+		}
+		return n, fs.cacheMetadata(path, m)
+	}
+
+	// Writing data replaces the metadata carried by object.
+	if m == nil {
+		m, err = fs.getMetadata(path)
+		if err != nil {
+			return
+		}
+	}
+	n, err = ms.writeWithMetadata(path, r, size, m, ps...)
+	if err != nil {
+		return
+	}
+	return n, fs.cacheMetadata(path, m)
+}
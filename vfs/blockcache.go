@@ -0,0 +1,451 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beyondstorage/go-storage/v4/pairs"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+const (
+	// blockSize is the size of blocks kept in block cache.
+	blockSize = 1024 * 1024
+	// defaultBlockCacheSize is the capacity of block cache if not specified.
+	defaultBlockCacheSize = 1024 * 1024 * 1024
+
+	// blockHeaderSize is the size of crc32 checksum before the block data.
+	blockHeaderSize = 4
+	// blockTempPrefix is the prefix of blocks being written, they will be
+	// removed while loading.
+	blockTempPrefix = "tmp-"
+)
+
+var errBlockCorrupted = errors.New("block corrupted")
+
+// BlockCache keeps fixed-size blocks of objects in local dir, so that data read
+// again will not touch the storage.
+//
+// Blocks are keyed by path and version of object, so blocks of a changed object
+// will never be hit and will be evicted at last. Every block carries a crc32
+// checksum which is verified on every hit.
+type BlockCache struct {
+	dir      string
+	capacity uint64
+	logger   *zap.Logger
+
+	hits   *atomic.Uint64
+	misses *atomic.Uint64
+
+	lock   sync.Mutex
+	size   uint64
+	policy EvictionPolicy
+	// blocks are the sizes of blocks indexed by the dir of path first, so that
+	// blocks of a path could be invalidated together.
+	blocks map[string]map[string]uint64
+	// generation will be increased after every invalidation, blocks read from
+	// storage before invalidation could be stale and will not be cached.
+	generation uint64
+}
+
+// BlockCacheStats is the statistics of block cache.
+type BlockCacheStats struct {
+	Policy string
+	Hits   uint64
+	Misses uint64
+	Blocks int
+	Size   uint64
+}
+
+// NewBlockCache creates a block cache in dir, blocks left by last mount will be loaded.
+//
+// LRU will be used if policy is nil.
+func NewBlockCache(dir string, capacity uint64, policy EvictionPolicy, logger *zap.Logger) (bc *BlockCache, err error) {
+	if capacity == 0 {
+		capacity = defaultBlockCacheSize
+	}
+	if policy == nil {
+		policy = newLRUPolicy()
+	}
+
+	bc = &BlockCache{
+		dir:      dir,
+		capacity: capacity,
+		logger:   logger,
+
+		hits:   atomic.NewUint64(0),
+		misses: atomic.NewUint64(0),
+
+		policy: policy,
+		blocks: make(map[string]map[string]uint64),
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("create block cache dir: %w", err)
+	}
+	err = bc.load()
+	if err != nil {
+		return nil, fmt.Errorf("load block cache: %w", err)
+	}
+	return bc, nil
+}
+
+// blockKey returns the key of block, the key is also the relative path of block
+// file: blocks of the same path share a dir so that they could be invalidated together.
+func blockKey(path, version string, idx uint64) string {
+	return fmt.Sprintf("%s/%s-%d", hashString(path), hashString(version), idx)
+}
+
+func hashString(s string) string {
+	h := sha1.Sum([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// load will rebuild the index from block files, recently modified blocks will
+// be evicted at last.
+func (bc *BlockCache) load() (err error) {
+	type file struct {
+		key   string
+		size  uint64
+		mtime time.Time
+	}
+	files := make([]file, 0)
+
+	err = filepath.Walk(bc.dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(fi.Name(), blockTempPrefix) {
+			return os.Remove(p)
+		}
+
+		rel, err := filepath.Rel(bc.dir, p)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{
+			key:   filepath.ToSlash(rel),
+			size:  uint64(fi.Size()),
+			mtime: fi.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].mtime.Before(files[j].mtime)
+	})
+	for _, f := range files {
+		bc.add(f.key, f.size)
+	}
+	bc.evict()
+
+	bc.logger.Info("load block cache",
+		zap.String("dir", bc.dir),
+		zap.String("policy", bc.policy.Name()),
+		zap.Uint64("size", bc.size))
+	return nil
+}
+
+// add indexes the block.
+//
+// Caller must hold bc.lock.
+func (bc *BlockCache) add(key string, size uint64) {
+	dir := path.Dir(key)
+	if old, ok := bc.blocks[dir][key]; ok {
+		bc.size -= old
+	} else if bc.blocks[dir] == nil {
+		bc.blocks[dir] = make(map[string]uint64)
+	}
+	bc.blocks[dir][key] = size
+	bc.size += size
+	bc.policy.Add(key)
+}
+
+// delete removes the block from index, ok will be false if block is not indexed.
+//
+// Caller must hold bc.lock.
+func (bc *BlockCache) delete(key string) (ok bool) {
+	dir := path.Dir(key)
+	size, ok := bc.blocks[dir][key]
+	if !ok {
+		return false
+	}
+	bc.size -= size
+	delete(bc.blocks[dir], key)
+	if len(bc.blocks[dir]) == 0 {
+		delete(bc.blocks, dir)
+	}
+	return true
+}
+
+// Stats returns the statistics of block cache.
+func (bc *BlockCache) Stats() BlockCacheStats {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	blocks := 0
+	for _, v := range bc.blocks {
+		blocks += len(v)
+	}
+	return BlockCacheStats{
+		Policy: bc.policy.Name(),
+		Hits:   bc.hits.Load(),
+		Misses: bc.misses.Load(),
+		Blocks: blocks,
+		Size:   bc.size,
+	}
+}
+
+// Generation returns the current generation, it should be got before reading
+// from storage and passed to Put.
+func (bc *BlockCache) Generation() uint64 {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	return bc.generation
+}
+
+// Get returns the data of block, ok will be false if block is not cached.
+func (bc *BlockCache) Get(key string) (data []byte, ok bool) {
+	bc.lock.Lock()
+	_, ok = bc.blocks[path.Dir(key)][key]
+	if ok {
+		bc.policy.Access(key)
+	}
+	bc.lock.Unlock()
+	if !ok {
+		bc.misses.Inc()
+		return nil, false
+	}
+
+	data, err := bc.readBlock(key)
+	if err != nil {
+		bc.logger.Warn("read block", zap.String("key", key), zap.Error(err))
+		bc.remove(key)
+		bc.misses.Inc()
+		return nil, false
+	}
+	bc.hits.Inc()
+	return data, true
+}
+
+func (bc *BlockCache) readBlock(key string) (data []byte, err error) {
+	bs, err := ioutil.ReadFile(filepath.Join(bc.dir, filepath.FromSlash(key)))
+	if err != nil {
+		return
+	}
+	if len(bs) < blockHeaderSize {
+		return nil, errBlockCorrupted
+	}
+	data = bs[blockHeaderSize:]
+	if binary.BigEndian.Uint32(bs) != crc32.ChecksumIEEE(data) {
+		return nil, errBlockCorrupted
+	}
+	return data, nil
+}
+
+// Put adds the block read in generation into cache, errors will only be logged
+// because the block could always be read from storage.
+func (bc *BlockCache) Put(key string, data []byte, generation uint64) {
+	if bc.Generation() != generation {
+		return
+	}
+
+	size, err := bc.writeBlock(key, data)
+	if err != nil {
+		bc.logger.Warn("write block", zap.String("key", key), zap.Error(err))
+		return
+	}
+
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	// Object could be changed while writing the block.
+	if bc.generation != generation {
+		bc.removeFile(key)
+		return
+	}
+	bc.add(key, size)
+	bc.evict()
+}
+
+// writeBlock writes block into a temp file and renames it, so that a block
+// file is either complete or missing.
+func (bc *BlockCache) writeBlock(key string, data []byte) (size uint64, err error) {
+	p := filepath.Join(bc.dir, filepath.FromSlash(key))
+	err = os.MkdirAll(filepath.Dir(p), 0700)
+	if err != nil {
+		return
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(p), blockTempPrefix)
+	if err != nil {
+		return
+	}
+	header := make([]byte, blockHeaderSize)
+	binary.BigEndian.PutUint32(header, crc32.ChecksumIEEE(data))
+	_, err = f.Write(append(header, data...))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return
+	}
+
+	err = os.Rename(f.Name(), p)
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return
+	}
+	return uint64(blockHeaderSize + len(data)), nil
+}
+
+// Invalidate removes all blocks of the path, it should be called after the
+// object changed via this mount.
+func (bc *BlockCache) Invalidate(p string) {
+	dir := hashString(p)
+
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	bc.generation++
+	for key := range bc.blocks[dir] {
+		bc.delete(key)
+		bc.policy.Remove(key)
+	}
+	err := os.RemoveAll(filepath.Join(bc.dir, dir))
+	if err != nil {
+		bc.logger.Warn("invalidate blocks", zap.String("path", p), zap.Error(err))
+	}
+}
+
+func (bc *BlockCache) remove(key string) {
+	bc.lock.Lock()
+	defer bc.lock.Unlock()
+
+	if bc.delete(key) {
+		bc.policy.Remove(key)
+		bc.removeFile(key)
+	}
+}
+
+// evict removes blocks chosen by policy until size is under capacity.
+//
+// Caller must hold bc.lock.
+func (bc *BlockCache) evict() {
+	for bc.size > bc.capacity {
+		key, ok := bc.policy.Evict()
+		if !ok {
+			return
+		}
+		if bc.delete(key) {
+			bc.removeFile(key)
+		}
+	}
+}
+
+func (bc *BlockCache) removeFile(key string) {
+	err := os.Remove(filepath.Join(bc.dir, filepath.FromSlash(key)))
+	if err != nil && !os.IsNotExist(err) {
+		bc.logger.Warn("remove block", zap.String("key", key), zap.Error(err))
+	}
+}
+
+// objectVersion returns the version used in block key, size and last modified
+// will be used if storage doesn't return etag.
+func objectVersion(ino *Inode) string {
+	if ino.Etag != "" {
+		return ino.Etag
+	}
+	return fmt.Sprintf("%d-%d", ino.Size, ino.LastModified.UnixNano())
+}
+
+// readCached reads data of object at offset into buf via block cache.
+func (fs *FS) readCached(path, version string, offset uint64, buf []byte) (n int, err error) {
+	for n < len(buf) {
+		pos := offset + uint64(n)
+		idx := pos / blockSize
+
+		data, err := fs.readBlock(path, version, idx)
+		if err != nil {
+			return n, err
+		}
+		off := pos - idx*blockSize
+		if off >= uint64(len(data)) {
+			break
+		}
+		n += copy(buf[n:], data[off:])
+		// Block shorter than block size is the last one.
+		if len(data) < blockSize {
+			break
+		}
+	}
+	return n, nil
+}
+
+// readBlock reads the whole block from block cache or storage.
+func (fs *FS) readBlock(path, version string, idx uint64) (data []byte, err error) {
+	key := blockKey(path, version, idx)
+	if data, ok := fs.blockCache.Get(key); ok {
+		return data, nil
+	}
+
+	generation := fs.blockCache.Generation()
+	var b bytes.Buffer
+	_, err = fs.s.Read(path, &b,
+		pairs.WithOffset(int64(idx*blockSize)),
+		pairs.WithSize(blockSize))
+	if err != nil {
+		return
+	}
+	data = b.Bytes()
+	// Storage could ignore the size.
+	if len(data) > blockSize {
+		data = data[:blockSize]
+	}
+	fs.blockCache.Put(key, data, generation)
+	return data, nil
+}
+
+// BlockCacheStats returns the statistics of block cache, ok will be false if
+// block cache is not enabled.
+func (fs *FS) BlockCacheStats() (stats BlockCacheStats, ok bool) {
+	if fs.blockCache == nil {
+		return BlockCacheStats{}, false
+	}
+	return fs.blockCache.Stats(), true
+}
+
+// invalidateBlocks drops cached blocks after the object changed, data prefetched
+// by handles opened for it will be dropped as well.
+func (fs *FS) invalidateBlocks(path string) {
+	for _, fh := range fs.fhm.ListPath(path) {
+		fh.raStale.Store(true)
+	}
+	if fs.blockCache == nil {
+		return
+	}
+	fs.blockCache.Invalidate(path)
+}
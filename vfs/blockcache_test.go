@@ -0,0 +1,94 @@
+package vfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestBlockCacheEvict(t *testing.T) {
+	dir := t.TempDir()
+	bc, err := NewBlockCache(dir, 2*(blockHeaderSize+4), nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bc.Put(blockKey("a", "v1", 0), []byte("aaaa"), bc.Generation())
+	bc.Put(blockKey("b", "v1", 0), []byte("bbbb"), bc.Generation())
+	// Touch a so that b will be evicted.
+	if _, ok := bc.Get(blockKey("a", "v1", 0)); !ok {
+		t.Fatal("expect a cached")
+	}
+	bc.Put(blockKey("c", "v1", 0), []byte("cccc"), bc.Generation())
+
+	if _, ok := bc.Get(blockKey("b", "v1", 0)); ok {
+		t.Error("expect b evicted")
+	}
+	for _, p := range []string{"a", "c"} {
+		if _, ok := bc.Get(blockKey(p, "v1", 0)); !ok {
+			t.Errorf("expect %s cached", p)
+		}
+	}
+
+	// Blocks should be kept across restarts.
+	bc, err = NewBlockCache(dir, 2*(blockHeaderSize+4), nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, ok := bc.Get(blockKey("c", "v1", 0))
+	if !ok || !bytes.Equal(data, []byte("cccc")) {
+		t.Errorf("expect c loaded, got %q", data)
+	}
+}
+
+func TestBlockCacheInvalidate(t *testing.T) {
+	bc, err := NewBlockCache(t.TempDir(), 0, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gen := bc.Generation()
+	bc.Put(blockKey("a", "v1", 0), []byte("aaaa"), gen)
+	bc.Put(blockKey("a", "v1", 1), []byte("aaaa"), gen)
+	bc.Invalidate("a")
+	for i := uint64(0); i < 2; i++ {
+		if _, ok := bc.Get(blockKey("a", "v1", i)); ok {
+			t.Errorf("expect block %d invalidated", i)
+		}
+	}
+
+	// Block read before invalidation could be stale.
+	bc.Put(blockKey("a", "v1", 0), []byte("aaaa"), gen)
+	if _, ok := bc.Get(blockKey("a", "v1", 0)); ok {
+		t.Error("expect stale block dropped")
+	}
+}
+
+func TestBlockCacheChecksum(t *testing.T) {
+	dir := t.TempDir()
+	bc, err := NewBlockCache(dir, 0, nil, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := blockKey("a", "v1", 0)
+	bc.Put(key, []byte("aaaa"), bc.Generation())
+
+	p := filepath.Join(dir, filepath.FromSlash(key))
+	bs, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs[len(bs)-1] = 'b'
+	err = ioutil.WriteFile(p, bs, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := bc.Get(key); ok {
+		t.Error("expect corrupted block dropped")
+	}
+}
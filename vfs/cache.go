@@ -2,19 +2,37 @@ package vfs
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"regexp"
 	"sync"
+	"time"
 
+	"github.com/beyondstorage/go-storage/v4/pairs"
+	"github.com/beyondstorage/go-storage/v4/services"
 	"github.com/beyondstorage/go-storage/v4/types"
 	"github.com/panjf2000/ants/v2"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
-type op struct {
-	fd   uint64
-	size int64
-}
+const (
+	// defaultPartSize is the size of parts persisted in background if not specified.
+	defaultPartSize = 64 * 1024 * 1024
+	// minPartSize is the min size of a part except the last one if storage
+	// doesn't tell, session with less dirty data can't be persisted before completed.
+	minPartSize = 5 * 1024 * 1024
+	// defaultDirtyLimit is the max bytes of dirty data if not specified.
+	defaultDirtyLimit = 1024 * 1024 * 1024
+	// defaultUploadConcurrency is the number of parts uploaded at the same time
+	// if not specified.
+	defaultUploadConcurrency = 10
+)
+
+// errNoPart means the session has no part to persist for now, parts being
+// persisted in background will release its dirty bytes later.
+var errNoPart = errors.New("no part to persist")
 
 type chunk struct {
 	lock sync.Mutex
@@ -27,6 +45,17 @@ type chunk struct {
 	persistedSize int64
 	nextIdx       uint64
 	currentSize   int64
+	// metadata is the user metadata of the object, it's written along with
+	// data if storage carries user metadata.
+	metadata Metadata
+	// sizes are the sizes of pieces in order, so that data could be located
+	// for reading before the session completed.
+	sizes []int64
+	// sealedIdx is the number of sealed pieces, only sealed pieces could be
+	// persisted as parts in background.
+	sealedIdx uint64
+	// piece is the piece being appended, it's only accessed by the writer.
+	piece *types.Object
 
 	// If we have CreateMultipart or CreateAppend, we will store the object here.
 	// So we can check if object == nil to decide use CompleteMultipart or call Write.
@@ -35,99 +64,453 @@ type chunk struct {
 	// Only valid if we have already called CreateMultipart.
 	parts          map[int]*types.Part
 	nextPartNumber int
+
+	// dirtySize is the bytes reserved by this session which are not released yet.
+	dirtySize int64
+	// inflight is the number of parts claimed but not persisted yet.
+	inflight int
+
+	// notify wakes up the scheduler of this session after data written.
+	notify chan struct{}
+	// done will be closed after the scheduler exited.
+	done chan struct{}
+	// createLock serializes creating multipart without holding lock, so that
+	// writes of this session will not wait for the storage.
+	createLock sync.Mutex
+
+	// err is the first error failed the session, data written could not be
+	// persisted anymore once set.
+	err error
+}
+
+// part is a range of pieces to be persisted as a multipart part.
+type part struct {
+	start, end uint64
+	size       int64
+	number     int
 }
 
-func newChunk(fd uint64, path string) *chunk {
+func newChunk(fd uint64, path string, m Metadata) *chunk {
 	return &chunk{
-		wg:   &sync.WaitGroup{},
-		fd:   fd,
-		path: path,
+		wg:       &sync.WaitGroup{},
+		fd:       fd,
+		path:     path,
+		metadata: m,
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
 	}
 }
 
+// Cache keeps data being written in cache store and uploads it in background.
+//
+// Every write session has its own scheduler to claim parts, and parts of all
+// sessions are uploaded by the shared pool, so that a slow session will not
+// block writes of others.
 type Cache struct {
 	s      types.Storager // Real data store
 	c      types.Storager // Cache data store
 	logger *zap.Logger
 
-	p  *ants.Pool
-	ch chan op
+	p *ants.Pool
+
+	// Writes are appended into pieces in cache store, and a piece will be
+	// sealed as a part once it reaches partSize.
+	partSize    int64
+	minPartSize int64
+
+	// dirty is the bytes written into cache store which are not persisted yet,
+	// writes beyond dirtyLimit will persist data synchronously, or wait for
+	// parts persisted in background.
+	dirty      *atomic.Int64
+	dirtyLimit int64
+	// released is broadcast after dirty bytes released or parts persisted.
+	releaseLock sync.Mutex
+	released    *sync.Cond
 
 	chunks    map[uint64]*chunk
 	chunkLock sync.Mutex
 }
 
-func NewCache(s, c types.Storager, logger *zap.Logger) *Cache {
+// NewCache creates the write cache, parts will be uploaded by pool p.
+//
+// defaultDirtyLimit and defaultPartSize will be used if dirtyLimit or partSize
+// is zero, and partSize will be adjusted to the multipart limits of storage.
+func NewCache(s, c types.Storager, p *ants.Pool, dirtyLimit, partSize int64, logger *zap.Logger) *Cache {
+	if dirtyLimit == 0 {
+		dirtyLimit = defaultDirtyLimit
+	}
+
+	meta := s.Metadata()
+	minSize := int64(minPartSize)
+	if v, ok := meta.GetMultipartSizeMinimum(); ok {
+		minSize = v
+	}
+	if partSize == 0 {
+		partSize = defaultPartSize
+	}
+	if partSize < minSize {
+		partSize = minSize
+	}
+	if v, ok := meta.GetMultipartSizeMaximum(); ok && partSize > v {
+		partSize = v
+	}
+
 	cache := &Cache{
 		s:      s,
 		c:      c,
+		p:      p,
 		logger: logger,
+
+		partSize:    partSize,
+		minPartSize: minSize,
+
+		dirty:      atomic.NewInt64(0),
+		dirtyLimit: dirtyLimit,
+
+		chunks: make(map[uint64]*chunk),
 	}
+	cache.released = sync.NewCond(&cache.releaseLock)
+	return cache
+}
 
-	p, err := ants.NewPool(10)
+// checkCacheStorage makes sure the storage could be used as cache store, data
+// appended into it should be read back at any offset and deleted.
+func checkCacheStorage(s types.Storager) (err error) {
+	a, ok := s.(types.Appender)
+	if !ok {
+		return errors.New("append is not supported")
+	}
+
+	p := fmt.Sprintf("beyondfs-probe-%d", time.Now().UnixNano())
+	data := []byte("beyondfs")
+
+	o, err := a.CreateAppend(p)
+	if err != nil {
+		return fmt.Errorf("create append: %w", err)
+	}
+	_, err = a.WriteAppend(o, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("write append: %w", err)
+	}
+	err = a.CommitAppend(o)
 	if err != nil {
-		panic(fmt.Errorf("new pool: %v", err))
+		return fmt.Errorf("commit append: %w", err)
 	}
 
-	cache.p = p
-	cache.ch = make(chan op)
-	cache.chunks = make(map[uint64]*chunk)
-	return cache
+	var buf bytes.Buffer
+	_, err = s.Read(p, &buf, pairs.WithOffset(2), pairs.WithSize(4))
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), data[2:6]) {
+		return fmt.Errorf("read at offset: expect %q, got %q", data[2:6], buf.Bytes())
+	}
+
+	err = s.Delete(p)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	return nil
 }
 
-func (c *Cache) Start() {
-	for v := range c.ch {
-		c.chunkLock.Lock()
-		chk := c.chunks[v.fd]
-		c.chunkLock.Unlock()
+// piecePattern matches the paths of pieces, other objects in cache storage
+// don't belong to us.
+var piecePattern = regexp.MustCompile(`^[0-9]+-[0-9]+$`)
 
-		chk.lock.Lock()
-		chk.nextIdx += 1
-		chk.currentSize += v.size
-		chk.lock.Unlock()
+// piecePath returns the path of idx-th piece of the session of fd.
+func piecePath(fd, idx uint64) string {
+	return fmt.Sprintf("%d-%d", fd, idx)
+}
 
-		// Skip persistViaWriteMultipart write operation if we don't have enough data.
-		if chk.currentSize-chk.persistedSize < 64*1024*1024 {
+// cleanCacheStorage removes pieces left by sessions of last mount.
+func cleanCacheStorage(s types.Storager) (err error) {
+	it, err := s.List("", pairs.WithListMode(types.ListModeDir))
+	if err != nil {
+		return fmt.Errorf("list: %w", err)
+	}
+	for {
+		o, err := it.Next()
+		if err != nil && errors.Is(err, types.IterateDone) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("list: %w", err)
+		}
+		if o.Mode.IsDir() || !piecePattern.MatchString(o.Path) {
 			continue
 		}
 
-		chk.lock.Lock()
+		err = s.Delete(o.Path)
+		if err != nil && !errors.Is(err, services.ErrObjectNotExist) {
+			return fmt.Errorf("delete %s: %w", o.Path, err)
+		}
+	}
+}
 
-		if chk.object == nil {
-			o, err := c.s.(types.Multiparter).CreateMultipart(chk.path)
+// schedule claims sealed pieces of the session as parts and submits them to
+// the pool until the session ended.
+func (c *Cache) schedule(chk *chunk) {
+	defer close(chk.done)
+
+	for range chk.notify {
+		// Data will be written in single write operation while completing.
+		if _, ok := c.s.(types.Multiparter); !ok {
+			continue
+		}
+
+		for chk.failed() == nil {
+			pt, err := c.claimPart(chk)
 			if err != nil {
-				c.logger.Fatal("create multipart", zap.Error(err))
+				c.fail(chk, fmt.Errorf("create multipart: %w", err))
+				break
+			}
+			if pt == nil {
+				break
 			}
+			c.submitPart(chk, pt)
+		}
+	}
+}
+
+// fail records err as the error of session and returns the first error, the
+// session could not be completed anymore.
+func (c *Cache) fail(chk *chunk, err error) error {
+	chk.lock.Lock()
+	if chk.err == nil {
+		c.logger.Error("write session failed",
+			zap.String("path", chk.path),
+			zap.Error(err))
+		chk.err = fmt.Errorf("%w: %v", ErrIO, err)
+	}
+	err = chk.err
+	chk.lock.Unlock()
 
-			chk.object = o
-			chk.parts = make(map[int]*types.Part)
+	// Writer waiting for the budget should fail fast as well.
+	c.wakeReleased()
+	return err
+}
+
+// failed returns the error of session, nil means the session is still healthy.
+func (chk *chunk) failed() error {
+	chk.lock.Lock()
+	defer chk.lock.Unlock()
+
+	return chk.err
+}
+
+// stopSchedule stops the scheduler of session and waits for it, no part will
+// be claimed in background after returned.
+func (c *Cache) stopSchedule(chk *chunk) {
+	close(chk.notify)
+	<-chk.done
+}
+
+// submitPart persists the part via pool, chk.wg will be done after persisted.
+func (c *Cache) submitPart(chk *chunk, pt *part) {
+	chk.wg.Add(1)
+	err := c.p.Submit(func() {
+		defer chk.wg.Done()
+
+		err := c.persistViaWriteMultipart(chk, pt.start, pt.end, pt.size, pt.number)
+		if err != nil {
+			c.fail(chk, fmt.Errorf("write multipart: %w", err))
 		}
+	})
+	if err != nil {
+		chk.wg.Done()
+		c.fail(chk, fmt.Errorf("submit task: %w", err))
+	}
+}
 
-		start := chk.persistedIdx
-		end := chk.nextIdx
-		size := chk.currentSize - chk.persistedSize
-		partNumber := chk.nextPartNumber
-		chk.persistedSize = chk.currentSize
-		chk.persistedIdx = chk.nextIdx
-		chk.nextPartNumber += 1
-		chk.lock.Unlock()
+// claimPart claims the next sealed piece as a new part, nil will be returned
+// if there is no sealed piece left.
+func (c *Cache) claimPart(chk *chunk) (pt *part, err error) {
+	if !chk.hasPart() {
+		return nil, nil
+	}
+	err = c.createMultipart(chk)
+	if err != nil {
+		return nil, err
+	}
 
-		chk.wg.Add(1)
-		err := c.p.Submit(func() {
-			defer chk.wg.Done()
+	chk.lock.Lock()
+	defer chk.lock.Unlock()
 
-			err := c.persistViaWriteMultipart(chk, start, end, size, partNumber)
-			if err != nil {
-				c.logger.Error("persistViaWriteMultipart", zap.Error(err))
-			}
-		})
+	// Piece could be claimed by others while creating multipart.
+	if !chk.hasPartLocked() {
+		return nil, nil
+	}
+	size := chk.sizes[chk.persistedIdx]
+	pt = &part{
+		start:  chk.persistedIdx,
+		end:    chk.persistedIdx + 1,
+		size:   size,
+		number: chk.nextPartNumber,
+	}
+	chk.persistedSize += size
+	chk.persistedIdx += 1
+	chk.nextPartNumber += 1
+	chk.inflight += 1
+	return pt, nil
+}
+
+func (chk *chunk) hasPart() bool {
+	chk.lock.Lock()
+	defer chk.lock.Unlock()
+
+	return chk.hasPartLocked()
+}
+
+// hasPartLocked checks whether there is any sealed piece not claimed.
+//
+// Caller must hold chk.lock.
+func (chk *chunk) hasPartLocked() bool {
+	return chk.persistedIdx < chk.sealedIdx
+}
+
+// createMultipart creates the multipart of session if not created.
+func (c *Cache) createMultipart(chk *chunk) (err error) {
+	chk.createLock.Lock()
+	defer chk.createLock.Unlock()
+
+	chk.lock.Lock()
+	created := chk.object != nil
+	chk.lock.Unlock()
+	if created {
+		return nil
+	}
+
+	var o *types.Object
+	err = retry(c.logger, "create multipart", func() error {
+		if ms, ok := c.s.(metadataStorer); ok {
+			o, err = ms.createMultipartWithMetadata(chk.path, chk.metadata)
+		} else {
+			o, err = c.s.(types.Multiparter).CreateMultipart(chk.path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	chk.lock.Lock()
+	chk.object = o
+	chk.parts = make(map[int]*types.Part)
+	chk.lock.Unlock()
+	return nil
+}
+
+// persistPart persists dirty data of the session synchronously, so that the
+// dirty bytes could be released. errNoPart will be returned if there is no
+// part could be persisted now.
+func (c *Cache) persistPart(chk *chunk) (err error) {
+	if _, ok := c.s.(types.Multiparter); !ok {
+		return errNoPart
+	}
+
+	// Piece being appended could be sealed earlier as long as it's large enough.
+	chk.lock.Lock()
+	size := chk.sizes[len(chk.sizes)-1]
+	chk.lock.Unlock()
+	if chk.piece != nil && size >= c.minPartSize {
+		err = c.seal(chk)
 		if err != nil {
-			c.logger.Fatal("submit task", zap.Error(err))
+			return c.fail(chk, fmt.Errorf("seal piece: %w", err))
+		}
+	}
+
+	pt, err := c.claimPart(chk)
+	if err != nil {
+		return c.fail(chk, fmt.Errorf("create multipart: %w", err))
+	}
+	if pt == nil {
+		return errNoPart
+	}
+
+	chk.wg.Add(1)
+	defer chk.wg.Done()
+	err = c.persistViaWriteMultipart(chk, pt.start, pt.end, pt.size, pt.number)
+	if err != nil {
+		return c.fail(chk, fmt.Errorf("write multipart: %w", err))
+	}
+	return nil
+}
+
+// reserve takes size bytes from the dirty budget for the session.
+//
+// If the budget is exhausted, the session will persist its parts synchronously,
+// or wait for its parts persisted in background. Session without dirty data or
+// parts in flight is always allowed to write, so that writers will not wait
+// for each other, and the budget could be exceeded by less than a part per
+// session then.
+func (c *Cache) reserve(chk *chunk, size int64) (err error) {
+	for {
+		if c.dirty.Add(size) <= c.dirtyLimit {
+			return nil
+		}
+		c.dirty.Sub(size)
+
+		chk.lock.Lock()
+		dirtySize := chk.dirtySize
+		chk.lock.Unlock()
+		if dirtySize == 0 {
+			break
+		}
+
+		err = c.persistPart(chk)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, errNoPart) {
+			return err
+		}
+		if !c.waitRelease(chk, size) {
+			break
 		}
 	}
+
+	c.dirty.Add(size)
+	return nil
+}
+
+// waitRelease waits until the budget has room for size bytes, or parts of
+// the session in flight are all persisted. It returns false if there is
+// nothing to wait.
+func (c *Cache) waitRelease(chk *chunk, size int64) bool {
+	c.releaseLock.Lock()
+	defer c.releaseLock.Unlock()
+
+	waited := false
+	for c.dirty.Load()+size > c.dirtyLimit {
+		chk.lock.Lock()
+		wait := chk.inflight > 0 && chk.err == nil
+		chk.lock.Unlock()
+		if !wait {
+			break
+		}
+		c.released.Wait()
+		waited = true
+	}
+	return waited || c.dirty.Load()+size <= c.dirtyLimit
+}
+
+// wakeReleased wakes up writers waiting for the budget.
+func (c *Cache) wakeReleased() {
+	c.releaseLock.Lock()
+	c.released.Broadcast()
+	c.releaseLock.Unlock()
 }
 
 func (c *Cache) complete(chk *chunk) error {
+	err := chk.failed()
+	if err != nil {
+		return err
+	}
+	err = c.seal(chk)
+	if err != nil {
+		return err
+	}
+
 	// object == nil means data is small enough to complete in single write operation.
 	// We can persist it via write.
 	if chk.object == nil {
@@ -138,105 +521,143 @@ func (c *Cache) complete(chk *chunk) error {
 		return c.persistViaWrite(chk, start, end, size)
 	}
 
-	// Check for dirty data.
-	//
-	// persistedIdx < nextIdx means we still have data to write.
-	if chk.persistedIdx < chk.nextIdx {
-		start := chk.persistedIdx
-		end := chk.nextIdx
-		size := chk.currentSize - chk.persistedSize
-		partNumber := chk.nextPartNumber
-
-		chk.wg.Add(1)
-		err := c.p.Submit(func() {
-			defer chk.wg.Done()
-
-			err := c.persistViaWriteMultipart(chk, start, end, size, partNumber)
-			if err != nil {
-				c.logger.Error("persistViaWriteMultipart", zap.Error(err))
-			}
-		})
+	// Persist pieces left, the last one is allowed to be smaller than minPartSize.
+	for {
+		pt, err := c.claimPart(chk)
 		if err != nil {
-			c.logger.Fatal("submit task", zap.Error(err))
+			return err
 		}
+		if pt == nil {
+			break
+		}
+		c.submitPart(chk, pt)
 	}
 
 	// It's safe to complete the multipart after wait.
 	chk.wg.Wait()
 
+	// Parts failed to persist are missing, the multipart must not be completed.
+	err = chk.failed()
+	if err != nil {
+		return err
+	}
+
 	parts := make([]*types.Part, 0, len(chk.parts))
 	for i := 0; i < len(chk.parts); i++ {
 		parts = append(parts, chk.parts[i])
 	}
 
-	err := c.s.(types.Multiparter).CompleteMultipart(chk.object, parts)
-	if err != nil {
-		return err
-	}
-	return nil
+	return retry(c.logger, "complete multipart", func() error {
+		return c.s.(types.Multiparter).CompleteMultipart(chk.object, parts)
+	})
 }
 
 func (c *Cache) persistViaWrite(chk *chunk, start, end uint64, size int64) error {
-	r, err := c.read(chk.fd, start, end)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		err = r.Close()
+	// Data will be read from cache store again for every retry.
+	return retry(c.logger, "write", func() error {
+		r, err := c.read(chk.fd, start, end)
 		if err != nil {
-			c.logger.Error("close reader", zap.Error(err))
-			return
+			return err
 		}
-	}()
+		defer c.closeReader(r)
 
-	_, err = c.s.Write(chk.path, r, size)
-	if err != nil {
-		c.logger.Error("write", zap.Error(err))
-		return err
-	}
-
-	err = r.Close()
-	if err != nil {
-		c.logger.Error("close", zap.Error(err))
+		if ms, ok := c.s.(metadataStorer); ok {
+			_, err = ms.writeWithMetadata(chk.path, r, size, chk.metadata)
+		} else {
+			_, err = c.s.Write(chk.path, r, size)
+		}
 		return err
-	}
-	return nil
+	})
 }
 
+// persistViaWriteMultipart persists the pieces as a part claimed before.
+//
+// Pieces will be removed from cache store once the part persisted, so data of
+// them could not be read from the session anymore.
 func (c *Cache) persistViaWriteMultipart(chk *chunk, start, end uint64, size int64, partNumber int) error {
-	r, err := c.read(chk.fd, start, end)
-	if err != nil {
-		return err
-	}
 	defer func() {
-		err = r.Close()
+		chk.lock.Lock()
+		chk.inflight -= 1
+		chk.lock.Unlock()
+		c.wakeReleased()
+	}()
+
+	var part *types.Part
+	err := retry(c.logger, "write multipart", func() error {
+		r, err := c.read(chk.fd, start, end)
 		if err != nil {
-			c.logger.Error("close reader", zap.Error(err))
-			return
+			return err
 		}
-	}()
+		defer c.closeReader(r)
 
-	_, part, err := c.s.(types.Multiparter).WriteMultipart(chk.object, r, size, partNumber)
+		_, part, err = c.s.(types.Multiparter).WriteMultipart(chk.object, r, size, partNumber)
+		return err
+	})
 	if err != nil {
-		c.logger.Error("write", zap.Error(err))
 		return err
 	}
 
 	chk.lock.Lock()
 	chk.parts[partNumber] = part
 	chk.lock.Unlock()
+
+	// Data has been persisted, remove it to make room for other writes.
+	c.deletePieces(chk.fd, start, end)
+	c.release(chk, size)
+	return nil
+}
+
+// release returns dirty bytes of session to the budget.
+func (c *Cache) release(chk *chunk, size int64) {
+	chk.lock.Lock()
+	chk.dirtySize -= size
+	chk.lock.Unlock()
+
+	c.dirty.Sub(size)
+	c.wakeReleased()
+}
+
+// DirtyBytes returns the bytes written into cache store which are not persisted yet.
+func (c *Cache) DirtyBytes() int64 {
+	return c.dirty.Load()
+}
+
+// reserveDirty takes size bytes from the dirty budget for data kept outside of
+// cache store like dirty chunks.
+//
+// If the budget is exhausted, flush will be called to persist dirty data of the
+// caller, and the caller is always allowed to take it then, so that callers will
+// not wait for each other.
+func (c *Cache) reserveDirty(size int64, flush func() error) (err error) {
+	if c.dirty.Add(size) <= c.dirtyLimit {
+		return nil
+	}
+	c.dirty.Sub(size)
+
+	err = flush()
+	if err != nil {
+		return
+	}
+	c.dirty.Add(size)
 	return nil
 }
 
+// releaseDirty returns the bytes taken via reserveDirty to the budget.
+func (c *Cache) releaseDirty(size int64) {
+	c.dirty.Sub(size)
+	c.wakeReleased()
+}
+
 func (c *Cache) read(fd, start, end uint64) (r io.ReadCloser, err error) {
 	r, w := io.Pipe()
 
 	go func() {
 		for i := start; i < end; i++ {
-			p := fmt.Sprintf("%d-%d", fd, i)
+			p := piecePath(fd, i)
 			_, err := c.c.Read(p, w)
 			if err != nil {
-				c.logger.Error("read", zap.Error(err))
+				// Reader will get the error instead of waiting for data.
+				_ = w.CloseWithError(err)
 				return
 			}
 		}
@@ -250,47 +671,311 @@ func (c *Cache) read(fd, start, end uint64) (r io.ReadCloser, err error) {
 	return r, nil
 }
 
-func (c *Cache) startWrite(fd uint64, path string) (err error) {
+// closeReader closes the reader returned by read, so that the reading
+// goroutine will exit even if data is not fully read.
+func (c *Cache) closeReader(r io.ReadCloser) {
+	err := r.Close()
+	if err != nil {
+		c.logger.Error("close reader", zap.Error(err))
+	}
+}
+
+// startWrite starts the write session of fd, the object will carry m if storage
+// carries user metadata.
+func (c *Cache) startWrite(fd uint64, path string, m Metadata) (err error) {
+	chk := newChunk(fd, path, m)
+	go c.schedule(chk)
+
 	c.chunkLock.Lock()
 	// FIXME: maybe we need to check the fd before set.
-	c.chunks[fd] = newChunk(fd, path)
+	c.chunks[fd] = chk
 	c.chunkLock.Unlock()
 	return nil
 }
 
-func (c *Cache) write(fd, idx uint64, data []byte) (n int64, err error) {
-	p := fmt.Sprintf("%d-%d", fd, idx)
+// abortWrite drops the session and its data without persisting it, parts
+// persisted will be dropped by aborting the multipart.
+func (c *Cache) abortWrite(fd uint64) {
+	c.chunkLock.Lock()
+	chk := c.chunks[fd]
+	delete(c.chunks, fd)
+	c.chunkLock.Unlock()
+	if chk == nil {
+		return
+	}
+
+	c.stopSchedule(chk)
+	chk.wg.Wait()
+	c.abortMultipart(chk)
+	c.deletePieces(fd, 0, chk.nextIdx)
+	chk.lock.Lock()
+	dirtySize := chk.dirtySize
+	chk.lock.Unlock()
+	c.release(chk, dirtySize)
+}
+
+// multipartCreated checks whether the multipart of session has been created, so
+// that data written is bound to the path.
+func (c *Cache) multipartCreated(fd uint64) bool {
+	c.chunkLock.Lock()
+	chk := c.chunks[fd]
+	c.chunkLock.Unlock()
+	if chk == nil {
+		return false
+	}
+
+	chk.lock.Lock()
+	defer chk.lock.Unlock()
+	return chk.object != nil
+}
+
+// renameWrite changes the path that session will be persisted to, false will be
+// returned if the multipart has been created for the old path.
+func (c *Cache) renameWrite(fd uint64, path string) bool {
+	c.chunkLock.Lock()
+	chk := c.chunks[fd]
+	c.chunkLock.Unlock()
+	if chk == nil {
+		return true
+	}
+
+	// Multipart is created with path while holding createLock.
+	chk.createLock.Lock()
+	defer chk.createLock.Unlock()
+	chk.lock.Lock()
+	defer chk.lock.Unlock()
+
+	if chk.object != nil {
+		return false
+	}
+	chk.path = path
+	return true
+}
+
+// discardWrite will drop the write session which has no data written.
+func (c *Cache) discardWrite(fd uint64) {
+	c.chunkLock.Lock()
+	chk := c.chunks[fd]
+	delete(c.chunks, fd)
+	c.chunkLock.Unlock()
+	if chk == nil {
+		return
+	}
+
+	c.stopSchedule(chk)
+}
+
+// write appends data into session, it could be blocked by the dirty bytes budget.
+func (c *Cache) write(fd uint64, data []byte) (n int64, err error) {
+	c.chunkLock.Lock()
+	chk := c.chunks[fd]
+	c.chunkLock.Unlock()
+
+	// Data could not be persisted anymore, fail fast.
+	err = chk.failed()
+	if err != nil {
+		return 0, err
+	}
 
 	size := int64(len(data))
-	n, err = c.c.Write(p, bytes.NewReader(data), size)
+	err = c.reserve(chk, size)
+	if err != nil {
+		return 0, err
+	}
+
+	sealed := false
+	for n < size {
+		if chk.piece == nil {
+			err = c.createPiece(chk)
+			if err != nil {
+				break
+			}
+		}
+
+		// Cut the data at part size, so that every sealed piece is a part.
+		chk.lock.Lock()
+		room := c.partSize - chk.sizes[len(chk.sizes)-1]
+		chk.lock.Unlock()
+		if room > size-n {
+			room = size - n
+		}
+
+		var written int64
+		written, err = c.c.(types.Appender).WriteAppend(chk.piece, bytes.NewReader(data[n:n+room]), room)
+
+		// Update the chunk before notifying scheduler, so that endWrite called
+		// right after write returned will see this data.
+		chk.lock.Lock()
+		chk.currentSize += written
+		chk.sizes[len(chk.sizes)-1] += written
+		chk.dirtySize += written
+		full := chk.sizes[len(chk.sizes)-1] >= c.partSize
+		chk.lock.Unlock()
+		n += written
+		if err != nil {
+			break
+		}
+
+		if full {
+			err = c.seal(chk)
+			if err != nil {
+				break
+			}
+			sealed = true
+		}
+	}
+	// Data not written doesn't take the budget.
+	if n < size {
+		c.dirty.Sub(size - n)
+	}
+	// Session with data partially written could not be completed.
+	if err != nil {
+		err = c.fail(chk, fmt.Errorf("write cache: %w", err))
+	}
+
+	// Scheduler has been notified if the channel is full.
+	if sealed {
+		select {
+		case chk.notify <- struct{}{}:
+		default:
+		}
+	}
+	return n, err
+}
+
+// createPiece creates a new piece to append data.
+func (c *Cache) createPiece(chk *chunk) (err error) {
+	p := piecePath(chk.fd, chk.nextIdx)
+	o, err := c.c.(types.Appender).CreateAppend(p)
+	if err != nil {
+		return
+	}
+	chk.piece = o
+
+	chk.lock.Lock()
+	chk.nextIdx += 1
+	chk.sizes = append(chk.sizes, 0)
+	chk.lock.Unlock()
+	return nil
+}
+
+// seal commits the piece being appended, so that it could be persisted as a part.
+func (c *Cache) seal(chk *chunk) (err error) {
+	if chk.piece == nil {
+		return nil
+	}
+	err = c.c.(types.Appender).CommitAppend(chk.piece)
 	if err != nil {
 		return
 	}
+	chk.piece = nil
 
-	c.ch <- op{
-		fd:   fd,
-		size: size,
+	chk.lock.Lock()
+	chk.sealedIdx = chk.nextIdx
+	chk.lock.Unlock()
+	return nil
+}
+
+// readAt reads data written in the session which has not been completed, so
+// that the data could be read before it's visible in storage.
+//
+// Data persisted as parts has been removed from cache store, reading it will
+// fail with ErrIO.
+func (c *Cache) readAt(fd, offset uint64, buf []byte) (n int, err error) {
+	c.chunkLock.Lock()
+	chk := c.chunks[fd]
+	c.chunkLock.Unlock()
+	if chk == nil {
+		return 0, nil
+	}
+
+	chk.lock.Lock()
+	sizes := chk.sizes
+	chk.lock.Unlock()
+
+	var (
+		start uint64
+		data  bytes.Buffer
+	)
+	for idx, size := range sizes {
+		end := start + uint64(size)
+		if end <= offset {
+			start = end
+			continue
+		}
+		if n >= len(buf) {
+			break
+		}
+
+		off := offset + uint64(n) - start
+		// Only the part needed by buf will be read.
+		size := end - start - off
+		if rest := uint64(len(buf) - n); size > rest {
+			size = rest
+		}
+		data.Reset()
+		_, err = c.c.Read(piecePath(fd, uint64(idx)), &data,
+			pairs.WithOffset(int64(off)),
+			pairs.WithSize(int64(size)))
+		if err != nil && errors.Is(err, services.ErrObjectNotExist) {
+			return n, fmt.Errorf("%w: data has been uploaded as parts", ErrIO)
+		}
+		if err != nil {
+			return
+		}
+		// Cache storage could ignore the size.
+		b := data.Bytes()
+		if uint64(len(b)) > size {
+			b = b[:size]
+		}
+		n += copy(buf[n:], b)
+		start = end
 	}
 	return n, nil
 }
 
+// endWrite completes the session, ErrIO will be returned if data written could
+// not be persisted.
 func (c *Cache) endWrite(fd uint64) (err error) {
 	c.chunkLock.Lock()
 	chk := c.chunks[fd]
 	c.chunkLock.Unlock()
+	if chk == nil {
+		return nil
+	}
 
+	c.stopSchedule(chk)
 	err = c.complete(chk)
 	if err != nil {
-		c.logger.Error("complete", zap.Error(err))
-		return
+		err = c.fail(chk, err)
+	}
+	// Parts could still be persisting if complete failed.
+	chk.wg.Wait()
+	if err != nil {
+		c.abortMultipart(chk)
 	}
 
 	c.chunkLock.Lock()
 	delete(c.chunks, fd)
 	c.chunkLock.Unlock()
-	return nil
+
+	// Data of failed session could not be persisted anymore, release it as well.
+	c.deletePieces(fd, 0, chk.nextIdx)
+	chk.lock.Lock()
+	dirtySize := chk.dirtySize
+	chk.lock.Unlock()
+	c.release(chk, dirtySize)
+	return err
 }
 
-func (c *Cache) Stop() {
-	close(c.ch)
+// deletePieces removes pieces in [start, end) from cache store, errors will
+// only be logged because the data has been persisted.
+func (c *Cache) deletePieces(fd, start, end uint64) {
+	for i := start; i < end; i++ {
+		p := piecePath(fd, i)
+		err := c.c.Delete(p)
+		if err != nil && !errors.Is(err, services.ErrObjectNotExist) {
+			c.logger.Error("delete cache", zap.String("path", p), zap.Error(err))
+		}
+	}
 }
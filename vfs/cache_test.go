@@ -0,0 +1,538 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beyondstorage/go-storage/v4/services"
+	"github.com/beyondstorage/go-storage/v4/types"
+	"github.com/panjf2000/ants/v2"
+	"go.uber.org/zap"
+)
+
+// fakeMultiparter adds multipart support to memory storage, parts will be
+// kept in memory until completed.
+type fakeMultiparter struct {
+	types.Storager
+	types.UnimplementedMultiparter
+
+	minPartSize int64
+
+	mu    sync.Mutex
+	n     int
+	parts map[string]map[int][]byte
+	// block blocks WriteMultipart until closed if not nil.
+	block chan struct{}
+	// createBlock blocks CreateMultipart of the path until closed.
+	createBlock map[string]chan struct{}
+	// fail is the number of following WriteMultipart to fail.
+	fail int
+	// aborted is the number of multiparts aborted.
+	aborted int
+	// completed is the parts of completed multiparts by path.
+	completed map[string][]*types.Part
+}
+
+func newFakeMultiparter(t *testing.T, minPartSize int64) *fakeMultiparter {
+	s, err := services.NewStoragerFromString("memory://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeMultiparter{
+		Storager:    s,
+		minPartSize: minPartSize,
+		parts:       make(map[string]map[int][]byte),
+	}
+}
+
+func (f *fakeMultiparter) String() string {
+	return "fake multiparter"
+}
+
+func (f *fakeMultiparter) Metadata(pairs ...types.Pair) *types.StorageMeta {
+	meta := f.Storager.Metadata(pairs...)
+	meta.SetMultipartSizeMinimum(f.minPartSize)
+	return meta
+}
+
+func (f *fakeMultiparter) CreateMultipart(path string, pairs ...types.Pair) (o *types.Object, err error) {
+	f.mu.Lock()
+	block := f.createBlock[path]
+	f.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.n++
+	o = newPartObject(path)
+	o.SetMultipartID(path + "#" + strconv.Itoa(f.n))
+	f.parts[o.MustGetMultipartID()] = make(map[int][]byte)
+	return o, nil
+}
+
+func (f *fakeMultiparter) WriteMultipart(o *types.Object, r io.Reader, size int64, index int, pairs ...types.Pair) (n int64, part *types.Part, err error) {
+	f.mu.Lock()
+	block := f.block
+	if f.fail > 0 {
+		f.fail--
+		f.mu.Unlock()
+		return 0, nil, services.ErrPermissionDenied
+	}
+	f.mu.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.parts[o.MustGetMultipartID()][index] = bs
+	return int64(len(bs)), &types.Part{Index: index, Size: int64(len(bs))}, nil
+}
+
+func (f *fakeMultiparter) CompleteMultipart(o *types.Object, parts []*types.Part, pairs ...types.Pair) (err error) {
+	f.mu.Lock()
+	m := f.parts[o.MustGetMultipartID()]
+	delete(f.parts, o.MustGetMultipartID())
+	if f.completed == nil {
+		f.completed = make(map[string][]*types.Part)
+	}
+	f.completed[o.Path] = parts
+	f.mu.Unlock()
+
+	var buf bytes.Buffer
+	for _, p := range parts {
+		buf.Write(m[p.Index])
+	}
+	_, err = f.Write(o.Path, &buf, int64(buf.Len()))
+	return
+}
+
+// newPartObject creates the object of multipart, it's not bound to the
+// underlying storage which could stat it lazily.
+func newPartObject(path string) *types.Object {
+	o := types.NewObject(nil, true)
+	o.Path = path
+	o.Mode = types.ModePart
+	return o
+}
+
+// Delete aborts the multipart if multipart id is given.
+func (f *fakeMultiparter) Delete(path string, ps ...types.Pair) (err error) {
+	for _, p := range ps {
+		if p.Key == "multipart_id" {
+			f.mu.Lock()
+			defer f.mu.Unlock()
+
+			delete(f.parts, p.Value.(string))
+			f.aborted++
+			return nil
+		}
+	}
+	return f.Storager.Delete(path, ps...)
+}
+
+// List lists incomplete multiparts in part mode.
+func (f *fakeMultiparter) List(path string, ps ...types.Pair) (oi *types.ObjectIterator, err error) {
+	for _, p := range ps {
+		if p.Key == "list_mode" && p.Value.(types.ListMode).IsPart() {
+			return f.listMultiparts(), nil
+		}
+	}
+	return f.Storager.List(path, ps...)
+}
+
+func (f *fakeMultiparter) listMultiparts() *types.ObjectIterator {
+	f.mu.Lock()
+	objects := make([]*types.Object, 0, len(f.parts))
+	for id := range f.parts {
+		o := newPartObject(strings.SplitN(id, "#", 2)[0])
+		o.SetMultipartID(id)
+		objects = append(objects, o)
+	}
+	f.mu.Unlock()
+
+	return types.NewObjectIterator(context.Background(), func(ctx context.Context, page *types.ObjectPage) error {
+		if objects == nil {
+			return types.IterateDone
+		}
+		page.Data, objects = objects, nil
+		return nil
+	}, &listStatus{})
+}
+
+type listStatus struct{}
+
+func (*listStatus) ContinuationToken() string {
+	return ""
+}
+
+// partCount returns the number of parts written into all multiparts.
+func (f *fakeMultiparter) partCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	n := 0
+	for _, m := range f.parts {
+		n += len(m)
+	}
+	return n
+}
+
+func newTestCache(t *testing.T, s types.Storager, dirtyLimit, partSize int64) *Cache {
+	c, err := services.NewStoragerFromString("memory://")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ants.NewPool(defaultUploadConcurrency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Release)
+	return NewCache(s, c, p, dirtyLimit, partSize, zap.NewNop())
+}
+
+// waitFor polls fn until it returns true, the test will fail after timeout.
+func waitFor(t *testing.T, fn func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCachePiecesReleased(t *testing.T) {
+	s := newFakeMultiparter(t, 4)
+	c := newTestCache(t, s, 0, 4)
+
+	err := c.startWrite(1, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("0123456789")
+	_, err = c.write(1, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Budget is released after pieces of sealed parts removed.
+	waitFor(t, func() bool { return c.DirtyBytes() == 2 })
+
+	for p, exist := range map[string]bool{"1-0": false, "1-1": false, "1-2": true} {
+		_, err = c.c.Stat(p)
+		if exist && err != nil {
+			t.Errorf("expect piece %s kept, got %v", p, err)
+		}
+		if !exist && err == nil {
+			t.Errorf("expect piece %s removed", p)
+		}
+	}
+
+	// Data not persisted yet could still be read.
+	buf := make([]byte, 2)
+	n, err := c.readAt(1, 8, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "89" {
+		t.Errorf("expect 89, got %q", buf[:n])
+	}
+	_, err = c.readAt(1, 0, buf)
+	if !errors.Is(err, ErrIO) {
+		t.Errorf("expect ErrIO while reading persisted data, got %v", err)
+	}
+
+	err = c.endWrite(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DirtyBytes() != 0 {
+		t.Errorf("expect no dirty bytes, got %d", c.DirtyBytes())
+	}
+	if _, err = c.c.Stat("1-2"); err == nil {
+		t.Error("expect all pieces removed after session ended")
+	}
+}
+
+func TestCacheReadAtSize(t *testing.T) {
+	s := newFakeMultiparter(t, 4)
+	c := newTestCache(t, s, 0, 1024)
+
+	err := c.startWrite(1, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.write(1, []byte("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := &sizeRecorder{Storager: c.c}
+	c.c = store
+
+	// Only the bytes needed by buf should be read from the piece.
+	buf := make([]byte, 2)
+	n, err := c.readAt(1, 3, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "34" {
+		t.Errorf("expect 34, got %q", buf[:n])
+	}
+	if len(store.sizes) != 1 || store.sizes[0] != 2 {
+		t.Errorf("expect one read in size 2, got %v", store.sizes)
+	}
+	c.abortWrite(1)
+}
+
+func TestCachePieces(t *testing.T) {
+	s := newFakeMultiparter(t, 4)
+	c := newTestCache(t, s, 0, 4)
+
+	err := c.startWrite(1, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The second write crosses part boundaries and is cut at part size.
+	for _, data := range []string{"012", "3456789"} {
+		_, err = c.write(1, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return s.partCount() == 2 })
+
+	c.chunkLock.Lock()
+	chk := c.chunks[1]
+	c.chunkLock.Unlock()
+	chk.lock.Lock()
+	sizes, sealed := chk.sizes, chk.sealedIdx
+	chk.lock.Unlock()
+	if len(sizes) != 3 || sizes[0] != 4 || sizes[1] != 4 || sizes[2] != 2 {
+		t.Errorf("expect piece sizes [4 4 2], got %v", sizes)
+	}
+	if sealed != 2 {
+		t.Errorf("expect 2 pieces sealed, got %d", sealed)
+	}
+
+	err = c.endWrite(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := s.completed["a"]
+	if len(parts) != 3 {
+		t.Fatalf("expect 3 parts, got %d", len(parts))
+	}
+	for i, size := range []int64{4, 4, 2} {
+		if parts[i].Index != i || parts[i].Size != size {
+			t.Errorf("expect part %d of size %d, got part %d of size %d", i, size, parts[i].Index, parts[i].Size)
+		}
+	}
+	var buf bytes.Buffer
+	_, err = s.Read("a", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "0123456789" {
+		t.Errorf("expect 0123456789, got %q", buf.String())
+	}
+}
+
+func TestNewCachePartSize(t *testing.T) {
+	cases := []struct {
+		name     string
+		partSize int64
+		expect   int64
+	}{
+		{"default", 0, defaultPartSize},
+		{"below minimum", 1, 4},
+		{"above maximum", 1 << 40, 1 << 30},
+		{"in range", 1 << 20, 1 << 20},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &maxPartSizer{newFakeMultiparter(t, 4), 1 << 30}
+			c := newTestCache(t, s, 0, tt.partSize)
+			if c.partSize != tt.expect {
+				t.Errorf("expect part size %d, got %d", tt.expect, c.partSize)
+			}
+			if c.minPartSize != 4 {
+				t.Errorf("expect min part size 4, got %d", c.minPartSize)
+			}
+		})
+	}
+}
+
+// maxPartSizer limits the maximum part size of storage.
+type maxPartSizer struct {
+	*fakeMultiparter
+
+	max int64
+}
+
+func (m *maxPartSizer) Metadata(pairs ...types.Pair) *types.StorageMeta {
+	meta := m.fakeMultiparter.Metadata(pairs...)
+	meta.SetMultipartSizeMaximum(m.max)
+	return meta
+}
+
+func TestCacheDirtyLimit(t *testing.T) {
+	s := newFakeMultiparter(t, 4)
+	s.block = make(chan struct{})
+	c := newTestCache(t, s, 8, 4)
+
+	err := c.startWrite(1, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both pieces will be sealed and being persisted in background.
+	_, err = c.write(1, []byte("01234567"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := c.write(1, []byte("89"))
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("expect write blocked by dirty limit, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(s.block)
+	err = <-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DirtyBytes() > 8 {
+		t.Errorf("expect dirty bytes under limit, got %d", c.DirtyBytes())
+	}
+
+	err = c.endWrite(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = s.Read("a", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "0123456789" {
+		t.Errorf("expect 0123456789, got %q", buf.String())
+	}
+}
+
+func TestCacheSlowCreateMultipart(t *testing.T) {
+	s := newFakeMultiparter(t, 4)
+	slow := make(chan struct{})
+	s.createBlock = map[string]chan struct{}{"slow": slow}
+	c := newTestCache(t, s, 0, 4)
+
+	for id, p := range map[uint64]string{1: "slow", 2: "fast"} {
+		err := c.startWrite(id, p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := c.write(1, []byte("01234567"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Session 2 should be persisted while session 1 is still creating multipart.
+	done := make(chan error)
+	go func() {
+		_, err := c.write(2, []byte("abcdefgh"))
+		if err == nil {
+			err = c.endWrite(2)
+		}
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect session not blocked by others")
+	}
+	if _, err = s.Stat("slow"); err == nil {
+		t.Error("expect slow not completed")
+	}
+
+	close(slow)
+	err = c.endWrite(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, expect := range map[string]string{"slow": "01234567", "fast": "abcdefgh"} {
+		var buf bytes.Buffer
+		_, err = s.Read(p, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != expect {
+			t.Errorf("expect %s, got %q", expect, buf.String())
+		}
+	}
+}
+
+func TestCleanCacheStorage(t *testing.T) {
+	s, err := services.NewStoragerFromString("fs://" + t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"1-0", "12-3", "a-1", "1-0.bak", "data"} {
+		_, err = s.Write(p, bytes.NewReader([]byte("x")), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = cleanCacheStorage(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, exist := range map[string]bool{
+		"1-0": false, "12-3": false, "a-1": true, "1-0.bak": true, "data": true,
+	} {
+		_, err = s.Stat(p)
+		if exist && err != nil {
+			t.Errorf("expect %s kept, got %v", p, err)
+		}
+		if !exist && err == nil {
+			t.Errorf("expect %s removed", p)
+		}
+	}
+}
+
+func TestCacheStorageIsStorage(t *testing.T) {
+	p := "fs://" + t.TempDir()
+	_, err := NewFS(&Config{
+		StoragePath:      p,
+		CacheStoragePath: p + "/",
+		Logger:           zap.NewNop(),
+	})
+	if err == nil {
+		t.Fatal("expect error while cache storage is the storage")
+	}
+}
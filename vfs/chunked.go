@@ -0,0 +1,361 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/beyondstorage/go-storage/v4/pairs"
+	"github.com/beyondstorage/go-storage/v4/services"
+	"go.uber.org/zap"
+)
+
+// readChunked reads data of chunked file, only chunks in the range will be touched.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) readChunked(offset uint64, buf []byte) (n int, err error) {
+	mf := fh.manifest
+	if offset >= mf.Size {
+		return 0, nil
+	}
+	end := offset + uint64(len(buf))
+	if end > mf.Size {
+		end = mf.Size
+	}
+
+	for offset < end {
+		idx := offset / mf.ChunkSize
+		off := offset % mf.ChunkSize
+		size := mf.ChunkSize - off
+		if size > end-offset {
+			size = end - offset
+		}
+		dst := buf[n : uint64(n)+size]
+
+		if data, ok := fh.dirtyChunks[idx]; ok {
+			copy(dst, data[off:])
+		} else if mf.Chunks[idx] == "" {
+			for i := range dst {
+				dst[i] = 0
+			}
+		} else {
+			fh.buf.Reset()
+			_, err = fh.fs.s.Read(mf.Chunks[idx], fh.buf,
+				pairs.WithOffset(int64(off)),
+				pairs.WithSize(int64(size)))
+			if err != nil {
+				fh.fs.logger.Error("read chunk",
+					zap.String("path", fh.ino.Path),
+					zap.String("chunk", mf.Chunks[idx]),
+					zap.Error(err))
+				return
+			}
+			// Chunk could be shorter than chunk size if it's the last one.
+			m := copy(dst, fh.buf.Bytes())
+			for i := m; i < len(dst); i++ {
+				dst[i] = 0
+			}
+		}
+
+		n += int(size)
+		offset += size
+	}
+	return n, nil
+}
+
+// writeChunked writes data into dirty chunks, chunks will be uploaded while
+// flushing or the dirty bytes budget is exhausted.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) writeChunked(offset uint64, buf []byte) (n int, err error) {
+	mf := fh.manifest
+	if end := offset + uint64(len(buf)); end > mf.Size {
+		mf.Resize(end)
+	}
+
+	for n < len(buf) {
+		idx := offset / mf.ChunkSize
+		off := offset % mf.ChunkSize
+
+		data, err := fh.dirtyChunk(idx)
+		if err != nil {
+			return n, err
+		}
+
+		m := copy(data[off:], buf[n:])
+		n += m
+		offset += uint64(m)
+	}
+
+	fh.dirty = true
+	fh.size = mf.Size
+	fh.offset = offset
+	return n, nil
+}
+
+// truncateChunked resizes the file, the manifest will be persisted while flushing.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) truncateChunked(size uint64) (err error) {
+	mf := fh.manifest
+	if size < mf.Size && size%mf.ChunkSize != 0 {
+		// Data after size in the cut chunk should be read as zero if the file
+		// is extended later.
+		idx := size / mf.ChunkSize
+		data, err := fh.dirtyChunk(idx)
+		if err != nil {
+			return err
+		}
+		tail := data[size%mf.ChunkSize:]
+		for i := range tail {
+			tail[i] = 0
+		}
+	}
+
+	count := mf.ChunkCount()
+	fh.replacedChunks = append(fh.replacedChunks, mf.Resize(size)...)
+	for idx := mf.ChunkCount(); idx < count; idx++ {
+		fh.changedChunks[idx] = true
+	}
+	fh.resized = true
+	for idx := range fh.dirtyChunks {
+		if idx >= mf.ChunkCount() {
+			delete(fh.dirtyChunks, idx)
+			fh.cache.releaseDirty(int64(mf.ChunkSize))
+		}
+	}
+	fh.dirty = true
+	fh.size = size
+	return nil
+}
+
+// dirtyChunk returns the dirty chunk of idx which could be modified in place,
+// the chunk will be loaded and counted into the dirty bytes budget if it's not
+// dirty yet.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) dirtyChunk(idx uint64) (data []byte, err error) {
+	if data, ok := fh.dirtyChunks[idx]; ok {
+		return data, nil
+	}
+
+	size := int64(fh.manifest.ChunkSize)
+	err = fh.cache.reserveDirty(size, fh.uploadChunks)
+	if err != nil {
+		return
+	}
+	data, err = fh.loadChunk(idx)
+	if err != nil {
+		fh.cache.releaseDirty(size)
+		return
+	}
+	fh.dirtyChunks[idx] = data
+	fh.changedChunks[idx] = true
+	return data, nil
+}
+
+// loadChunk returns the whole chunk which could be modified in place.
+func (fh *FileHandle) loadChunk(idx uint64) (data []byte, err error) {
+	mf := fh.manifest
+	data = make([]byte, mf.ChunkSize)
+	if mf.Chunks[idx] == "" {
+		return data, nil
+	}
+
+	fh.buf.Reset()
+	_, err = fh.fs.s.Read(mf.Chunks[idx], fh.buf)
+	if err != nil {
+		return nil, err
+	}
+	copy(data, fh.buf.Bytes())
+	return data, nil
+}
+
+// uploadChunks writes dirty chunks as new chunk objects via the upload pool,
+// replaced chunks will be deleted after the manifest persisted.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) uploadChunks() (err error) {
+	mf := fh.manifest
+
+	type upload struct {
+		idx  uint64
+		path string
+		err  error
+	}
+	var (
+		wg      sync.WaitGroup
+		uploads []*upload
+	)
+	for idx, data := range fh.dirtyChunks {
+		// Chunk beyond the file has been dropped by truncate.
+		if idx >= mf.ChunkCount() {
+			delete(fh.dirtyChunks, idx)
+			fh.cache.releaseDirty(int64(mf.ChunkSize))
+			continue
+		}
+		// The last chunk only contains data within the file size.
+		size := mf.Size - idx*mf.ChunkSize
+		if size > mf.ChunkSize {
+			size = mf.ChunkSize
+		}
+
+		u := &upload{idx: idx}
+		uploads = append(uploads, u)
+		data := data[:size]
+		wg.Add(1)
+		err = fh.cache.p.Submit(func() {
+			defer wg.Done()
+			u.path, u.err = fh.fs.writeChunk(data)
+		})
+		if err != nil {
+			wg.Done()
+			u.err = fmt.Errorf("submit task: %w", err)
+		}
+	}
+	wg.Wait()
+
+	err = nil
+	for _, u := range uploads {
+		if u.err != nil {
+			// Chunk is still dirty, it will be uploaded again while flushing.
+			if err == nil {
+				err = u.err
+			}
+			continue
+		}
+		if old := mf.Chunks[u.idx]; old != "" {
+			fh.replacedChunks = append(fh.replacedChunks, old)
+		}
+		mf.Chunks[u.idx] = u.path
+		delete(fh.dirtyChunks, u.idx)
+		fh.cache.releaseDirty(int64(mf.ChunkSize))
+	}
+	return err
+}
+
+// flushChunked uploads dirty chunks and commits the manifest.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) flushChunked() (err error) {
+	if !fh.dirty {
+		return nil
+	}
+
+	err = fh.uploadChunks()
+	if err != nil {
+		return
+	}
+
+	mu := fh.fs.manifestLock(fh.ino.Path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	latest, err := fh.fs.readManifest(fh.ino.Path)
+	if err != nil && !errors.Is(err, services.ErrObjectNotExist) {
+		return
+	}
+	mf, retired := fh.rebaseManifest(latest)
+
+	fh.ino.Chunked = true
+	fh.ino.Size = mf.Size
+	fh.ino.Mtime = time.Now()
+	err = fh.fs.SetManifest(fh.ino, mf)
+	if err != nil {
+		return
+	}
+	err = fh.fs.SetInode(fh.ino)
+	if err != nil {
+		return
+	}
+
+	fh.setManifest(mf)
+	fh.fs.retireChunks(retired)
+	fh.replacedChunks = nil
+	fh.changedChunks = make(map[uint64]bool)
+	fh.resized = false
+	fh.size = mf.Size
+	fh.dirty = false
+	return nil
+}
+
+// rebaseManifest returns the manifest to commit, and chunks no longer referred
+// by it.
+//
+// If the latest manifest has been committed by others since this handle read
+// it, only chunks changed by this handle will be applied on the latest one.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) rebaseManifest(latest *Manifest) (mf *Manifest, retired []string) {
+	cur := fh.manifest
+	mf = &Manifest{
+		Size:      cur.Size,
+		ChunkSize: cur.ChunkSize,
+		Chunks:    append([]string{}, cur.Chunks...),
+		Version:   cur.Version + 1,
+	}
+	if latest == nil {
+		return mf, unreferencedChunks(mf, fh.replacedChunks)
+	}
+
+	if latest.Version != cur.Version && latest.ChunkSize == cur.ChunkSize {
+		size := latest.Size
+		if fh.resized || cur.Size > size {
+			size = cur.Size
+		}
+		mf.Size = latest.Size
+		mf.Chunks = append([]string{}, latest.Chunks...)
+		mf.Resize(size)
+		for idx := range fh.changedChunks {
+			if idx < uint64(len(mf.Chunks)) && idx < uint64(len(cur.Chunks)) {
+				mf.Chunks[idx] = cur.Chunks[idx]
+			}
+		}
+	}
+	mf.Version = latest.Version + 1
+	return mf, unreferencedChunks(mf, latest.Chunks, fh.replacedChunks, cur.Chunks)
+}
+
+// setManifest makes this handle read mf, chunks read before will be released.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) setManifest(mf *Manifest) {
+	chunks := append([]string{}, mf.Chunks...)
+	fh.fs.chunkRefs.acquire(chunks)
+	fh.releaseChunks()
+	fh.readChunks = chunks
+	fh.manifest = mf
+}
+
+// releaseChunks releases chunks read by this handle, retired chunks will be
+// deleted if no handle reads them anymore.
+func (fh *FileHandle) releaseChunks() {
+	fh.fs.deleteChunkObjects(fh.fs.chunkRefs.release(fh.readChunks))
+	fh.readChunks = nil
+}
+
+// discardChunks deletes chunks uploaded by this handle but not referred by the
+// committed manifest.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) discardChunks() {
+	mu := fh.fs.manifestLock(fh.ino.Path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	latest, err := fh.fs.readManifest(fh.ino.Path)
+	if err != nil && !errors.Is(err, services.ErrObjectNotExist) {
+		// Chunks could be still referred, leave them alone.
+		fh.fs.logger.Error("read manifest", zap.String("path", fh.ino.Path), zap.Error(err))
+	} else {
+		if latest == nil {
+			latest = &Manifest{}
+		}
+		fh.fs.retireChunks(unreferencedChunks(latest, fh.manifest.Chunks, fh.replacedChunks))
+	}
+	fh.cache.releaseDirty(int64(len(fh.dirtyChunks)) * int64(fh.manifest.ChunkSize))
+	fh.dirtyChunks = make(map[uint64][]byte)
+	fh.changedChunks = make(map[uint64]bool)
+	fh.replacedChunks = nil
+}
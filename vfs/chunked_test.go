@@ -0,0 +1,282 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/beyondstorage/go-storage/v4/pairs"
+	"github.com/beyondstorage/go-storage/v4/types"
+	"go.uber.org/zap"
+)
+
+// newChunkedFS returns fs in chunked layout with 4 bytes chunks.
+func newChunkedFS(t *testing.T, dirtyLimit uint64) (*FS, uint64) {
+	fs, err := NewFS(&Config{
+		StoragePath:     "fs://" + t.TempDir(),
+		ChunkSize:       4,
+		CacheDirtyLimit: dirtyLimit,
+		Logger:          zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = fs.Close() })
+	// Root is the last inode allocated by NewFS.
+	return fs, nextInode.Load()
+}
+
+// countChunks returns the number of chunk objects in storage.
+func countChunks(t *testing.T, fs *FS) int {
+	it, err := fs.s.List(chunkDir, pairs.WithListMode(types.ListModeDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for {
+		_, err := it.Next()
+		if errors.Is(err, types.IterateDone) {
+			return n
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+}
+
+// readFile reads the whole file via a new handle.
+func readFile(t *testing.T, fs *FS, parent uint64, name string) []byte {
+	ino, err := fs.GetEntry(parent, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, err := fs.OpenFileHandle(ino, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.DeleteFileHandle(fh.ID)
+
+	buf := make([]byte, ino.Size+8)
+	n, err := fh.Read(0, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf[:n]
+}
+
+// writeFile writes data via the handle, and closes it.
+func writeFile(t *testing.T, fs *FS, fh *FileHandle, offset uint64, data string) {
+	_, err := fh.Write(offset, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChunkedReadWrite(t *testing.T) {
+	fs, root := newChunkedFS(t, 0)
+
+	ino, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fh.Write(0, []byte("0123456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fh.Write(3, []byte("ab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Dirty chunks should be read before uploaded.
+	buf := make([]byte, 16)
+	n, err := fh.Read(2, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "2ab56789" {
+		t.Errorf("expect 2ab56789, got %q", buf[:n])
+	}
+	err = fs.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := readFile(t, fs, root, "a"); string(got) != "012ab56789" {
+		t.Errorf("expect 012ab56789, got %q", got)
+	}
+	if n := countChunks(t, fs); n != 3 {
+		t.Errorf("expect 3 chunks, got %d", n)
+	}
+
+	// Only the touched chunk will be replaced.
+	fh, err = fs.OpenFileHandle(ino, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, fh, 9, "x")
+	if got := readFile(t, fs, root, "a"); string(got) != "012ab5678x" {
+		t.Errorf("expect 012ab5678x, got %q", got)
+	}
+	if n := countChunks(t, fs); n != 3 {
+		t.Errorf("expect replaced chunk deleted, got %d chunks", n)
+	}
+}
+
+func TestChunkedTruncate(t *testing.T) {
+	fs, root := newChunkedFS(t, 0)
+
+	ino, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, fh, 0, "0123456789")
+
+	fh, err = fs.OpenFileHandle(ino, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Data after the cut should be read as zero after extended.
+	err = fh.Truncate(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fh.Truncate(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, root, "a"); string(got) != "012345\x00\x00\x00" {
+		t.Errorf("expect 012345 with zeros, got %q", got)
+	}
+
+	// Truncate without handle.
+	ino, err = fs.GetEntry(root, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := uint64(2)
+	err = fs.UpdateAttr(ino, &AttrUpdate{Size: &size})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, root, "a"); string(got) != "01" {
+		t.Errorf("expect 01, got %q", got)
+	}
+	if n := countChunks(t, fs); n != 1 {
+		t.Errorf("expect chunks dropped, got %d chunks", n)
+	}
+}
+
+func TestChunkedAppend(t *testing.T) {
+	fs, root := newChunkedFS(t, 0)
+
+	ino, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, fh, 0, "0123")
+
+	fh, err = fs.OpenFileHandle(ino, os.O_WRONLY|os.O_APPEND)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Offset from kernel is ignored while appending.
+	writeFile(t, fs, fh, 0, "45678")
+
+	if got := readFile(t, fs, root, "a"); string(got) != "012345678" {
+		t.Errorf("expect 012345678, got %q", got)
+	}
+}
+
+func TestChunkedDirtyLimit(t *testing.T) {
+	fs, root := newChunkedFS(t, 8)
+
+	_, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("0123456789"), 4)
+	for i := range data {
+		_, err = fh.Write(uint64(i), data[i:i+1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The budget could be exceeded by a chunk.
+		if n := fs.DirtyBytes(); n > 8+4 {
+			t.Fatalf("expect dirty bytes within budget, got %d", n)
+		}
+	}
+	if n := countChunks(t, fs); n == 0 {
+		t.Error("expect chunks uploaded before close")
+	}
+
+	err = fs.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := fs.DirtyBytes(); n != 0 {
+		t.Errorf("expect no dirty bytes, got %d", n)
+	}
+	if got := readFile(t, fs, root, "a"); !bytes.Equal(got, data) {
+		t.Errorf("expect %q, got %q", data, got)
+	}
+}
+
+func TestChunkedConcurrentHandles(t *testing.T) {
+	fs, root := newChunkedFS(t, 0)
+
+	ino, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, fh, 0, "0123456789")
+
+	a, err := fs.OpenFileHandle(ino, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Write(9, []byte("x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := fs.OpenFileHandle(ino, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, b, 0, "ab")
+
+	// Chunk replaced by b is still read by a.
+	if n := countChunks(t, fs); n != 4 {
+		t.Errorf("expect replaced chunk kept, got %d chunks", n)
+	}
+	buf := make([]byte, 4)
+	n, err := a.Read(0, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "0123" {
+		t.Errorf("expect 0123, got %q", buf[:n])
+	}
+
+	// Changes of both handles should be kept.
+	err = fs.DeleteFileHandle(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, root, "a"); string(got) != "ab2345678x" {
+		t.Errorf("expect ab2345678x, got %q", got)
+	}
+	if n := countChunks(t, fs); n != 3 {
+		t.Errorf("expect replaced chunks deleted, got %d chunks", n)
+	}
+}
@@ -0,0 +1,112 @@
+package vfs
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// manifestLockCount is the number of locks serialising manifest commits, files
+// are hashed into them by path.
+const manifestLockCount = 64
+
+// chunkRefs counts the open handles reading each chunk, so that chunks no longer
+// referred by the manifest will only be deleted after no handle reads them.
+type chunkRefs struct {
+	mu   sync.Mutex
+	refs map[string]int
+	// retired are chunks no longer referred by the manifest but still read by
+	// handles, they will be deleted once released.
+	retired map[string]bool
+}
+
+func newChunkRefs() *chunkRefs {
+	return &chunkRefs{
+		refs:    make(map[string]int),
+		retired: make(map[string]bool),
+	}
+}
+
+// acquire marks chunks as read by a handle.
+func (cr *chunkRefs) acquire(chunks []string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	for _, v := range chunks {
+		if v != "" {
+			cr.refs[v] += 1
+		}
+	}
+}
+
+// release unmarks chunks read by a handle, retired chunks not read by any handle
+// anymore will be returned.
+func (cr *chunkRefs) release(chunks []string) (deletable []string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	for _, v := range chunks {
+		if v == "" {
+			continue
+		}
+		cr.refs[v] -= 1
+		if cr.refs[v] > 0 {
+			continue
+		}
+		delete(cr.refs, v)
+		if cr.retired[v] {
+			delete(cr.retired, v)
+			deletable = append(deletable, v)
+		}
+	}
+	return deletable
+}
+
+// retire marks chunks as no longer referred by the manifest, chunks not read by
+// any handle will be returned.
+func (cr *chunkRefs) retire(chunks []string) (deletable []string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	for _, v := range chunks {
+		if v == "" {
+			continue
+		}
+		if cr.refs[v] > 0 {
+			cr.retired[v] = true
+			continue
+		}
+		deletable = append(deletable, v)
+	}
+	return deletable
+}
+
+// retireChunks deletes chunks no longer referred by the manifest once no handle
+// reads them.
+func (fs *FS) retireChunks(chunks []string) {
+	fs.deleteChunkObjects(fs.chunkRefs.retire(chunks))
+}
+
+// manifestLock returns the lock serialising manifest commits of the file.
+func (fs *FS) manifestLock(path string) *sync.Mutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(path))
+	return &fs.manifestLocks[h.Sum32()%manifestLockCount]
+}
+
+// unreferencedChunks returns chunks in lists which are not referred by mf.
+func unreferencedChunks(mf *Manifest, lists ...[]string) (chunks []string) {
+	seen := make(map[string]bool)
+	for _, v := range mf.Chunks {
+		seen[v] = true
+	}
+	for _, list := range lists {
+		for _, v := range list {
+			if v == "" || seen[v] {
+				continue
+			}
+			seen[v] = true
+			chunks = append(chunks, v)
+		}
+	}
+	return chunks
+}
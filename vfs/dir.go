@@ -2,6 +2,7 @@ package vfs
 
 import (
 	"errors"
+	"strings"
 	"sync"
 
 	"github.com/beyondstorage/go-storage/v4/types"
@@ -58,9 +59,20 @@ func (dh *DirHandle) Next() (ino *Inode, err error) {
 	if err != nil {
 		return nil, err
 	}
+	// Hide the dir used by BeyondFS itself.
+	if dh.ino.Path == "" && strings.TrimSuffix(o.Path, "/") == internalDir {
+		return dh.Next()
+	}
 
+	loaded, err := dh.fs.loadMetadata(o)
+	if err != nil {
+		return
+	}
 	// TODO: maybe we can read data from cache instead.
 	ino = newInode(dh.ino.ID, o)
+	// Attributes and manifest will be loaded while looked up, so that listing
+	// doesn't need to read every object.
+	ino.Incomplete = !loaded || dh.fs.mayBeManifest(ino)
 	err = dh.fs.SetInode(ino)
 	if err != nil {
 		return
@@ -0,0 +1,30 @@
+package vfs
+
+import "errors"
+
+var (
+	// ErrIsDir means the inode to be operated is a dir.
+	ErrIsDir = errors.New("is a dir")
+	// ErrNotDir means the inode to be operated is not a dir.
+	ErrNotDir = errors.New("not a dir")
+	// ErrNotEmpty means the dir to be removed still has entries.
+	ErrNotEmpty = errors.New("dir not empty")
+	// ErrLockConflict means the lock conflicts with locks held by others.
+	ErrLockConflict = errors.New("lock conflict")
+	// ErrLockInterrupted means waiting for lock has been interrupted.
+	ErrLockInterrupted = errors.New("lock interrupted")
+	// ErrNoXAttr means the xattr to be operated doesn't exist.
+	ErrNoXAttr = errors.New("xattr not exist")
+	// ErrNotSymlink means the inode to be operated is not a symlink.
+	ErrNotSymlink = errors.New("not a symlink")
+	// ErrExist means the file to be created exclusively exists already.
+	ErrExist = errors.New("file exists")
+	// ErrBadHandle means the file handle is not opened for this operation.
+	ErrBadHandle = errors.New("bad file handle")
+	// ErrNotSupported means the operation could not be supported by current config.
+	ErrNotSupported = errors.New("operation not supported")
+	// ErrIO means data written could not be persisted into storage.
+	ErrIO = errors.New("input/output error")
+	// ErrBusy means the file is being written in a way bound to its path.
+	ErrBusy = errors.New("resource busy")
+)
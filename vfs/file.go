@@ -1,11 +1,17 @@
 package vfs
 
 import (
-	"fmt"
+	"errors"
+	"os"
+	"path"
 	"sync"
+	"time"
 
 	"github.com/Xuanwo/go-bufferpool"
 	"github.com/beyondstorage/go-storage/v4/pairs"
+	"github.com/beyondstorage/go-storage/v4/services"
+	"github.com/beyondstorage/go-storage/v4/types"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 
 	"github.com/beyondstorage/beyond-fs/meta"
@@ -18,11 +24,15 @@ var (
 type fileHandleMap struct {
 	lock sync.Mutex
 	m    map[uint64]*FileHandle
+	// writers are the handles which have written data to the inode, data
+	// written by them could be not visible in storage yet.
+	writers map[uint64]*FileHandle
 }
 
 func newFileHandleMap() *fileHandleMap {
 	return &fileHandleMap{
-		m: make(map[uint64]*FileHandle),
+		m:       make(map[uint64]*FileHandle),
+		writers: make(map[uint64]*FileHandle),
 	}
 }
 
@@ -47,6 +57,82 @@ func (fhm *fileHandleMap) Delete(id uint64) {
 	delete(fhm.m, id)
 }
 
+// List returns the handles opened for the inode.
+func (fhm *fileHandleMap) List(ino uint64) []*FileHandle {
+	fhm.lock.Lock()
+	defer fhm.lock.Unlock()
+
+	fhs := make([]*FileHandle, 0)
+	for _, fh := range fhm.m {
+		if fh.ino.ID == ino {
+			fhs = append(fhs, fh)
+		}
+	}
+	return fhs
+}
+
+// All returns all handles opened.
+func (fhm *fileHandleMap) All() []*FileHandle {
+	fhm.lock.Lock()
+	defer fhm.lock.Unlock()
+
+	fhs := make([]*FileHandle, 0, len(fhm.m))
+	for _, fh := range fhm.m {
+		fhs = append(fhs, fh)
+	}
+	return fhs
+}
+
+// ListPath returns the handles opened for the path.
+func (fhm *fileHandleMap) ListPath(path string) []*FileHandle {
+	fhm.lock.Lock()
+	defer fhm.lock.Unlock()
+
+	fhs := make([]*FileHandle, 0)
+	for _, fh := range fhm.m {
+		if fh.ino.Path == path {
+			fhs = append(fhs, fh)
+		}
+	}
+	return fhs
+}
+
+// SetPath changes the path of handle, it's protected by fhm.lock so that
+// handles could be looked up by path.
+func (fhm *fileHandleMap) SetPath(fh *FileHandle, p string) {
+	fhm.lock.Lock()
+	defer fhm.lock.Unlock()
+
+	fh.ino.Path = p
+	fh.ino.Name = path.Base(p)
+}
+
+// GetWriter returns the handle which is writing to the inode.
+func (fhm *fileHandleMap) GetWriter(ino uint64) *FileHandle {
+	fhm.lock.Lock()
+	defer fhm.lock.Unlock()
+
+	return fhm.writers[ino]
+}
+
+func (fhm *fileHandleMap) SetWriter(ino uint64, fh *FileHandle) {
+	fhm.lock.Lock()
+	defer fhm.lock.Unlock()
+
+	fhm.writers[ino] = fh
+}
+
+// DeleteWriter removes the writer only if it's still fh, a later writer
+// could have replaced it.
+func (fhm *fileHandleMap) DeleteWriter(ino uint64, fh *FileHandle) {
+	fhm.lock.Lock()
+	defer fhm.lock.Unlock()
+
+	if fhm.writers[ino] == fh {
+		delete(fhm.writers, ino)
+	}
+}
+
 type FileHandle struct {
 	ID uint64
 
@@ -59,11 +145,53 @@ type FileHandle struct {
 	size   uint64
 	offset uint64
 
+	// readable and writable are decided by the access mode of open flags.
+	readable bool
+	writable bool
+
 	// Read operations
 	buf *bufferpool.Buffer
+	ra  readAhead
+	// raStale means the file has been written, data prefetched in ra should
+	// be dropped before next read.
+	raStale atomic.Bool
 
 	// Write operations
+	//
+	// idx is the number of writes in the current write session.
 	idx uint64
+	// writing means a write session has been started in cache.
+	writing bool
+	// metadata is the user metadata of object written by the write session.
+	metadata Metadata
+	// err is the error of write session which failed to persist data, all
+	// following writes and flushes of this handle will fail with it.
+	err error
+
+	// Staging file will be used after the first random write, nil means
+	// writes are streamed via cache.
+	staging *os.File
+	dirty   bool
+
+	// Manifest will be used if this file is stored in chunked layout, nil
+	// means the file is a single object.
+	manifest       *Manifest
+	dirtyChunks    map[uint64][]byte
+	replacedChunks []string
+	// readChunks are the chunks of manifest committed that this handle reads,
+	// they will be kept until released.
+	readChunks []string
+	// changedChunks are the chunks changed by this handle since the manifest
+	// committed, resized means the file has been truncated. Only these changes
+	// will be applied if the manifest has been committed by others meanwhile.
+	changedChunks map[uint64]bool
+	resized       bool
+
+	// append means all writes will happen at the end of file, appendObject
+	// will be set if the object is appended via Appender.
+	append       bool
+	appender     types.Appender
+	appendObject *types.Object
 }
 
 func (fh *FileHandle) GetInode() *Inode {
@@ -71,55 +199,246 @@ func (fh *FileHandle) GetInode() *Inode {
 }
 
 func (fh *FileHandle) Read(offset uint64, buf []byte) (n int, err error) {
-	size := fh.size
-	if size > uint64(len(buf)) {
-		size = uint64(len(buf))
+	if !fh.readable {
+		return 0, ErrBadHandle
+	}
+
+	// Data written via other handles could be not visible in storage yet.
+	//
+	// Our lock must not be held while taking the writer's, handles could read
+	// from each other after the writer changed.
+	if w := fh.fs.fhm.GetWriter(fh.ino.ID); w != nil && w != fh {
+		n, ok, err := w.readInFlight(offset, buf)
+		if ok || err != nil {
+			return n, err
+		}
 	}
 
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
 
+	if fh.manifest != nil {
+		return fh.readChunked(offset, buf)
+	}
+	if fh.staging != nil {
+		return fh.readStaging(offset, buf)
+	}
+	if fh.writing {
+		return fh.readSession(offset, buf)
+	}
+
+	if fh.raStale.CAS(true, false) {
+		fh.ra.reset()
+	}
+	fh.ra.observe(offset, uint64(len(buf)))
+	if n, ok := fh.ra.read(offset, buf); ok {
+		fh.readAhead()
+		return n, nil
+	}
+
+	if fh.fs.blockCache != nil {
+		n, err = fh.fs.readCached(fh.ino.Path, objectVersion(fh.ino), offset, buf)
+		if err != nil {
+			fh.fs.logger.Error("read cached", zap.Error(err))
+			return
+		}
+		fh.readAhead()
+		return n, nil
+	}
+
 	fh.buf.Reset()
 
 	fh.fs.logger.Info("read data",
 		zap.String("path", fh.ino.Path),
 		zap.Uint64("offset", offset),
-		zap.Uint64("size", size))
+		zap.Int("size", len(buf)))
 	byteRead, err := fh.fs.s.Read(fh.ino.Path, fh.buf,
 		pairs.WithOffset(int64(offset)),
-		pairs.WithSize(int64(size)))
+		pairs.WithSize(int64(len(buf))))
 	if err != nil {
 		fh.fs.logger.Error("read underlying", zap.Error(err))
 		return
 	}
 
-	copy(buf, fh.buf.Bytes()[:byteRead])
-	fh.offset += uint64(byteRead)
-	return int(byteRead), nil
+	n = copy(buf, fh.buf.Bytes()[:byteRead])
+	fh.readAhead()
+	return n, nil
+}
+
+// readInFlight reads data via the writer's view of the file, which could contain
+// data not persisted yet. ok will be false if storage is already up to date.
+func (fh *FileHandle) readInFlight(offset uint64, buf []byte) (n int, ok bool, err error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	switch {
+	case fh.manifest != nil:
+		n, err = fh.readChunked(offset, buf)
+	case fh.staging != nil:
+		n, err = fh.readStaging(offset, buf)
+	case fh.writing:
+		n, err = fh.readSession(offset, buf)
+	default:
+		return 0, false, nil
+	}
+	return n, true, err
+}
+
+// readSession reads data from the write session in cache.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) readSession(offset uint64, buf []byte) (n int, err error) {
+	if offset >= fh.size {
+		return 0, nil
+	}
+	if rest := fh.size - offset; rest < uint64(len(buf)) {
+		buf = buf[:rest]
+	}
+	return fh.cache.readAt(fh.ID, offset, buf)
+}
+
+// syncManifest makes this handle read the manifest committed by writer, chunks
+// of the old manifest will be released.
+func (fh *FileHandle) syncManifest(mf *Manifest) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	// Dirty handle will apply its changes on the committed manifest while flushing.
+	if fh.dirty || fh.staging != nil || fh.writing {
+		return
+	}
+	fh.setManifest(&Manifest{
+		Size:      mf.Size,
+		ChunkSize: mf.ChunkSize,
+		Chunks:    append([]string{}, mf.Chunks...),
+		Version:   mf.Version,
+	})
+	if fh.dirtyChunks == nil {
+		fh.dirtyChunks = make(map[uint64][]byte)
+		fh.changedChunks = make(map[uint64]bool)
+	}
+	fh.ino.Chunked = true
+	fh.ino.Size = mf.Size
+	fh.size = mf.Size
+}
+
+// InFlightSize returns the size of file including data not persisted yet.
+func (fh *FileHandle) InFlightSize() (size uint64, ok bool) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if !fh.dirty && !fh.writing {
+		return 0, false
+	}
+	return fh.size, true
 }
 
 func (fh *FileHandle) PrepareForWrite() (err error) {
-	err = fh.cache.startWrite(fh.ID, fh.ino.Path)
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	return fh.prepareForWrite()
+}
+
+// prepareForWrite starts the write session of this handle.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) prepareForWrite() (err error) {
+	if fh.manifest != nil || fh.writing {
+		return nil
+	}
+	// Only new files will be stored in chunked layout, existing objects
+	// will keep their layout.
+	if fh.fs.chunkSize > 0 && fh.ino.Size == 0 {
+		fh.manifest = &Manifest{ChunkSize: fh.fs.chunkSize}
+		fh.dirtyChunks = make(map[uint64][]byte)
+		fh.changedChunks = make(map[uint64]bool)
+		return nil
+	}
+
+	m, err := fh.formatMetadata()
+	if err != nil {
+		return
+	}
+	err = fh.cache.startWrite(fh.ID, fh.ino.Path, m)
 	if err != nil {
 		return
 	}
+	fh.writing = true
+	fh.metadata = m
 	return
 }
 
+func (fh *FileHandle) formatMetadata() (m Metadata, err error) {
+	return fh.fs.formatWriteMetadata(fh.ino)
+}
+
 func (fh *FileHandle) Write(offset uint64, buf []byte) (n int, err error) {
 	fh.mu.Lock()
 	defer fh.mu.Unlock()
 
-	if offset != fh.offset {
-		return 0, fmt.Errorf("random write is not allowd")
+	if !fh.writable {
+		return 0, ErrBadHandle
+	}
+	if fh.err != nil {
+		return 0, fh.err
+	}
+	// Readers of this inode will read data written by this handle until it's closed.
+	fh.fs.fhm.SetWriter(fh.ino.ID, fh)
+
+	if fh.append {
+		// Kernel's offset could be stale if file has been appended by others.
+		offset = fh.size
+	}
+	if fh.appendObject != nil {
+		return fh.writeAppend(buf)
+	}
+	if fh.manifest != nil {
+		return fh.writeChunked(offset, buf)
+	}
+	if fh.staging == nil && !fh.writing {
+		// Streaming writes will replace the whole object, so existing data
+		// needs to be kept in staging file.
+		if fh.size > 0 {
+			err = fh.startStaging()
+			if err != nil {
+				fh.fs.logger.Error("start staging", zap.Error(err))
+				return
+			}
+		} else {
+			err = fh.prepareForWrite()
+			if err != nil {
+				return
+			}
+			if fh.manifest != nil {
+				return fh.writeChunked(offset, buf)
+			}
+		}
+	}
+	if fh.staging == nil && offset != fh.offset {
+		// Random write could not be streamed, switch to staging file instead.
+		err = fh.startStaging()
+		if err != nil {
+			fh.fs.logger.Error("start staging", zap.Error(err))
+			return
+		}
+	}
+	if fh.staging != nil {
+		return fh.writeStaging(offset, buf)
 	}
 
 	fh.fs.logger.Info("write data",
 		zap.String("path", fh.ino.Path),
 		zap.Uint64("offset", offset),
 		zap.Int("size", len(buf)))
-	byteWritten, err := fh.cache.write(fh.ID, fh.idx, buf)
+	byteWritten, err := fh.cache.write(fh.ID, buf)
 	if err != nil {
+		// Data appended before failed has been a part of the session.
+		fh.size += uint64(byteWritten)
+		fh.offset += uint64(byteWritten)
+		if errors.Is(err, ErrIO) {
+			fh.err = err
+		}
 		fh.fs.logger.Error("write buffer", zap.Error(err))
 		return
 	}
@@ -131,10 +450,172 @@ func (fh *FileHandle) Write(offset uint64, buf []byte) (n int, err error) {
 	return int(byteWritten), nil
 }
 
+// Flush will upload the staging file or dirty chunks, and complete streaming
+// writes, so that failures could be returned to close and fsync.
+func (fh *FileHandle) Flush() (err error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if fh.err != nil {
+		return fh.err
+	}
+	if fh.manifest != nil {
+		return fh.flushChunked()
+	}
+	if fh.staging != nil {
+		return fh.uploadStaging()
+	}
+	if fh.writing {
+		return fh.endWrite()
+	}
+	return nil
+}
+
+// Truncate changes the size of file via this handle, data written by this handle
+// but not persisted yet will be truncated as well.
+func (fh *FileHandle) Truncate(size uint64) (err error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if !fh.writable {
+		return ErrBadHandle
+	}
+	if fh.err != nil {
+		return fh.err
+	}
+
+	if fh.appendObject != nil {
+		// Appendable object could only be rewritten after appended data committed,
+		// following writes will go through staging file.
+		err = fh.commitAppend()
+		if err != nil {
+			return
+		}
+		fh.appender = nil
+		fh.appendObject = nil
+	}
+	if fh.writing && size == 0 {
+		// Nothing written needs to be kept, following writes will start a new session.
+		fh.cache.abortWrite(fh.ID)
+		fh.writing = false
+		fh.idx = 0
+		fh.size = 0
+		fh.offset = 0
+	}
+	if fh.writing {
+		err = fh.startStaging()
+		if err != nil {
+			return
+		}
+	}
+
+	switch {
+	case fh.manifest != nil:
+		err = fh.truncateChunked(size)
+	case fh.staging != nil:
+		err = fh.truncateStaging(size)
+	default:
+		// Handle has nothing in flight, truncate the object directly.
+		var ino *Inode
+		ino, err = fh.fs.GetInode(fh.ino.ID)
+		if err != nil {
+			return
+		}
+		if ino == nil {
+			return services.ErrObjectNotExist
+		}
+		err = fh.fs.UpdateAttr(ino, &AttrUpdate{Size: &size})
+		if err != nil {
+			return
+		}
+		fh.ino.Size = size
+		fh.size = size
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	// Readers should see the size before this handle flushed.
+	fh.fs.fhm.SetWriter(fh.ino.ID, fh)
+	return nil
+}
+
 func (fh *FileHandle) CloseForWrite() (err error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if fh.appendObject != nil {
+		return fh.commitAppend()
+	}
+	if fh.manifest != nil {
+		return fh.flushChunked()
+	}
+	if fh.staging != nil {
+		return fh.closeStaging()
+	}
+	if fh.err != nil {
+		return fh.err
+	}
+	if !fh.writing {
+		return nil
+	}
+	return fh.endWrite()
+}
+
+// Discard drops data of this handle which could not be persisted, so that the
+// write session, staging file and chunks will not be leaked after close failed.
+func (fh *FileHandle) Discard() {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if fh.writing {
+		fh.cache.abortWrite(fh.ID)
+		fh.writing = false
+	}
+	if fh.staging != nil {
+		_ = fh.staging.Close()
+		err := os.Remove(fh.staging.Name())
+		if err != nil {
+			fh.fs.logger.Error("remove staging",
+				zap.String("staging", fh.staging.Name()),
+				zap.Error(err))
+		}
+		fh.staging = nil
+	}
+	if fh.manifest != nil && fh.dirty {
+		fh.discardChunks()
+	}
+	fh.dirty = false
+}
+
+// endWrite completes the write session, the error will be kept since data
+// written could not be persisted anymore.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) endWrite() (err error) {
 	err = fh.cache.endWrite(fh.ID)
+	fh.writing = false
+	fh.fs.invalidateBlocks(fh.ino.Path)
 	if err != nil {
+		fh.err = err
 		return
 	}
-	return
+
+	// Metadata has been written along with data if storage carries it.
+	m := fh.metadata
+	if _, ok := fh.fs.s.(metadataStorer); !ok {
+		m, err = fh.formatMetadata()
+		if err != nil {
+			return
+		}
+	}
+	err = fh.fs.cacheMetadata(fh.ino.Path, m)
+	if err != nil {
+		return
+	}
+
+	fh.ino.Size = fh.size
+	fh.ino.Mtime = time.Now()
+	fh.fs.refreshObject(fh.ino)
+	return fh.fs.SetInode(fh.ino)
 }
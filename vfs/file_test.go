@@ -0,0 +1,276 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/beyondstorage/go-storage/v4/services"
+	"github.com/beyondstorage/go-storage/v4/types"
+	"go.uber.org/zap"
+)
+
+func TestFileHandleTruncate(t *testing.T) {
+	cases := []struct {
+		name   string
+		size   uint64
+		expect []byte
+	}{
+		// Streamed session will be dropped.
+		{"to zero", 0, bytes.Repeat([]byte{'b'}, 10)},
+		// Written data will be moved into staging file.
+		{"keep head", 50, append(bytes.Repeat([]byte{'b'}, 10), bytes.Repeat([]byte{'a'}, 40)...)},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			fs, root := newTestFS(t, "fs://"+t.TempDir(), "")
+			defer fs.Close()
+
+			_, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = fh.Write(0, bytes.Repeat([]byte{'a'}, 100))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = fh.Truncate(tt.size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = fh.Write(0, bytes.Repeat([]byte{'b'}, 10))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = fs.DeleteFileHandle(fh.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			_, err = fs.s.Read("a", &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf.Bytes(), tt.expect) {
+				t.Errorf("expect %q, got %q", tt.expect, buf.Bytes())
+			}
+		})
+	}
+}
+
+func TestReadInFlight(t *testing.T) {
+	fs, root := newTestFS(t, "fs://"+t.TempDir(), "")
+	defer fs.Close()
+
+	ino, a, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every open gets its own copy of inode.
+	ino, err = fs.GetInode(ino.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := fs.OpenFileHandle(ino, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Data written via a is not persisted yet.
+	_, err = a.Write(0, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	n, err := b.Read(0, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "hello" {
+		t.Errorf("expect hello, got %q", buf[:n])
+	}
+
+	// Handles become the writer in turn and read from each other.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		var wg sync.WaitGroup
+		for _, fh := range []*FileHandle{a, b} {
+			wg.Add(1)
+			go func(fh *FileHandle) {
+				defer wg.Done()
+
+				buf := make([]byte, 5)
+				for i := 0; i < 100; i++ {
+					_, _ = fh.Write(0, []byte("world"))
+					_, _ = fh.Read(0, buf)
+				}
+			}(fh)
+		}
+		wg.Wait()
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("reads between handles deadlocked")
+	}
+
+	for _, fh := range []*FileHandle{a, b} {
+		err = fs.DeleteFileHandle(fh.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// failWriter fails all writes to storage.
+type failWriter struct {
+	types.Storager
+}
+
+func (f failWriter) Write(path string, r io.Reader, size int64, pairs ...types.Pair) (n int64, err error) {
+	return 0, services.ErrPermissionDenied
+}
+
+func TestDeleteFileHandleDiscard(t *testing.T) {
+	fs, root := newTestFS(t, "fs://"+t.TempDir(), "")
+	defer fs.Close()
+
+	_, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Random write will switch to staging file.
+	_, err = fh.Write(10, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fh.staging == nil {
+		t.Fatal("expect staging file used")
+	}
+	staging := fh.staging.Name()
+
+	fs.s = failWriter{fs.s}
+	err = fs.DeleteFileHandle(fh.ID)
+	if err == nil {
+		t.Fatal("expect close failed")
+	}
+	if _, err = os.Stat(staging); !os.IsNotExist(err) {
+		t.Errorf("expect staging file removed, got %v", err)
+	}
+	if fs.fhm.Get(fh.ID) != nil {
+		t.Error("expect handle removed")
+	}
+}
+
+func TestObjectRefreshedAfterWrite(t *testing.T) {
+	fs, root := newTestFS(t, "fs://"+t.TempDir(), "")
+	defer fs.Close()
+
+	_, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := objectVersion(fh.GetInode())
+
+	_, err = fh.Write(0, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := fs.s.Stat("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ino := fh.GetInode()
+	if lm, _ := o.GetLastModified(); !ino.LastModified.Equal(lm) {
+		t.Errorf("expect last modified %v, got %v", lm, ino.LastModified)
+	}
+	if objectVersion(ino) == before {
+		t.Errorf("expect version changed, got %s", before)
+	}
+}
+
+func TestStagingSeededFromSession(t *testing.T) {
+	fs, root := newTestFS(t, "fs://"+t.TempDir(), "")
+	defer fs.Close()
+
+	_, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fh.Write(0, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Random write switches to staging file.
+	_, err = fh.Write(10, []byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Streamed data should be copied from cache instead of uploaded.
+	o, err := fs.s.Stat("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := o.GetContentLength(); n != 0 {
+		t.Errorf("expect nothing uploaded before close, got %d bytes", n)
+	}
+
+	err = fs.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	_, err = fs.s.Read("a", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "hello\x00\x00\x00\x00\x00world"
+	if buf.String() != expect {
+		t.Errorf("expect %q, got %q", expect, buf.String())
+	}
+}
+
+func TestTruncateStagingDir(t *testing.T) {
+	stagingDir := t.TempDir()
+	fs, err := NewFS(&Config{
+		StoragePath: "fs://" + t.TempDir(),
+		StagingDir:  stagingDir,
+		Logger:      zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	root := nextInode.Load()
+
+	ino, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, fh, 0, "hello")
+
+	// Object is spooled into staging dir, which is missing now.
+	err = os.Remove(stagingDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := uint64(2)
+	err = fs.UpdateAttr(ino, &AttrUpdate{Size: &size})
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expect staging dir not exist, got %v", err)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/beyondstorage/go-service-fs/v3"
@@ -12,6 +15,7 @@ import (
 	"github.com/beyondstorage/go-storage/v4/pairs"
 	"github.com/beyondstorage/go-storage/v4/services"
 	"github.com/beyondstorage/go-storage/v4/types"
+	"github.com/panjf2000/ants/v2"
 	"go.uber.org/atomic"
 	"go.uber.org/zap"
 
@@ -35,14 +39,92 @@ type FS struct {
 	s     types.Storager
 	cache *Cache
 	meta  meta.Service
+	locks LockManager
+
+	readAheadPool *ants.Pool
+	blockCache    *BlockCache
+
+	persistAttr bool
+	stagingDir  string
+	chunkSize   uint64
+	chunkRefs   *chunkRefs
+	// manifestLocks serialise manifest commits of chunked files.
+	manifestLocks [manifestLockCount]sync.Mutex
+	// metaPersistent means meta service will be kept across mounts.
+	metaPersistent bool
 
 	dhm    *dirHandleMap
 	fhm    *fileHandleMap
 	logger *zap.Logger
+
+	// stop will be closed while closing fs, background jobs in wg should
+	// return after that.
+	stop chan struct{}
+	wg   sync.WaitGroup
 }
 
 type Config struct {
 	StoragePath string
+	// CacheStoragePath is the storage to keep data being written before it's
+	// uploaded, memory will be used if empty.
+	//
+	// Data written is kept in it until it's uploaded as a part or the file
+	// closed, data uploaded as parts could not be read back until the file
+	// closed. A local storage like fs:///var/cache/beyondfs is required for
+	// writing files larger than the memory. The storage should support append
+	// and be dedicated to cache, pieces left in it will be removed while mounting.
+	CacheStoragePath string
+	// CacheDirtyLimit is the max bytes of data written but not uploaded yet,
+	// including dirty chunks in chunked layout, 1GiB will be used if zero. Writes
+	// beyond it will upload data synchronously or wait for uploads in background.
+	// It could be exceeded by less than a part or a chunk per file, and doesn't
+	// apply to storage without multipart which could only upload streamed data
+	// while closing.
+	CacheDirtyLimit uint64
+	// CachePartSize is the size of parts uploaded while writing, 64MiB will be
+	// used if zero. It will be adjusted to the multipart limits of storage.
+	CachePartSize uint64
+	// UploadConcurrency is the max number of parts uploaded at the same time
+	// by all files, 10 will be used if zero.
+	UploadConcurrency uint64
+	// MultipartMaxAge is the age of incomplete multiparts under the work dir to
+	// be aborted, 24h will be used if zero. Multiparts being written by other
+	// mounts will be aborted as well if it's too short.
+	//
+	// Storage like s3 doesn't return the time multipart created, so the age is
+	// counted since it's first seen, which is kept across mounts only if
+	// MetaPath is set.
+	MultipartMaxAge time.Duration
+	// MetaPath is the dir to persist metadata, metadata will be kept in memory if empty.
+	//
+	// Dir rename journals can only be recovered in next mount with MetaPath set.
+	// Storage like s3 keeps attributes and xattrs in object's user metadata.
+	// Other storage only keeps attributes in meta service, they will be lost
+	// after unmount without MetaPath, and xattrs are not supported there.
+	MetaPath string
+	// LockManager manages advisory locks, locks will be kept in memory if nil.
+	LockManager LockManager
+	// PersistAttr will persist mode, owner and times changed via SetAttr into object's
+	// user metadata, otherwise they will be kept in inode only.
+	PersistAttr bool
+	// StagingDir is the local dir to keep staging files for random writes and
+	// objects being truncated, os.TempDir will be used if empty.
+	StagingDir string
+	// ChunkSize enables chunked layout if not zero, new files will be stored as
+	// chunk objects in this size, so random writes only touch affected chunks.
+	//
+	// Files in chunked layout are recognised via content type, or probing the
+	// header while chunked layout enabled. Storage without content type like fs
+	// requires it to be kept enabled to read these files.
+	ChunkSize uint64
+	// BlockCacheDir enables on-disk block cache for reads if not empty, cached
+	// blocks will be kept across mounts.
+	BlockCacheDir string
+	// BlockCacheSize is the capacity of block cache in bytes, 1GiB will be used if zero.
+	BlockCacheSize uint64
+	// BlockCachePolicy is the eviction policy of block cache: lru, lfu or 2q,
+	// lru will be used if empty.
+	BlockCachePolicy string
 
 	Logger *zap.Logger
 }
@@ -53,68 +135,179 @@ func NewFS(cfg *Config) (fs *FS, err error) {
 		return nil, err
 	}
 
-	cacheStore, err := services.NewStoragerFromString("memory://")
+	cachePath := cfg.CacheStoragePath
+	if cachePath == "" {
+		cachePath = "memory://"
+	}
+	// Cache storage will be cleaned while mounting, it must not be the storage
+	// itself. Memory storage is created per instance so it's always dedicated.
+	if !strings.HasPrefix(cachePath, "memory:") &&
+		strings.TrimSuffix(cachePath, "/") == strings.TrimSuffix(cfg.StoragePath, "/") {
+		return nil, fmt.Errorf("cache storage %s is the storage to mount", cachePath)
+	}
+	cacheStore, err := services.NewStoragerFromString(cachePath)
 	if err != nil {
 		return nil, err
 	}
+	err = checkCacheStorage(cacheStore)
+	if err != nil {
+		return nil, fmt.Errorf("check cache storage %s: %w", cachePath, err)
+	}
+	err = cleanCacheStorage(cacheStore)
+	if err != nil {
+		return nil, fmt.Errorf("clean cache storage %s: %w", cachePath, err)
+	}
 
-	metaSrv, err := meta.NewBadger()
+	metaSrv, err := meta.NewBadger(cfg.MetaPath)
 	if err != nil {
 		return nil, err
 	}
+	// Inode id is allocated per mount, drop inodes and entries left by last mount.
+	prefixes := [][]byte{meta.InodePrefix(), meta.DirPrefix(), meta.ManifestPrefix()}
+	if _, ok := store.(metadataStorer); ok {
+		// Metadata could be changed by others, it will be loaded from objects again.
+		prefixes = append(prefixes, meta.MetadataPrefix())
+	}
+	for _, prefix := range prefixes {
+		err = metaSrv.PrefixDelete(prefix)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	readAheadPool, err := ants.NewPool(readAheadConcurrency, ants.WithNonblocking(true))
+	if err != nil {
+		return nil, fmt.Errorf("new pool: %w", err)
+	}
+	uploadConcurrency := int(cfg.UploadConcurrency)
+	if uploadConcurrency == 0 {
+		uploadConcurrency = defaultUploadConcurrency
+	}
+	uploadPool, err := ants.NewPool(uploadConcurrency)
+	if err != nil {
+		return nil, fmt.Errorf("new pool: %w", err)
+	}
 
 	fs = &FS{
-		s: store,
-		// TODO: we will support other service as cache later.
-		cache: NewCache(store, cacheStore, cfg.Logger),
+		s:     store,
+		cache: NewCache(store, cacheStore, uploadPool, int64(cfg.CacheDirtyLimit), int64(cfg.CachePartSize), cfg.Logger),
 		meta:  metaSrv,
+		locks: cfg.LockManager,
+
+		readAheadPool: readAheadPool,
+
+		persistAttr:    cfg.PersistAttr,
+		stagingDir:     cfg.StagingDir,
+		chunkSize:      cfg.ChunkSize,
+		chunkRefs:      newChunkRefs(),
+		metaPersistent: cfg.MetaPath != "",
 
 		dhm:    newDirHandleMap(),
 		fhm:    newFileHandleMap(),
 		logger: cfg.Logger,
+
+		stop: make(chan struct{}),
+	}
+
+	if fs.locks == nil {
+		fs.locks = NewLocalLockManager()
+	}
+	if cfg.BlockCacheDir != "" {
+		policy, err := NewEvictionPolicy(cfg.BlockCachePolicy)
+		if err != nil {
+			return nil, err
+		}
+		fs.blockCache, err = NewBlockCache(cfg.BlockCacheDir, cfg.BlockCacheSize, policy, cfg.Logger)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// Start cache service.
-	go fs.cache.Start()
+	err = fs.recoverRenames()
+	if err != nil {
+		return nil, err
+	}
 
 	o := types.NewObject(nil, true)
 	o.ID = store.Metadata().WorkDir
 	o.Path = ""
 	o.Mode = types.ModeDir
+	_, err = fs.loadMetadata(o)
+	if err != nil {
+		return nil, err
+	}
 	err = fs.SetInode(newInode(1, o))
 	if err != nil {
 		return nil, err
 	}
+
+	// Collect multiparts left by failed sessions and crashed mounts.
+	fs.wg.Add(1)
+	go func() {
+		defer fs.wg.Done()
+		fs.cache.collectMultiparts(fs.meta, cfg.MultipartMaxAge, fs.stop)
+	}()
 	return fs, err
 }
 
-func (fs *FS) Create(parent uint64, name string) (ino *Inode, fh *FileHandle, err error) {
-	// FIXME: we need to handle file exists.
+// Close will stop background jobs and release the meta service, fs should not
+// be used anymore.
+func (fs *FS) Close() (err error) {
+	close(fs.stop)
+	fs.wg.Wait()
+	return fs.meta.Close()
+}
+
+// Create creates a new file and opens it with flags.
+//
+// Existing file will be opened instead unless O_EXCL is set.
+func (fs *FS) Create(parent uint64, name string, attr *CreateAttr, flags int) (ino *Inode, fh *FileHandle, err error) {
 	p, err := fs.GetInode(parent)
 	if err != nil {
 		return nil, nil, err
 	}
 
+	ino, err = fs.GetEntry(parent, name)
+	if err != nil && !errors.Is(err, services.ErrObjectNotExist) {
+		return nil, nil, err
+	}
+	if ino != nil {
+		if flags&os.O_EXCL != 0 {
+			return nil, nil, ErrExist
+		}
+		if ino.IsDir() {
+			return nil, nil, ErrIsDir
+		}
+		fh, err = fs.OpenFileHandle(ino, flags)
+		if err != nil {
+			return nil, nil, err
+		}
+		return ino, fh, nil
+	}
+
+	now := time.Now()
+	m := attr.formatMetadata(0, now)
+
 	path := p.GetEntryPath(name)
-	_, err = fs.s.Write(path, bytes.NewReader([]byte{}), 0)
+	_, err = fs.writeObject(path, bytes.NewReader([]byte{}), 0, m)
 	if err != nil {
 		fs.logger.Error("write", zap.String("path", path), zap.Error(err))
 		return nil, nil, err
 	}
 
-	o := fs.s.Create(path)
-	o.Path = path
-	o.Mode = types.ModeRead
+	o := fs.newObject(path, types.ModeRead)
 	o.SetContentLength(0)
-	o.SetLastModified(time.Now())
+	o.SetLastModified(now)
+	o.SetUserMetadata(m)
 
 	ino = newInode(parent, o)
+	fs.refreshObject(ino)
 	err = fs.SetInode(ino)
 	if err != nil {
 		return
 	}
 
-	fh, err = fs.CreateFileHandle(ino)
+	fh, err = fs.OpenFileHandle(ino, flags)
 	if err != nil {
 		return
 	}
@@ -126,10 +319,17 @@ func (fs *FS) Delete(parent uint64, name string) (err error) {
 	if err != nil {
 		return
 	}
+	chunks := fs.getChunks(ino)
 	err = fs.s.Delete(ino.Path)
 	if err != nil {
 		return
 	}
+	fs.invalidateBlocks(ino.Path)
+	fs.retireChunks(chunks)
+	err = fs.deleteMetadata(ino.Path)
+	if err != nil {
+		return
+	}
 	err = fs.DeleteInode(ino)
 	if err != nil {
 		return
@@ -147,8 +347,55 @@ func (fs *FS) Stat(parent uint64, name string) (ino *Inode, err error) {
 		return
 	}
 
-	path := p.GetEntryPath(name)
-	o, err := fs.s.Stat(path)
+	o, err := fs.statObject(p.GetEntryPath(name))
+	if err != nil {
+		return nil, err
+	}
+	_, err = fs.loadMetadata(o)
+	if err != nil {
+		return nil, err
+	}
+	ino = newInode(p.ID, o)
+	err = fs.resolveManifest(ino)
+	if err != nil {
+		return
+	}
+	err = fs.SetInode(ino)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// completeInode stats the object of an incomplete inode built from listing, so
+// that attributes carried by object could be loaded. The inode ID is kept since
+// it could have been returned already.
+func (fs *FS) completeInode(ino *Inode) (err error) {
+	o, err := fs.statObject(ino.Path)
+	if err != nil {
+		return
+	}
+	_, err = fs.loadMetadata(o)
+	if err != nil {
+		return
+	}
+	c := newInode(ino.ParentID, o)
+	c.ID = ino.ID
+	err = fs.resolveManifest(c)
+	if err != nil {
+		return
+	}
+	err = fs.SetInode(c)
+	if err != nil {
+		return
+	}
+	*ino = *c
+	return nil
+}
+
+// statObject returns the object of path, which could be a file or a dir.
+func (fs *FS) statObject(path string) (o *types.Object, err error) {
+	o, err = fs.s.Stat(path)
 	if err != nil && errors.Is(err, services.ErrObjectNotExist) {
 		// FIXME: we need to use stat with ModeDir instead.
 		o, err = fs.s.Stat(path + "/")
@@ -158,10 +405,31 @@ func (fs *FS) Stat(parent uint64, name string) (ino *Inode, err error) {
 		o.Path = path
 		o.Mode = types.ModeDir
 	}
+	return o, err
+}
+
+func (fs *FS) CreateDir(parent uint64, name string, attr *CreateAttr) (ino *Inode, err error) {
+	p, err := fs.GetInode(parent)
 	if err != nil {
 		return nil, err
 	}
-	ino = newInode(p.ID, o)
+
+	now := time.Now()
+	m := attr.formatMetadata(os.ModeDir, now)
+
+	path := p.GetEntryPath(name)
+	err = fs.createDirObject(path, m)
+	if err != nil {
+		fs.logger.Error("create dir", zap.String("path", path), zap.Error(err))
+		return nil, err
+	}
+
+	o := fs.newObject(path, types.ModeDir)
+	o.SetLastModified(now)
+	// Dir's attributes will be kept in inode even if storage can't carry them.
+	o.SetUserMetadata(m)
+
+	ino = newInode(parent, o)
 	err = fs.SetInode(ino)
 	if err != nil {
 		return
@@ -169,8 +437,85 @@ func (fs *FS) Stat(parent uint64, name string) (ino *Inode, err error) {
 	return
 }
 
-func (fs *FS) DeleteDir(path string) (err error) {
-	panic("implement me")
+func (fs *FS) DeleteDir(parent uint64, name string) (err error) {
+	ino, err := fs.GetEntry(parent, name)
+	if err != nil {
+		return
+	}
+	if !ino.IsDir() {
+		return ErrNotDir
+	}
+
+	empty, err := fs.isEmptyDir(ino.Path)
+	if err != nil {
+		return
+	}
+	if !empty {
+		return ErrNotEmpty
+	}
+
+	err = fs.deleteDirObject(ino.Path)
+	if err != nil {
+		return
+	}
+	err = fs.DeleteInode(ino)
+	if err != nil {
+		return
+	}
+	err = fs.DeleteEntry(parent, name)
+	if err != nil {
+		return
+	}
+	return
+}
+
+// createDirObject will create dir via Direr, or a dir marker object with trailing
+// slash if storage doesn't support dir natively.
+func (fs *FS) createDirObject(path string, m Metadata) (err error) {
+	if ms, ok := fs.s.(metadataStorer); ok {
+		err = ms.createDirWithMetadata(path, m)
+	} else if d, ok := fs.s.(types.Direr); ok {
+		_, err = d.CreateDir(path)
+	} else {
+		_, err = fs.s.Write(path+"/", bytes.NewReader([]byte{}), 0)
+	}
+	if err != nil || len(m) == 0 {
+		return
+	}
+	return fs.cacheMetadata(path, m)
+}
+
+func (fs *FS) deleteDirObject(path string) (err error) {
+	if _, ok := fs.s.(types.Direr); ok {
+		err = fs.s.Delete(path, pairs.WithObjectMode(types.ModeDir))
+	} else {
+		err = fs.s.Delete(path + "/")
+	}
+	if err != nil {
+		return
+	}
+	return fs.deleteMetadata(path)
+}
+
+func (fs *FS) isEmptyDir(path string) (empty bool, err error) {
+	it, err := fs.s.List(path+"/", pairs.WithListMode(types.ListModeDir))
+	if err != nil {
+		return
+	}
+	for {
+		o, err := it.Next()
+		if err != nil && errors.Is(err, types.IterateDone) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		// Dir marker object could be listed as well, skip it.
+		if strings.TrimSuffix(o.Path, "/") == path {
+			continue
+		}
+		return false, nil
+	}
 }
 
 func (fs *FS) CreateFileHandle(ino *Inode) (fh *FileHandle, err error) {
@@ -184,11 +529,56 @@ func (fs *FS) CreateFileHandle(ino *Inode) (fh *FileHandle, err error) {
 		buf:    fileBufPool.Get(),
 		size:   ino.Size,
 		offset: 0,
+
+		readable: true,
+		writable: true,
+	}
+	if ino.Chunked {
+		mf, err := fs.GetManifest(ino)
+		if err != nil {
+			return nil, err
+		}
+		fh.setManifest(mf)
+		fh.dirtyChunks = make(map[uint64][]byte)
+		fh.changedChunks = make(map[uint64]bool)
 	}
 	fs.fhm.Set(fh.ID, fh)
 	return fh, nil
 }
 
+// OpenFileHandle creates a file handle which honours the open flags.
+//
+// O_TRUNC will truncate the file before opening, and O_APPEND will prepare the
+// handle for appending. Write session will be started by the first write.
+func (fs *FS) OpenFileHandle(ino *Inode, flags int) (fh *FileHandle, err error) {
+	mode := flags & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	writable := mode == os.O_WRONLY || mode == os.O_RDWR
+
+	if flags&os.O_TRUNC != 0 && writable && (ino.Size > 0 || ino.Chunked) {
+		var size uint64
+		err = fs.UpdateAttr(ino, &AttrUpdate{Size: &size})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	fh, err = fs.CreateFileHandle(ino)
+	if err != nil {
+		return nil, err
+	}
+	fh.readable = mode == os.O_RDONLY || mode == os.O_RDWR
+	fh.writable = writable
+
+	if flags&os.O_APPEND != 0 && writable {
+		err = fh.PrepareForAppend()
+		if err != nil {
+			fs.fhm.Delete(fh.ID)
+			return nil, err
+		}
+	}
+	return fh, nil
+}
+
 func (fs *FS) GetFileHandle(fhid uint64) (fh *FileHandle, err error) {
 	return fs.fhm.Get(fhid), nil
 }
@@ -198,16 +588,29 @@ func (fs *FS) DeleteFileHandle(fhid uint64) (err error) {
 	if fh == nil {
 		return nil
 	}
+	// Handle will not be used anymore even if failed to close.
 	err = fh.CloseForWrite()
 	if err != nil {
-		return
+		fh.Discard()
 	}
+	fs.fhm.DeleteWriter(fh.ino.ID, fh)
 	fs.fhm.Delete(fhid)
+	fh.releaseChunks()
+	if err != nil {
+		return
+	}
+
+	// Other handles opened before could still refer to the old manifest.
+	if fh.manifest != nil {
+		for _, v := range fs.fhm.List(fh.ino.ID) {
+			v.syncManifest(fh.manifest)
+		}
+	}
 	return nil
 }
 
 func (fs *FS) CreateDirHandle(ino *Inode) (dh *DirHandle, err error) {
-	it, err := fs.s.List(ino.Path, pairs.WithListMode(types.ListModeDir))
+	it, err := fs.s.List(ino.GetDirPath(), pairs.WithListMode(types.ListModeDir))
 	if err != nil {
 		return
 	}
@@ -271,11 +674,65 @@ func (fs *FS) GetInode(id uint64) (ino *Inode, err error) {
 	return
 }
 
+// DirtyBytes returns the bytes of data written but not uploaded yet.
+func (fs *FS) DirtyBytes() int64 {
+	return fs.cache.DirtyBytes()
+}
+
+// GetAttr returns the inode with data written by open handles taken into account.
+func (fs *FS) GetAttr(id uint64) (ino *Inode, err error) {
+	ino, err = fs.GetInode(id)
+	if err != nil || ino == nil {
+		return
+	}
+	fs.applyInFlight(ino)
+	return ino, nil
+}
+
+// applyInFlight updates the size of inode if it's being written.
+func (fs *FS) applyInFlight(ino *Inode) {
+	w := fs.fhm.GetWriter(ino.ID)
+	if w == nil {
+		return
+	}
+	if size, ok := w.InFlightSize(); ok {
+		ino.Size = size
+	}
+}
+
+// newObject returns an object whose facts are all set by caller. Objects from
+// Storager.Create could be stat lazily while getting facts not set, which will
+// replace the facts set, like user metadata not carried by storage.
+func (fs *FS) newObject(path string, mode types.ObjectMode) *types.Object {
+	o := types.NewObject(fs.s, true)
+	o.ID = fs.s.Create(path).ID
+	o.Path = path
+	o.Mode = mode
+	return o
+}
+
+// refreshObject updates the facts of object in inode after it's written, so that
+// xattrs and block cache will not see the replaced object.
+func (fs *FS) refreshObject(ino *Inode) {
+	o, err := fs.s.Stat(ino.Path)
+	if err != nil {
+		// Stale etag must not be kept, the version will fall back to size and time.
+		fs.logger.Warn("stat after write", zap.String("path", ino.Path), zap.Error(err))
+		o = fs.s.Create(ino.Path)
+		o.SetLastModified(time.Now())
+	}
+	ino.setObjectFacts(o)
+}
+
 func (fs *FS) DeleteInode(ino *Inode) (err error) {
 	err = fs.meta.Delete(meta.InodeKey(ino.ID))
 	if err != nil {
 		return fmt.Errorf("del inode: %w", err)
 	}
+	err = fs.meta.Delete(meta.ManifestKey(ino.ID))
+	if err != nil {
+		return fmt.Errorf("del manifest: %w", err)
+	}
 	return
 }
 
@@ -303,6 +760,13 @@ func (fs *FS) GetEntry(parent uint64, name string) (ino *Inode, err error) {
 	if err != nil {
 		return nil, fmt.Errorf("unmarshal inode: %w", err)
 	}
+	if ino.Incomplete {
+		err = fs.completeInode(ino)
+		if err != nil {
+			return nil, err
+		}
+	}
+	fs.applyInFlight(ino)
 	return
 }
 
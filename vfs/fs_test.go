@@ -0,0 +1,333 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/beyondstorage/go-storage/v4/pairs"
+	"github.com/beyondstorage/go-storage/v4/services"
+	"github.com/beyondstorage/go-storage/v4/types"
+)
+
+// flatType is the storage keeping objects in a flat key space like s3, dirs are
+// only made of key prefixes and marker objects.
+const flatType = "flat"
+
+func init() {
+	services.RegisterSchema(flatType, map[string]string{})
+	services.RegisterStorager(flatType, newFlatStorage)
+}
+
+type flatStorage struct {
+	types.UnimplementedStorager
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	// readErr will be returned by reads after half of data read if set.
+	readErr error
+}
+
+func newFlatStorage(ps ...types.Pair) (types.Storager, error) {
+	return &flatStorage{objects: make(map[string][]byte)}, nil
+}
+
+func (st *flatStorage) String() string {
+	return flatType
+}
+
+func (st *flatStorage) Metadata(ps ...types.Pair) *types.StorageMeta {
+	return types.NewStorageMeta()
+}
+
+func (st *flatStorage) Create(path string, ps ...types.Pair) *types.Object {
+	o := types.NewObject(st, true)
+	o.ID = path
+	o.Path = path
+	return o
+}
+
+func (st *flatStorage) Stat(path string, ps ...types.Pair) (o *types.Object, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	data, ok := st.objects[path]
+	if !ok {
+		return nil, services.ErrObjectNotExist
+	}
+	o = st.Create(path)
+	o.Mode = types.ModeRead
+	o.SetContentLength(int64(len(data)))
+	return o, nil
+}
+
+func (st *flatStorage) Read(path string, w io.Writer, ps ...types.Pair) (n int64, err error) {
+	st.mu.Lock()
+	data, ok := st.objects[path]
+	readErr := st.readErr
+	st.mu.Unlock()
+	if !ok {
+		return 0, services.ErrObjectNotExist
+	}
+
+	for _, v := range ps {
+		switch v.Key {
+		case "offset":
+			data = data[v.Value.(int64):]
+		case "size":
+			if size := v.Value.(int64); size < int64(len(data)) {
+				data = data[:size]
+			}
+		}
+	}
+	if readErr != nil {
+		m, _ := w.Write(data[:len(data)/2])
+		return int64(m), readErr
+	}
+	m, err := w.Write(data)
+	return int64(m), err
+}
+
+func (st *flatStorage) Write(path string, r io.Reader, size int64, ps ...types.Pair) (n int64, err error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.objects[path] = data
+	return int64(len(data)), nil
+}
+
+func (st *flatStorage) Delete(path string, ps ...types.Pair) (err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	delete(st.objects, path)
+	return nil
+}
+
+func (st *flatStorage) List(path string, ps ...types.Pair) (oi *types.ObjectIterator, err error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	// Objects and common prefixes right under path, like s3 with delimiter.
+	var objects []*types.Object
+	seen := make(map[string]bool)
+	for k := range st.objects {
+		if !strings.HasPrefix(k, path) {
+			continue
+		}
+		o := st.Create(k)
+		o.Mode = types.ModeRead
+		if i := strings.Index(k[len(path):], "/"); i >= 0 && len(path)+i+1 < len(k) {
+			o.Path = k[:len(path)+i+1]
+			o.Mode = types.ModeDir
+		}
+		if seen[o.Path] {
+			continue
+		}
+		seen[o.Path] = true
+		objects = append(objects, o)
+	}
+
+	done := false
+	return types.NewObjectIterator(context.Background(), func(ctx context.Context, page *types.ObjectPage) error {
+		if done {
+			return types.IterateDone
+		}
+		done = true
+		page.Data = objects
+		return nil
+	}, nil), nil
+}
+
+func TestCreateDeleteDir(t *testing.T) {
+	fs, root := newTestFS(t, "fs://"+t.TempDir(), "")
+	defer fs.Close()
+
+	ino, err := fs.CreateDir(root, "d", &CreateAttr{Mode: 0750})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ino.IsDir() || ino.Path != "d" {
+		t.Fatalf("expect dir d, got %+v", ino)
+	}
+	o, err := fs.s.Stat("d", pairs.WithObjectMode(types.ModeDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !o.Mode.IsDir() {
+		t.Errorf("expect dir created in storage, got mode %v", o.Mode)
+	}
+
+	_, fh, err := fs.Create(ino.ID, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, fh, 0, "hello")
+	err = fs.DeleteDir(root, "d")
+	if !errors.Is(err, ErrNotEmpty) {
+		t.Errorf("expect not empty, got %v", err)
+	}
+	err = fs.DeleteDir(ino.ID, "a")
+	if !errors.Is(err, ErrNotDir) {
+		t.Errorf("expect not dir, got %v", err)
+	}
+
+	err = fs.Delete(ino.ID, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.DeleteDir(root, "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.GetEntry(root, "d")
+	if !errors.Is(err, services.ErrObjectNotExist) {
+		t.Errorf("expect dir removed, got %v", err)
+	}
+}
+
+func TestDirMarker(t *testing.T) {
+	fs, root := newTestFS(t, flatType+"://", "")
+	defer fs.Close()
+
+	ino, err := fs.CreateDir(root, "d", &CreateAttr{Mode: 0755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Storage without dir keeps an empty object with trailing slash.
+	o, err := fs.s.Stat("d/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := o.GetContentLength(); n != 0 {
+		t.Errorf("expect empty marker, got size %d", n)
+	}
+
+	// Marker is not counted as an entry of the dir.
+	_, fh, err := fs.Create(ino.ID, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, fh, 0, "hello")
+	err = fs.DeleteDir(root, "d")
+	if !errors.Is(err, ErrNotEmpty) {
+		t.Errorf("expect not empty, got %v", err)
+	}
+	err = fs.Delete(ino.ID, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.DeleteDir(root, "d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.s.Stat("d/")
+	if !errors.Is(err, services.ErrObjectNotExist) {
+		t.Errorf("expect marker removed, got %v", err)
+	}
+}
+
+func TestCreateExclusive(t *testing.T) {
+	fs, root := newTestFS(t, "fs://"+t.TempDir(), "")
+	defer fs.Close()
+
+	ino, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, fh, 0, "hello")
+
+	_, _, err = fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if !errors.Is(err, ErrExist) {
+		t.Errorf("expect exist, got %v", err)
+	}
+	// Existing file is opened without O_EXCL.
+	got, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDONLY|os.O_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.DeleteFileHandle(fh.ID)
+	if got.ID != ino.ID || got.Size != 5 {
+		t.Errorf("expect inode %d in size 5, got %+v", ino.ID, got)
+	}
+}
+
+func TestOpenTruncate(t *testing.T) {
+	fs, root := newTestFS(t, "fs://"+t.TempDir(), "")
+	defer fs.Close()
+
+	_, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, fh, 0, "hello")
+	ino, err := fs.GetEntry(root, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// O_TRUNC is ignored by read only opens.
+	fh, err = fs.OpenFileHandle(ino, os.O_RDONLY|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = fs.DeleteFileHandle(fh.ID)
+	if got := readFile(t, fs, root, "a"); string(got) != "hello" {
+		t.Errorf("expect hello, got %q", got)
+	}
+
+	fh, err = fs.OpenFileHandle(ino, os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ino.Size != 0 {
+		t.Errorf("expect inode truncated, got size %d", ino.Size)
+	}
+	writeFile(t, fs, fh, 0, "hi")
+	if got := readFile(t, fs, root, "a"); string(got) != "hi" {
+		t.Errorf("expect hi, got %q", got)
+	}
+}
+
+func TestOpenAccessMode(t *testing.T) {
+	fs, root := newTestFS(t, "fs://"+t.TempDir(), "")
+	defer fs.Close()
+
+	ino, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 8)
+	_, err = fh.Read(0, buf)
+	if !errors.Is(err, ErrBadHandle) {
+		t.Errorf("expect bad handle while reading, got %v", err)
+	}
+	writeFile(t, fs, fh, 0, "hello")
+
+	fh, err = fs.OpenFileHandle(ino, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.DeleteFileHandle(fh.ID)
+	_, err = fh.Write(0, []byte("world"))
+	if !errors.Is(err, ErrBadHandle) {
+		t.Errorf("expect bad handle while writing, got %v", err)
+	}
+	err = fh.Truncate(0)
+	if !errors.Is(err, ErrBadHandle) {
+		t.Errorf("expect bad handle while truncating, got %v", err)
+	}
+	if got := readFile(t, fs, root, "a"); string(got) != "hello" {
+		t.Errorf("expect hello, got %q", got)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"strings"
 	"time"
 
 	"github.com/beyondstorage/go-storage/v4/types"
@@ -23,12 +24,38 @@ type Inode struct {
 	Atime      time.Time
 	Mtime      time.Time
 	Ctime      time.Time
+	Uid        uint32
+	Gid        uint32
+	// HasMode means the permission bits in Mode are set explicitly, instead of the defaults.
+	HasMode bool
+	// HasOwner means Uid and Gid are set explicitly, instead of the defaults.
+	HasOwner bool
+
+	// Target is the target of symlink, could be empty if not read yet.
+	Target string
+	// Chunked means this file is stored as chunks described by a manifest,
+	// and Size is the size of file instead of the manifest object.
+	Chunked bool
+	// Incomplete means this inode is built from listing without attributes
+	// carried by object, it will be completed via stat while looked up.
+	Incomplete bool
+
+	// Object facts from underlying storage, could be empty if storage doesn't support.
+	Etag         string
+	ContentMd5   string
+	ContentType  string
+	StorageClass string
+	LastModified time.Time
 }
 
 func (ino *Inode) IsDir() bool {
 	return ino.Mode&uint32(os.ModeDir) != 0
 }
 
+func (ino *Inode) IsSymlink() bool {
+	return ino.Mode&uint32(os.ModeSymlink) != 0
+}
+
 func (ino *Inode) GetEntryPath(name string) string {
 	if ino.Path == "" {
 		return name
@@ -36,17 +63,38 @@ func (ino *Inode) GetEntryPath(name string) string {
 	return fmt.Sprintf("%s/%s", ino.Path, name)
 }
 
+// GetDirPath returns the path used to list entries under this dir.
+func (ino *Inode) GetDirPath() string {
+	if ino.Path == "" {
+		return ""
+	}
+	return ino.Path + "/"
+}
+
 func newInode(parent uint64, o *types.Object) *Inode {
 	ino := &Inode{
 		ID:       NextInodeID(),
 		ParentID: parent,
 
-		Path:       o.Path,
+		// Dir objects returned by list could have a trailing slash, trim it so that
+		// entry path could be built via GetEntryPath.
+		Path:       strings.TrimSuffix(o.Path, "/"),
 		Name:       path.Base(o.Path),
 		Generation: 1,
 		Mode:       formatMode(o.Mode),
 	}
 
+	if o.Mode.IsLink() {
+		// Target from Linker is always absolute, prefer the one as user input.
+		ino.Target = getMetadataLinkTarget(o)
+		if ino.Target == "" {
+			ino.Target, _ = o.GetLinkTarget()
+		}
+	}
+	if isMetadataSymlink(o) {
+		ino.Mode = uint32(os.ModeSymlink) | 0777
+	}
+
 	if v, ok := o.GetContentLength(); ok {
 		ino.Size = uint64(v)
 	}
@@ -56,13 +104,28 @@ func newInode(parent uint64, o *types.Object) *Inode {
 		ino.Mtime = v
 		ino.Ctime = v
 	}
+	ino.setObjectFacts(o)
+
+	parseAttrMetadata(ino, o)
 	return ino
 }
 
+// setObjectFacts updates the facts of object kept in inode, facts that object
+// doesn't carry will be cleared.
+func (ino *Inode) setObjectFacts(o *types.Object) {
+	ino.LastModified, _ = o.GetLastModified()
+	ino.Etag, _ = o.GetEtag()
+	ino.ContentMd5, _ = o.GetContentMd5()
+	ino.ContentType, _ = o.GetContentType()
+	ino.StorageClass = getStorageClass(o)
+}
+
 func formatMode(o types.ObjectMode) uint32 {
 	var mode uint32
 	if o.IsDir() {
 		mode = uint32(os.ModeDir) | 0755
+	} else if o.IsLink() {
+		mode = uint32(os.ModeSymlink) | 0777
 	} else {
 		mode = 0644
 	}
@@ -84,6 +84,78 @@ func (z *Inode) DecodeMsg(dc *msgp.Reader) (err error) {
 				err = msgp.WrapError(err, "Ctime")
 				return
 			}
+		case "Uid":
+			z.Uid, err = dc.ReadUint32()
+			if err != nil {
+				err = msgp.WrapError(err, "Uid")
+				return
+			}
+		case "Gid":
+			z.Gid, err = dc.ReadUint32()
+			if err != nil {
+				err = msgp.WrapError(err, "Gid")
+				return
+			}
+		case "HasMode":
+			z.HasMode, err = dc.ReadBool()
+			if err != nil {
+				err = msgp.WrapError(err, "HasMode")
+				return
+			}
+		case "HasOwner":
+			z.HasOwner, err = dc.ReadBool()
+			if err != nil {
+				err = msgp.WrapError(err, "HasOwner")
+				return
+			}
+		case "Target":
+			z.Target, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Target")
+				return
+			}
+		case "Chunked":
+			z.Chunked, err = dc.ReadBool()
+			if err != nil {
+				err = msgp.WrapError(err, "Chunked")
+				return
+			}
+		case "Incomplete":
+			z.Incomplete, err = dc.ReadBool()
+			if err != nil {
+				err = msgp.WrapError(err, "Incomplete")
+				return
+			}
+		case "Etag":
+			z.Etag, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Etag")
+				return
+			}
+		case "ContentMd5":
+			z.ContentMd5, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "ContentMd5")
+				return
+			}
+		case "ContentType":
+			z.ContentType, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "ContentType")
+				return
+			}
+		case "StorageClass":
+			z.StorageClass, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "StorageClass")
+				return
+			}
+		case "LastModified":
+			z.LastModified, err = dc.ReadTime()
+			if err != nil {
+				err = msgp.WrapError(err, "LastModified")
+				return
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -97,9 +169,9 @@ func (z *Inode) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *Inode) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 10
+	// map header, size 22
 	// write "ID"
-	err = en.Append(0x8a, 0xa2, 0x49, 0x44)
+	err = en.Append(0xde, 0x0, 0x16, 0xa2, 0x49, 0x44)
 	if err != nil {
 		return
 	}
@@ -198,15 +270,135 @@ func (z *Inode) EncodeMsg(en *msgp.Writer) (err error) {
 		err = msgp.WrapError(err, "Ctime")
 		return
 	}
+	// write "Uid"
+	err = en.Append(0xa3, 0x55, 0x69, 0x64)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint32(z.Uid)
+	if err != nil {
+		err = msgp.WrapError(err, "Uid")
+		return
+	}
+	// write "Gid"
+	err = en.Append(0xa3, 0x47, 0x69, 0x64)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint32(z.Gid)
+	if err != nil {
+		err = msgp.WrapError(err, "Gid")
+		return
+	}
+	// write "HasMode"
+	err = en.Append(0xa7, 0x48, 0x61, 0x73, 0x4d, 0x6f, 0x64, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteBool(z.HasMode)
+	if err != nil {
+		err = msgp.WrapError(err, "HasMode")
+		return
+	}
+	// write "HasOwner"
+	err = en.Append(0xa8, 0x48, 0x61, 0x73, 0x4f, 0x77, 0x6e, 0x65, 0x72)
+	if err != nil {
+		return
+	}
+	err = en.WriteBool(z.HasOwner)
+	if err != nil {
+		err = msgp.WrapError(err, "HasOwner")
+		return
+	}
+	// write "Target"
+	err = en.Append(0xa6, 0x54, 0x61, 0x72, 0x67, 0x65, 0x74)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Target)
+	if err != nil {
+		err = msgp.WrapError(err, "Target")
+		return
+	}
+	// write "Chunked"
+	err = en.Append(0xa7, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64)
+	if err != nil {
+		return
+	}
+	err = en.WriteBool(z.Chunked)
+	if err != nil {
+		err = msgp.WrapError(err, "Chunked")
+		return
+	}
+	// write "Incomplete"
+	err = en.Append(0xaa, 0x49, 0x6e, 0x63, 0x6f, 0x6d, 0x70, 0x6c, 0x65, 0x74, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteBool(z.Incomplete)
+	if err != nil {
+		err = msgp.WrapError(err, "Incomplete")
+		return
+	}
+	// write "Etag"
+	err = en.Append(0xa4, 0x45, 0x74, 0x61, 0x67)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Etag)
+	if err != nil {
+		err = msgp.WrapError(err, "Etag")
+		return
+	}
+	// write "ContentMd5"
+	err = en.Append(0xaa, 0x43, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x4d, 0x64, 0x35)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.ContentMd5)
+	if err != nil {
+		err = msgp.WrapError(err, "ContentMd5")
+		return
+	}
+	// write "ContentType"
+	err = en.Append(0xab, 0x43, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.ContentType)
+	if err != nil {
+		err = msgp.WrapError(err, "ContentType")
+		return
+	}
+	// write "StorageClass"
+	err = en.Append(0xac, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x43, 0x6c, 0x61, 0x73, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.StorageClass)
+	if err != nil {
+		err = msgp.WrapError(err, "StorageClass")
+		return
+	}
+	// write "LastModified"
+	err = en.Append(0xac, 0x4c, 0x61, 0x73, 0x74, 0x4d, 0x6f, 0x64, 0x69, 0x66, 0x69, 0x65, 0x64)
+	if err != nil {
+		return
+	}
+	err = en.WriteTime(z.LastModified)
+	if err != nil {
+		err = msgp.WrapError(err, "LastModified")
+		return
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z *Inode) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 10
+	// map header, size 22
 	// string "ID"
-	o = append(o, 0x8a, 0xa2, 0x49, 0x44)
+	o = append(o, 0xde, 0x0, 0x16, 0xa2, 0x49, 0x44)
 	o = msgp.AppendUint64(o, z.ID)
 	// string "ParentID"
 	o = append(o, 0xa8, 0x50, 0x61, 0x72, 0x65, 0x6e, 0x74, 0x49, 0x44)
@@ -235,6 +427,42 @@ func (z *Inode) MarshalMsg(b []byte) (o []byte, err error) {
 	// string "Ctime"
 	o = append(o, 0xa5, 0x43, 0x74, 0x69, 0x6d, 0x65)
 	o = msgp.AppendTime(o, z.Ctime)
+	// string "Uid"
+	o = append(o, 0xa3, 0x55, 0x69, 0x64)
+	o = msgp.AppendUint32(o, z.Uid)
+	// string "Gid"
+	o = append(o, 0xa3, 0x47, 0x69, 0x64)
+	o = msgp.AppendUint32(o, z.Gid)
+	// string "HasMode"
+	o = append(o, 0xa7, 0x48, 0x61, 0x73, 0x4d, 0x6f, 0x64, 0x65)
+	o = msgp.AppendBool(o, z.HasMode)
+	// string "HasOwner"
+	o = append(o, 0xa8, 0x48, 0x61, 0x73, 0x4f, 0x77, 0x6e, 0x65, 0x72)
+	o = msgp.AppendBool(o, z.HasOwner)
+	// string "Target"
+	o = append(o, 0xa6, 0x54, 0x61, 0x72, 0x67, 0x65, 0x74)
+	o = msgp.AppendString(o, z.Target)
+	// string "Chunked"
+	o = append(o, 0xa7, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x65, 0x64)
+	o = msgp.AppendBool(o, z.Chunked)
+	// string "Incomplete"
+	o = append(o, 0xaa, 0x49, 0x6e, 0x63, 0x6f, 0x6d, 0x70, 0x6c, 0x65, 0x74, 0x65)
+	o = msgp.AppendBool(o, z.Incomplete)
+	// string "Etag"
+	o = append(o, 0xa4, 0x45, 0x74, 0x61, 0x67)
+	o = msgp.AppendString(o, z.Etag)
+	// string "ContentMd5"
+	o = append(o, 0xaa, 0x43, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x4d, 0x64, 0x35)
+	o = msgp.AppendString(o, z.ContentMd5)
+	// string "ContentType"
+	o = append(o, 0xab, 0x43, 0x6f, 0x6e, 0x74, 0x65, 0x6e, 0x74, 0x54, 0x79, 0x70, 0x65)
+	o = msgp.AppendString(o, z.ContentType)
+	// string "StorageClass"
+	o = append(o, 0xac, 0x53, 0x74, 0x6f, 0x72, 0x61, 0x67, 0x65, 0x43, 0x6c, 0x61, 0x73, 0x73)
+	o = msgp.AppendString(o, z.StorageClass)
+	// string "LastModified"
+	o = append(o, 0xac, 0x4c, 0x61, 0x73, 0x74, 0x4d, 0x6f, 0x64, 0x69, 0x66, 0x69, 0x65, 0x64)
+	o = msgp.AppendTime(o, z.LastModified)
 	return
 }
 
@@ -316,6 +544,78 @@ func (z *Inode) UnmarshalMsg(bts []byte) (o []byte, err error) {
 				err = msgp.WrapError(err, "Ctime")
 				return
 			}
+		case "Uid":
+			z.Uid, bts, err = msgp.ReadUint32Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Uid")
+				return
+			}
+		case "Gid":
+			z.Gid, bts, err = msgp.ReadUint32Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Gid")
+				return
+			}
+		case "HasMode":
+			z.HasMode, bts, err = msgp.ReadBoolBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "HasMode")
+				return
+			}
+		case "HasOwner":
+			z.HasOwner, bts, err = msgp.ReadBoolBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "HasOwner")
+				return
+			}
+		case "Target":
+			z.Target, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Target")
+				return
+			}
+		case "Chunked":
+			z.Chunked, bts, err = msgp.ReadBoolBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Chunked")
+				return
+			}
+		case "Incomplete":
+			z.Incomplete, bts, err = msgp.ReadBoolBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Incomplete")
+				return
+			}
+		case "Etag":
+			z.Etag, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Etag")
+				return
+			}
+		case "ContentMd5":
+			z.ContentMd5, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "ContentMd5")
+				return
+			}
+		case "ContentType":
+			z.ContentType, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "ContentType")
+				return
+			}
+		case "StorageClass":
+			z.StorageClass, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "StorageClass")
+				return
+			}
+		case "LastModified":
+			z.LastModified, bts, err = msgp.ReadTimeBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "LastModified")
+				return
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -330,6 +630,6 @@ func (z *Inode) UnmarshalMsg(bts []byte) (o []byte, err error) {
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *Inode) Msgsize() (s int) {
-	s = 1 + 3 + msgp.Uint64Size + 9 + msgp.Uint64Size + 5 + msgp.StringPrefixSize + len(z.Path) + 5 + msgp.StringPrefixSize + len(z.Name) + 11 + msgp.Uint64Size + 5 + msgp.Uint64Size + 5 + msgp.Uint32Size + 6 + msgp.TimeSize + 6 + msgp.TimeSize + 6 + msgp.TimeSize
+	s = 3 + 3 + msgp.Uint64Size + 9 + msgp.Uint64Size + 5 + msgp.StringPrefixSize + len(z.Path) + 5 + msgp.StringPrefixSize + len(z.Name) + 11 + msgp.Uint64Size + 5 + msgp.Uint64Size + 5 + msgp.Uint32Size + 6 + msgp.TimeSize + 6 + msgp.TimeSize + 6 + msgp.TimeSize + 4 + msgp.Uint32Size + 4 + msgp.Uint32Size + 8 + msgp.BoolSize + 9 + msgp.BoolSize + 7 + msgp.StringPrefixSize + len(z.Target) + 8 + msgp.BoolSize + 11 + msgp.BoolSize + 5 + msgp.StringPrefixSize + len(z.Etag) + 11 + msgp.StringPrefixSize + len(z.ContentMd5) + 12 + msgp.StringPrefixSize + len(z.ContentType) + 13 + msgp.StringPrefixSize + len(z.StorageClass) + 13 + msgp.TimeSize
 	return
 }
@@ -0,0 +1,118 @@
+package vfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/beyondstorage/go-storage/v4/types"
+	"go.uber.org/zap"
+)
+
+// CreateSymlink will create a symlink which points to target.
+//
+// Symlink is stored as a small object whose content is the target, and marked
+// by the symlink mode in user metadata like s3fs does, which requires MetaPath
+// to be kept if storage doesn't carry user metadata. Storage that supports
+// Linker but doesn't carry user metadata will create symlink via Linker instead.
+//
+// Target is always kept as user input, even if it's a relative one.
+func (fs *FS) CreateSymlink(parent uint64, name, target string, attr *CreateAttr) (ino *Inode, err error) {
+	p, err := fs.GetInode(parent)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	// Symlink's permission bits are always 0777.
+	m := (&CreateAttr{Mode: 0777, Uid: attr.Uid, Gid: attr.Gid}).formatMetadata(os.ModeSymlink, now)
+
+	path := p.GetEntryPath(name)
+	o, err := fs.writeSymlink(path, target, m)
+	if err != nil {
+		fs.logger.Error("create symlink",
+			zap.String("path", path),
+			zap.String("target", target),
+			zap.Error(err))
+		return nil, err
+	}
+	o.Path = path
+	o.SetLastModified(now)
+
+	ino = newInode(parent, o)
+	ino.Target = target
+	err = fs.SetInode(ino)
+	if err != nil {
+		return
+	}
+	return
+}
+
+func (fs *FS) writeSymlink(p, target string, m Metadata) (o *types.Object, err error) {
+	_, carried := fs.s.(metadataStorer)
+	l, ok := fs.s.(types.Linker)
+	if carried || !ok {
+		// Marker in user metadata will be lost after unmount if it's not carried
+		// by object, and the symlink will become a regular file then.
+		if !carried && !fs.metaPersistent {
+			return nil, fmt.Errorf("create symlink: %w", ErrNotSupported)
+		}
+
+		_, err = fs.writeObject(p, bytes.NewReader([]byte(target)), int64(len(target)), m)
+		if err != nil {
+			return nil, err
+		}
+		o = fs.newObject(p, types.ModeRead)
+		o.SetContentLength(int64(len(target)))
+		o.SetUserMetadata(m)
+		return o, nil
+	}
+
+	// Linker treats relative target as relative to work dir instead of the link's
+	// dir, and returns an absolute target, so the target as user input is kept in
+	// user metadata.
+	linkTarget := target
+	if !strings.HasPrefix(target, "/") {
+		linkTarget = path.Join(path.Dir(p), target)
+	}
+	o, err = l.CreateLink(p, linkTarget)
+	if err != nil {
+		return nil, err
+	}
+	o.Mode |= types.ModeLink
+
+	m[metadataLinkTarget] = target
+	err = fs.cacheMetadata(p, m)
+	if err != nil {
+		return nil, err
+	}
+	o.SetUserMetadata(m)
+	return o, nil
+}
+
+// Readlink returns the target of the symlink.
+func (fs *FS) Readlink(ino *Inode) (target string, err error) {
+	if !ino.IsSymlink() {
+		return "", ErrNotSymlink
+	}
+	if ino.Target != "" {
+		return ino.Target, nil
+	}
+
+	// Symlink marked via user metadata, read target from content.
+	var buf bytes.Buffer
+	_, err = fs.s.Read(ino.Path, &buf)
+	if err != nil {
+		return "", err
+	}
+
+	ino.Target = buf.String()
+	err = fs.SetInode(ino)
+	if err != nil {
+		return
+	}
+	return ino.Target, nil
+}
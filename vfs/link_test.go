@@ -0,0 +1,136 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSymlinkMarker(t *testing.T) {
+	// Memory storage doesn't support Linker, symlink will be marked via user metadata.
+	fs, root := newTestFS(t, "memory://", t.TempDir())
+	defer fs.Close()
+
+	_, err := fs.CreateSymlink(root, "l", "a/b", &CreateAttr{Uid: 1001, Gid: 1002})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stat from storage again, the marker should be recognised.
+	ino, err := fs.Stat(root, "l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ino.IsSymlink() {
+		t.Fatalf("expect symlink, got mode %o", ino.Mode)
+	}
+	if !ino.HasOwner || ino.Uid != 1001 || ino.Gid != 1002 {
+		t.Errorf("expect owner 1001:1002, got %d:%d", ino.Uid, ino.Gid)
+	}
+	target, err := fs.Readlink(ino)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "a/b" {
+		t.Errorf("expect target a/b, got %s", target)
+	}
+}
+
+func TestSymlinkNotPersisted(t *testing.T) {
+	fs, root := newTestFS(t, "memory://", "")
+	defer fs.Close()
+
+	_, err := fs.CreateSymlink(root, "l", "a/b", &CreateAttr{})
+	if !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expect ErrNotSupported, got %v", err)
+	}
+}
+
+func TestSymlinkRelativeTarget(t *testing.T) {
+	// fs storage supports Linker, which returns absolute targets.
+	dir, metaDir := t.TempDir(), t.TempDir()
+
+	fs, root := newTestFS(t, "fs://"+dir, metaDir)
+	_, err := fs.CreateSymlink(root, "l", "a/b", &CreateAttr{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Symlink on the host should still point to the same file.
+	target, err := os.Readlink(filepath.Join(dir, "l"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != filepath.Join(dir, "a/b") {
+		t.Errorf("expect host target %s, got %s", filepath.Join(dir, "a/b"), target)
+	}
+	err = fs.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, root = newTestFS(t, "fs://"+dir, metaDir)
+	defer fs.Close()
+
+	ino, err := fs.Stat(root, "l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ino.IsSymlink() {
+		t.Fatalf("expect symlink, got mode %o", ino.Mode)
+	}
+	target, err = fs.Readlink(ino)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "a/b" {
+		t.Errorf("expect target a/b, got %s", target)
+	}
+}
+
+func TestSymlinkCarried(t *testing.T) {
+	storagePath := metaMemoryType + "://" + t.Name()
+
+	// Symlink is stored as s3fs does, meta service is not required.
+	fs, root := newTestFS(t, storagePath, "")
+	_, err := fs.CreateSymlink(root, "l", "../a/b", &CreateAttr{Uid: 1001, Gid: 1002})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st := fs.s.(*metaMemoryStorage)
+	var buf bytes.Buffer
+	_, err = st.Read("l", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "../a/b" {
+		t.Errorf("expect target as content, got %s", buf.String())
+	}
+	if mode := st.getMetadata("l")[metadataMode]; mode != "41471" {
+		t.Errorf("expect mode S_IFLNK|0777, got %s", mode)
+	}
+
+	fs, root = newTestFS(t, storagePath, "")
+	defer fs.Close()
+
+	ino, err := fs.Stat(root, "l")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ino.IsSymlink() || ino.Uid != 1001 || ino.Gid != 1002 {
+		t.Fatalf("expect symlink owned by 1001:1002, got %+v", ino)
+	}
+	target, err := fs.Readlink(ino)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "../a/b" {
+		t.Errorf("expect target ../a/b, got %s", target)
+	}
+}
@@ -0,0 +1,205 @@
+package vfs
+
+import (
+	"math"
+	"sync"
+)
+
+type LockType uint8
+
+const (
+	LockUnlock LockType = iota
+	LockRead
+	LockWrite
+)
+
+// LockEOF is the End of a lock which lasts until the end of file.
+const LockEOF = math.MaxUint64
+
+// Lock is an advisory byte range lock, both Start and End are inclusive.
+type Lock struct {
+	Start uint64
+	End   uint64
+	Type  LockType
+	Pid   uint32
+	Owner uint64
+	// Flock marks locks acquired via flock(2), they always cover the whole file
+	// and never conflict with fcntl locks.
+	Flock bool
+}
+
+func (lk Lock) overlaps(x Lock) bool {
+	return lk.Start <= x.End && x.Start <= lk.End
+}
+
+func (lk Lock) conflicts(x Lock) bool {
+	if lk.Flock != x.Flock || lk.Owner == x.Owner || !lk.overlaps(x) {
+		return false
+	}
+	return lk.Type == LockWrite || x.Type == LockWrite
+}
+
+// LockManager manages advisory locks (fcntl and flock) of inodes.
+//
+// The local implementation keeps locks in memory, so locks only take effect
+// inside one mount. Locks could be shared between mounts by implementing this
+// interface on a shared meta service.
+type LockManager interface {
+	// Get returns the first lock that conflicts with lk, or a lock with LockUnlock
+	// type if no conflicts.
+	Get(ino uint64, lk Lock) (Lock, error)
+	// Set acquires or releases lk, returns ErrLockConflict if lk conflicts with
+	// locks held by other owners.
+	Set(ino uint64, lk Lock) error
+	// Wait acquires lk, and blocks until conflicting locks released, returns
+	// ErrLockInterrupted if cancel is closed while waiting.
+	Wait(cancel <-chan struct{}, ino uint64, lk Lock) error
+	// Release releases all fcntl locks, or flock locks if flock is true, held by
+	// owner on this inode.
+	Release(ino uint64, owner uint64, flock bool) error
+}
+
+type localLockManager struct {
+	lock  sync.Mutex
+	locks map[uint64][]Lock
+	// changed will be closed and removed while locks of the inode changed, so that
+	// all waiters could check again.
+	changed map[uint64]chan struct{}
+}
+
+// NewLocalLockManager creates a LockManager which keeps locks in memory.
+func NewLocalLockManager() LockManager {
+	return &localLockManager{
+		locks:   make(map[uint64][]Lock),
+		changed: make(map[uint64]chan struct{}),
+	}
+}
+
+func (m *localLockManager) Get(ino uint64, lk Lock) (Lock, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if x, ok := m.conflict(ino, lk); ok {
+		return x, nil
+	}
+	return Lock{Type: LockUnlock}, nil
+}
+
+func (m *localLockManager) Set(ino uint64, lk Lock) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.conflict(ino, lk); ok {
+		return ErrLockConflict
+	}
+	m.apply(ino, lk)
+	return nil
+}
+
+func (m *localLockManager) Wait(cancel <-chan struct{}, ino uint64, lk Lock) error {
+	for {
+		m.lock.Lock()
+		if _, ok := m.conflict(ino, lk); !ok {
+			m.apply(ino, lk)
+			m.lock.Unlock()
+			return nil
+		}
+
+		ch, ok := m.changed[ino]
+		if !ok {
+			ch = make(chan struct{})
+			m.changed[ino] = ch
+		}
+		m.lock.Unlock()
+
+		select {
+		case <-ch:
+		case <-cancel:
+			return ErrLockInterrupted
+		}
+	}
+}
+
+func (m *localLockManager) Release(ino uint64, owner uint64, flock bool) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.apply(ino, Lock{
+		Start: 0,
+		End:   LockEOF,
+		Type:  LockUnlock,
+		Owner: owner,
+		Flock: flock,
+	})
+	return nil
+}
+
+func (m *localLockManager) conflict(ino uint64, lk Lock) (Lock, bool) {
+	if lk.Type == LockUnlock {
+		return Lock{}, false
+	}
+	for _, x := range m.locks[ino] {
+		if x.conflicts(lk) {
+			return x, true
+		}
+	}
+	return Lock{}, false
+}
+
+// apply will replace the range of lk held by the same owner with lk, flock
+// locks are replaced as a whole.
+//
+// Caller must hold the lock.
+func (m *localLockManager) apply(ino uint64, lk Lock) {
+	locks := make([]Lock, 0, len(m.locks[ino])+2)
+	for _, x := range m.locks[ino] {
+		if x.Owner != lk.Owner || x.Flock != lk.Flock || !x.overlaps(lk) {
+			locks = append(locks, x)
+			continue
+		}
+		if x.Flock {
+			continue
+		}
+		// Keep the parts of x outside lk.
+		if x.Start < lk.Start {
+			head := x
+			head.End = lk.Start - 1
+			locks = append(locks, head)
+		}
+		if x.End > lk.End {
+			tail := x
+			tail.Start = lk.End + 1
+			locks = append(locks, tail)
+		}
+	}
+	if lk.Type != LockUnlock {
+		locks = append(locks, lk)
+	}
+
+	if len(locks) == 0 {
+		delete(m.locks, ino)
+	} else {
+		m.locks[ino] = locks
+	}
+
+	if ch, ok := m.changed[ino]; ok {
+		close(ch)
+		delete(m.changed, ino)
+	}
+}
+
+func (fs *FS) GetLock(ino uint64, lk Lock) (Lock, error) {
+	return fs.locks.Get(ino, lk)
+}
+
+func (fs *FS) SetLock(ino uint64, lk Lock) error {
+	return fs.locks.Set(ino, lk)
+}
+
+func (fs *FS) SetLockWait(cancel <-chan struct{}, ino uint64, lk Lock) error {
+	return fs.locks.Wait(cancel, ino, lk)
+}
+
+func (fs *FS) ReleaseLocks(ino uint64, owner uint64, flock bool) error {
+	return fs.locks.Release(ino, owner, flock)
+}
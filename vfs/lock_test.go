@@ -0,0 +1,162 @@
+package vfs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocalLockManagerConflict(t *testing.T) {
+	m := NewLocalLockManager()
+
+	err := m.Set(1, Lock{Start: 0, End: 99, Type: LockRead, Owner: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read locks from different owners could be shared.
+	err = m.Set(1, Lock{Start: 50, End: 149, Type: LockRead, Owner: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Set(1, Lock{Start: 120, End: 130, Type: LockWrite, Owner: 1})
+	if err != ErrLockConflict {
+		t.Errorf("expect conflict, got %v", err)
+	}
+	// Locks on other inodes should not conflict.
+	err = m.Set(2, Lock{Start: 120, End: 130, Type: LockWrite, Owner: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lk, err := m.Get(1, Lock{Start: 140, End: LockEOF, Type: LockWrite, Owner: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lk.Type != LockRead || lk.Owner != 2 {
+		t.Errorf("expect conflict with owner 2, got %+v", lk)
+	}
+}
+
+func TestLocalLockManagerSplit(t *testing.T) {
+	m := NewLocalLockManager()
+
+	err := m.Set(1, Lock{Start: 0, End: 99, Type: LockWrite, Owner: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unlock the middle range, head and tail should still be locked.
+	err = m.Set(1, Lock{Start: 40, End: 59, Type: LockUnlock, Owner: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		start, end uint64
+		conflict   bool
+	}{
+		{0, 39, true},
+		{40, 59, false},
+		{60, 99, true},
+		{100, LockEOF, false},
+	}
+	for _, tt := range cases {
+		lk, err := m.Get(1, Lock{Start: tt.start, End: tt.end, Type: LockRead, Owner: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (lk.Type != LockUnlock) != tt.conflict {
+			t.Errorf("range [%d, %d]: expect conflict %v, got %+v", tt.start, tt.end, tt.conflict, lk)
+		}
+	}
+}
+
+func TestLocalLockManagerWait(t *testing.T) {
+	m := NewLocalLockManager()
+
+	err := m.Set(1, Lock{Start: 0, End: LockEOF, Type: LockWrite, Owner: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel := make(chan struct{})
+	close(cancel)
+	err = m.Wait(cancel, 1, Lock{Start: 0, End: LockEOF, Type: LockWrite, Owner: 2})
+	if err != ErrLockInterrupted {
+		t.Errorf("expect interrupted, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- m.Wait(make(chan struct{}), 1, Lock{Start: 0, End: LockEOF, Type: LockWrite, Owner: 2})
+	}()
+
+	err = m.Release(1, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wait is not woken up after release")
+	}
+}
+
+func TestLocalLockManagerFlock(t *testing.T) {
+	m := NewLocalLockManager()
+
+	whole := Lock{Start: 0, End: LockEOF, Type: LockWrite}
+	flock := whole
+	flock.Owner, flock.Flock = 1, true
+	err := m.Set(1, flock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flock and fcntl locks are independent.
+	fcntl := whole
+	fcntl.Owner = 2
+	err = m.Set(1, fcntl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := flock
+	other.Owner = 2
+	err = m.Set(1, other)
+	if err != ErrLockConflict {
+		t.Errorf("expect conflict with flock, got %v", err)
+	}
+
+	// Unlocking a range of fcntl locks or releasing them keeps flock.
+	err = m.Set(1, Lock{Start: 0, End: 9, Type: LockUnlock, Owner: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Release(1, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lk, err := m.Get(1, other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !lk.Flock || lk.Owner != 1 || lk.Start != 0 || lk.End != LockEOF {
+		t.Errorf("expect whole flock of owner 1, got %+v", lk)
+	}
+
+	err = m.Release(1, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Set(1, other)
+	if err != nil {
+		t.Errorf("expect flock released, got %v", err)
+	}
+	lk, err = m.Get(1, Lock{Start: 0, End: LockEOF, Type: LockWrite, Owner: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lk.Flock || lk.Owner != 2 {
+		t.Errorf("expect fcntl lock of owner 2 kept, got %+v", lk)
+	}
+}
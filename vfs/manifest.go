@@ -0,0 +1,328 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/beyondstorage/go-storage/v4/pairs"
+	"github.com/beyondstorage/go-storage/v4/services"
+	"go.uber.org/zap"
+
+	"github.com/beyondstorage/beyond-fs/meta"
+)
+
+//go:generate go run github.com/tinylib/msgp
+
+const (
+	// internalDir is the dir used by BeyondFS itself, it's hidden from listing.
+	internalDir = ".beyondfs"
+	// chunkDir is the dir of chunk objects in chunked layout.
+	chunkDir = internalDir + "/chunks/"
+
+	// manifestContentType is set on manifest objects if storage keeps content type.
+	manifestContentType = "application/vnd.beyondfs.manifest"
+	// maxManifestSize is the max size of objects that could be a manifest, only
+	// objects smaller than it will be probed for manifestMagic.
+	maxManifestSize = 4 * 1024 * 1024
+)
+
+// manifestMagic is the header of manifest objects, so that manifest could be
+// recognised even if storage doesn't keep content type.
+var manifestMagic = []byte("BEYONDFS-MANIFEST\x00")
+
+// Manifest describes a file stored in chunked layout.
+//
+// File is split into fixed-size chunk objects, chunks that are not changed will
+// be shared between versions of the file.
+type Manifest struct {
+	Size      uint64
+	ChunkSize uint64
+	// Chunks are the paths of chunk objects in order, empty path means a hole
+	// that should be read as zero.
+	Chunks []string
+	// Version increases every time the manifest committed, so that commits
+	// based on a stale manifest could be detected.
+	Version uint64
+}
+
+// ChunkCount returns the count of chunks needed for the size of file.
+func (mf *Manifest) ChunkCount() uint64 {
+	return (mf.Size + mf.ChunkSize - 1) / mf.ChunkSize
+}
+
+// Resize will update the size of file, chunks beyond the size will be dropped
+// and returned.
+func (mf *Manifest) Resize(size uint64) (dropped []string) {
+	mf.Size = size
+	n := mf.ChunkCount()
+	for uint64(len(mf.Chunks)) < n {
+		mf.Chunks = append(mf.Chunks, "")
+	}
+	if uint64(len(mf.Chunks)) > n {
+		for _, v := range mf.Chunks[n:] {
+			if v != "" {
+				dropped = append(dropped, v)
+			}
+		}
+		mf.Chunks = mf.Chunks[:n]
+	}
+	return dropped
+}
+
+func newChunkPath() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("generate chunk id: %w", err)
+	}
+	return chunkDir + hex.EncodeToString(b), nil
+}
+
+// GetManifest returns the manifest of chunked file.
+//
+// Manifest is cached in meta service, and loaded from manifest object for the first time.
+func (fs *FS) GetManifest(ino *Inode) (mf *Manifest, err error) {
+	bs, err := fs.meta.Get(meta.ManifestKey(ino.ID))
+	if err != nil {
+		return nil, fmt.Errorf("get manifest: %w", err)
+	}
+	if bs != nil {
+		mf = &Manifest{}
+		_, err = mf.UnmarshalMsg(bs)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal manifest: %w", err)
+		}
+		return mf, nil
+	}
+
+	mf, err = fs.readManifest(ino.Path)
+	if err != nil {
+		return
+	}
+	if mf == nil {
+		return nil, fmt.Errorf("get manifest %s: %w", ino.Path, services.ErrObjectNotExist)
+	}
+	err = fs.setManifestMeta(ino, mf)
+	if err != nil {
+		return
+	}
+	return mf, nil
+}
+
+// SetManifest will persist the manifest into meta service and manifest object.
+func (fs *FS) SetManifest(ino *Inode, mf *Manifest) (err error) {
+	bs, err := mf.MarshalMsg(append([]byte{}, manifestMagic...))
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+
+	m, err := fs.formatWriteMetadata(ino)
+	if err != nil {
+		return
+	}
+	_, err = fs.writeObject(ino.Path, bytes.NewReader(bs), int64(len(bs)), m,
+		pairs.WithContentType(manifestContentType))
+	if err != nil {
+		return
+	}
+	fs.refreshObject(ino)
+	return fs.setManifestMeta(ino, mf)
+}
+
+func (fs *FS) setManifestMeta(ino *Inode, mf *Manifest) (err error) {
+	bs, err := mf.MarshalMsg(nil)
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+
+	err = fs.meta.Set(meta.ManifestKey(ino.ID), bs)
+	if err != nil {
+		return fmt.Errorf("set manifest: %w", err)
+	}
+	return nil
+}
+
+// readManifest reads manifest from object, nil will be returned if this object
+// is not a manifest.
+func (fs *FS) readManifest(path string) (mf *Manifest, err error) {
+	var buf bytes.Buffer
+	_, err = fs.s.Read(path, &buf, pairs.WithSize(maxManifestSize))
+	if err != nil {
+		return
+	}
+	if !bytes.HasPrefix(buf.Bytes(), manifestMagic) {
+		return nil, nil
+	}
+	return parseManifest(buf.Bytes())
+}
+
+// probeManifest reads manifest from object if it starts with manifestMagic,
+// only the header will be read for other objects.
+func (fs *FS) probeManifest(path string) (mf *Manifest, err error) {
+	var buf bytes.Buffer
+	_, err = fs.s.Read(path, &buf, pairs.WithSize(int64(len(manifestMagic))))
+	if err != nil {
+		return
+	}
+	// Storage could ignore the size and return the whole object.
+	if !bytes.HasPrefix(buf.Bytes(), manifestMagic) {
+		return nil, nil
+	}
+	if buf.Len() > len(manifestMagic) {
+		return parseManifest(buf.Bytes())
+	}
+	return fs.readManifest(path)
+}
+
+// parseManifest parses manifest from the content of manifest object.
+func parseManifest(bs []byte) (mf *Manifest, err error) {
+
+	mf = &Manifest{}
+	_, err = mf.UnmarshalMsg(bs[len(manifestMagic):])
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal manifest: %w", err)
+	}
+	return mf, nil
+}
+
+// resolveManifest checks whether the inode is a chunked file, and updates
+// the inode with the manifest.
+//
+// Objects could only be recognised via content type or probing the header,
+// so probing will only happen while chunked layout is enabled. Storage like fs
+// doesn't keep content type, files written in chunked layout will be seen as
+// manifest objects on it after chunked layout disabled.
+func (fs *FS) resolveManifest(ino *Inode) (err error) {
+	if ino.IsDir() || ino.IsSymlink() {
+		return nil
+	}
+
+	var mf *Manifest
+	if ino.ContentType == manifestContentType {
+		mf, err = fs.readManifest(ino.Path)
+	} else {
+		if fs.chunkSize == 0 || ino.Size < uint64(len(manifestMagic)) || ino.Size > maxManifestSize {
+			return nil
+		}
+		mf, err = fs.probeManifest(ino.Path)
+	}
+	if err != nil || mf == nil {
+		return
+	}
+	ino.Chunked = true
+	ino.Size = mf.Size
+	return fs.setManifestMeta(ino, mf)
+}
+
+// mayBeManifest checks whether resolveManifest needs to read the object of this
+// inode. Content type is unknown for objects listed from storage like s3, they
+// could be manifest objects as well.
+func (fs *FS) mayBeManifest(ino *Inode) bool {
+	if ino.IsDir() || ino.IsSymlink() || ino.Size < uint64(len(manifestMagic)) || ino.Size > maxManifestSize {
+		return false
+	}
+	if fs.chunkSize > 0 || ino.ContentType == manifestContentType {
+		return true
+	}
+	_, ok := fs.s.(metadataStorer)
+	return ok && ino.ContentType == ""
+}
+
+// getChunks returns all chunks of this file, chunks should be collected before
+// the manifest object removed or replaced.
+func (fs *FS) getChunks(ino *Inode) []string {
+	if !ino.Chunked {
+		return nil
+	}
+
+	mf, err := fs.GetManifest(ino)
+	if err != nil {
+		// Chunks will be leaked, but the file itself is still consistent.
+		fs.logger.Error("get manifest", zap.String("path", ino.Path), zap.Error(err))
+		return nil
+	}
+	return mf.Chunks
+}
+
+// deleteChunkObjects will delete chunks, errors will only be logged because
+// chunks are not reachable anymore.
+func (fs *FS) deleteChunkObjects(chunks []string) {
+	for _, v := range chunks {
+		if v == "" {
+			continue
+		}
+		err := fs.s.Delete(v)
+		if err != nil && !errors.Is(err, services.ErrObjectNotExist) {
+			fs.logger.Error("delete chunk", zap.String("path", v), zap.Error(err))
+		}
+	}
+}
+
+// truncateManifest will resize the chunked file.
+//
+// The last chunk will be rewritten if it's cut, so that extending the file later
+// will read zero instead of the old data.
+func (fs *FS) truncateManifest(ino *Inode, size uint64) (err error) {
+	mu := fs.manifestLock(ino.Path)
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Manifest cached could be stale if committed via other inodes.
+	mf, err := fs.readManifest(ino.Path)
+	if err != nil {
+		return
+	}
+	if mf == nil {
+		return fmt.Errorf("get manifest %s: %w", ino.Path, services.ErrObjectNotExist)
+	}
+
+	var replaced []string
+	if size < mf.Size && size%mf.ChunkSize != 0 {
+		idx := size / mf.ChunkSize
+		if p := mf.Chunks[idx]; p != "" {
+			n := size % mf.ChunkSize
+
+			var buf bytes.Buffer
+			_, err = fs.s.Read(p, &buf, pairs.WithSize(int64(n)))
+			if err != nil {
+				return
+			}
+			// Storage could ignore the size, and chunk could be shorter than n.
+			data := make([]byte, n)
+			copy(data, buf.Bytes())
+
+			np, err := fs.writeChunk(data)
+			if err != nil {
+				return err
+			}
+			mf.Chunks[idx] = np
+			replaced = append(replaced, p)
+		}
+	}
+	replaced = append(replaced, mf.Resize(size)...)
+	mf.Version += 1
+
+	err = fs.SetManifest(ino, mf)
+	if err != nil {
+		return
+	}
+	fs.retireChunks(replaced)
+	return nil
+}
+
+// writeChunk writes data as a new chunk object, chunk objects are never
+// overwritten so they could be shared.
+func (fs *FS) writeChunk(data []byte) (path string, err error) {
+	path, err = newChunkPath()
+	if err != nil {
+		return
+	}
+	_, err = fs.s.Write(path, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
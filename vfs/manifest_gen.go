@@ -0,0 +1,225 @@
+package vfs
+
+// Code generated by github.com/tinylib/msgp DO NOT EDIT.
+
+import (
+	"github.com/tinylib/msgp/msgp"
+)
+
+// DecodeMsg implements msgp.Decodable
+func (z *Manifest) DecodeMsg(dc *msgp.Reader) (err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, err = dc.ReadMapHeader()
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, err = dc.ReadMapKeyPtr()
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "Size":
+			z.Size, err = dc.ReadUint64()
+			if err != nil {
+				err = msgp.WrapError(err, "Size")
+				return
+			}
+		case "ChunkSize":
+			z.ChunkSize, err = dc.ReadUint64()
+			if err != nil {
+				err = msgp.WrapError(err, "ChunkSize")
+				return
+			}
+		case "Chunks":
+			var zb0002 uint32
+			zb0002, err = dc.ReadArrayHeader()
+			if err != nil {
+				err = msgp.WrapError(err, "Chunks")
+				return
+			}
+			if cap(z.Chunks) >= int(zb0002) {
+				z.Chunks = (z.Chunks)[:zb0002]
+			} else {
+				z.Chunks = make([]string, zb0002)
+			}
+			for za0001 := range z.Chunks {
+				z.Chunks[za0001], err = dc.ReadString()
+				if err != nil {
+					err = msgp.WrapError(err, "Chunks", za0001)
+					return
+				}
+			}
+		case "Version":
+			z.Version, err = dc.ReadUint64()
+			if err != nil {
+				err = msgp.WrapError(err, "Version")
+				return
+			}
+		default:
+			err = dc.Skip()
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z *Manifest) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 4
+	// write "Size"
+	err = en.Append(0x84, 0xa4, 0x53, 0x69, 0x7a, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint64(z.Size)
+	if err != nil {
+		err = msgp.WrapError(err, "Size")
+		return
+	}
+	// write "ChunkSize"
+	err = en.Append(0xa9, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x53, 0x69, 0x7a, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint64(z.ChunkSize)
+	if err != nil {
+		err = msgp.WrapError(err, "ChunkSize")
+		return
+	}
+	// write "Chunks"
+	err = en.Append(0xa6, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteArrayHeader(uint32(len(z.Chunks)))
+	if err != nil {
+		err = msgp.WrapError(err, "Chunks")
+		return
+	}
+	for za0001 := range z.Chunks {
+		err = en.WriteString(z.Chunks[za0001])
+		if err != nil {
+			err = msgp.WrapError(err, "Chunks", za0001)
+			return
+		}
+	}
+	// write "Version"
+	err = en.Append(0xa7, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint64(z.Version)
+	if err != nil {
+		err = msgp.WrapError(err, "Version")
+		return
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z *Manifest) MarshalMsg(b []byte) (o []byte, err error) {
+	o = msgp.Require(b, z.Msgsize())
+	// map header, size 4
+	// string "Size"
+	o = append(o, 0x84, 0xa4, 0x53, 0x69, 0x7a, 0x65)
+	o = msgp.AppendUint64(o, z.Size)
+	// string "ChunkSize"
+	o = append(o, 0xa9, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x53, 0x69, 0x7a, 0x65)
+	o = msgp.AppendUint64(o, z.ChunkSize)
+	// string "Chunks"
+	o = append(o, 0xa6, 0x43, 0x68, 0x75, 0x6e, 0x6b, 0x73)
+	o = msgp.AppendArrayHeader(o, uint32(len(z.Chunks)))
+	for za0001 := range z.Chunks {
+		o = msgp.AppendString(o, z.Chunks[za0001])
+	}
+	// string "Version"
+	o = append(o, 0xa7, 0x56, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e)
+	o = msgp.AppendUint64(o, z.Version)
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *Manifest) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, bts, err = msgp.ReadMapHeaderBytes(bts)
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, bts, err = msgp.ReadMapKeyZC(bts)
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "Size":
+			z.Size, bts, err = msgp.ReadUint64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Size")
+				return
+			}
+		case "ChunkSize":
+			z.ChunkSize, bts, err = msgp.ReadUint64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "ChunkSize")
+				return
+			}
+		case "Chunks":
+			var zb0002 uint32
+			zb0002, bts, err = msgp.ReadArrayHeaderBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Chunks")
+				return
+			}
+			if cap(z.Chunks) >= int(zb0002) {
+				z.Chunks = (z.Chunks)[:zb0002]
+			} else {
+				z.Chunks = make([]string, zb0002)
+			}
+			for za0001 := range z.Chunks {
+				z.Chunks[za0001], bts, err = msgp.ReadStringBytes(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "Chunks", za0001)
+					return
+				}
+			}
+		case "Version":
+			z.Version, bts, err = msgp.ReadUint64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Version")
+				return
+			}
+		default:
+			bts, err = msgp.Skip(bts)
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	o = bts
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z *Manifest) Msgsize() (s int) {
+	s = 1 + 5 + msgp.Uint64Size + 10 + msgp.Uint64Size + 7 + msgp.ArrayHeaderSize
+	for za0001 := range z.Chunks {
+		s += msgp.StringPrefixSize + len(z.Chunks[za0001])
+	}
+	s += 8 + msgp.Uint64Size
+	return
+}
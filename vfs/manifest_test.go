@@ -0,0 +1,142 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/beyondstorage/go-storage/v4/types"
+	"go.uber.org/zap"
+)
+
+// sizeRecorder records the size of every read.
+type sizeRecorder struct {
+	types.Storager
+	sizes []int64
+}
+
+func (s *sizeRecorder) Read(path string, w io.Writer, pairs ...types.Pair) (n int64, err error) {
+	size := int64(-1)
+	for _, v := range pairs {
+		if v.Key == "size" {
+			size = v.Value.(int64)
+		}
+	}
+	s.sizes = append(s.sizes, size)
+	return s.Storager.Read(path, w, pairs...)
+}
+
+func TestResolveManifest(t *testing.T) {
+	fs, err := NewFS(&Config{
+		StoragePath: "fs://" + t.TempDir(),
+		ChunkSize:   4,
+		Logger:      zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	s := &sizeRecorder{Storager: fs.s}
+	fs.s = s
+
+	// Regular objects should only be probed for the header.
+	data := bytes.Repeat([]byte{'a'}, 1024)
+	_, err = s.Write("a", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ino := &Inode{Path: "a", Size: uint64(len(data))}
+	err = fs.resolveManifest(ino)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ino.Chunked {
+		t.Error("expect regular file")
+	}
+	if len(s.sizes) != 1 || s.sizes[0] != int64(len(manifestMagic)) {
+		t.Errorf("expect one read of the header, got %v", s.sizes)
+	}
+
+	mf := &Manifest{Size: 6, ChunkSize: 4, Chunks: []string{"", ""}}
+	ino = &Inode{Path: "b"}
+	err = fs.SetManifest(ino, mf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := s.Stat("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ino.Size = uint64(o.MustGetContentLength())
+	err = fs.resolveManifest(ino)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ino.Chunked || ino.Size != 6 {
+		t.Errorf("expect chunked file in size 6, got %+v", ino)
+	}
+}
+
+func TestListManifestLazily(t *testing.T) {
+	fs, err := NewFS(&Config{
+		StoragePath: "fs://" + t.TempDir(),
+		ChunkSize:   4,
+		Logger:      zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	root := nextInode.Load()
+	s := &sizeRecorder{Storager: fs.s}
+	fs.s = s
+
+	data := bytes.Repeat([]byte{'a'}, 1024)
+	_, err = s.Write("a", bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.SetManifest(&Inode{Path: "b"}, &Manifest{Size: 6, ChunkSize: 4, Chunks: []string{"", ""}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := fs.GetInode(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dh, err := fs.CreateDirHandle(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		ino, err := dh.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ino == nil {
+			break
+		}
+		if !ino.Incomplete {
+			t.Errorf("expect %s to be resolved while looked up", ino.Name)
+		}
+	}
+	if len(s.sizes) != 0 {
+		t.Errorf("expect no read while listing, got %v", s.sizes)
+	}
+
+	ino, err := fs.GetEntry(root, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ino.Chunked || ino.Size != 6 {
+		t.Errorf("expect chunked file in size 6, got %+v", ino)
+	}
+	ino, err = fs.GetEntry(root, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ino.Chunked || ino.Size != uint64(len(data)) {
+		t.Errorf("expect regular file in size %d, got %+v", len(data), ino)
+	}
+}
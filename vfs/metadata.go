@@ -0,0 +1,340 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	s3 "github.com/beyondstorage/go-service-s3/v2"
+	"github.com/beyondstorage/go-storage/v4/services"
+	"github.com/beyondstorage/go-storage/v4/types"
+
+	"github.com/beyondstorage/beyond-fs/meta"
+)
+
+//go:generate go run github.com/tinylib/msgp
+
+// Metadata is the user metadata of an object, including the attributes used by
+// BeyondFS and xattrs.
+//
+// Metadata is written along with objects if storage carries user metadata like
+// s3, and cached in meta service keyed by object path. Otherwise, only the
+// attributes are kept in meta service, which will be kept across mounts only if
+// MetaPath is set, and will not be seen by other tools.
+type Metadata map[string]string
+
+// metadataStorer is implemented by storage whose objects carry user metadata,
+// Stat of it always returns the user metadata.
+//
+// Writing data will replace the user metadata, so objects must always be written
+// along with their metadata on such storage.
+type metadataStorer interface {
+	// writeWithMetadata writes the object carrying m, only content type is
+	// supported in pairs.
+	writeWithMetadata(path string, r io.Reader, size int64, m Metadata, ps ...types.Pair) (n int64, err error)
+	// createMultipartWithMetadata creates a multipart whose object will carry m.
+	createMultipartWithMetadata(path string, m Metadata) (o *types.Object, err error)
+	// createDirWithMetadata creates the dir object carrying m.
+	createDirWithMetadata(path string, m Metadata) (err error)
+	// replaceMetadata replaces the user metadata of an existing object.
+	replaceMetadata(path string, dir bool, m Metadata) (err error)
+}
+
+// User metadata keys follow the convention of s3fs, so that objects written by
+// s3fs and BeyondFS could be read by each other.
+const (
+	// metadataMode is the POSIX mode in decimal, including the file type bits.
+	metadataMode = "mode"
+	// metadataUid is the owner's uid in decimal.
+	metadataUid = "uid"
+	// metadataGid is the owner's gid in decimal.
+	metadataGid = "gid"
+	// metadataMtime is the modification time in unix seconds.
+	metadataMtime = "mtime"
+)
+
+// metadataLinkTarget is the target of symlink created via Linker as user input,
+// which is only kept in meta service.
+const metadataLinkTarget = "link-target"
+
+// isReservedMetadata checks whether this user metadata is used by BeyondFS itself,
+// reserved metadata will not be exposed as xattr.
+func isReservedMetadata(k string) bool {
+	switch k {
+	case metadataMode, metadataUid, metadataGid, metadataMtime, metadataLinkTarget:
+		return true
+	default:
+		return false
+	}
+}
+
+// getMetadataUint32 returns the decimal value stored in object's user metadata.
+func getMetadataUint32(o *types.Object, k string) (x uint32, ok bool) {
+	m, ok := o.GetUserMetadata()
+	if !ok {
+		return 0, false
+	}
+	v, ok := m[k]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(n), true
+}
+
+// getMetadataMode returns the POSIX mode stored in object's user metadata.
+func getMetadataMode(o *types.Object) (mode uint32, ok bool) {
+	return getMetadataUint32(o, metadataMode)
+}
+
+// isMetadataSymlink checks whether this object is a symlink marked via user metadata.
+func isMetadataSymlink(o *types.Object) bool {
+	mode, ok := getMetadataMode(o)
+	return ok && mode&syscall.S_IFMT == syscall.S_IFLNK
+}
+
+// getMetadataLinkTarget returns the target of symlink kept in user metadata.
+func getMetadataLinkTarget(o *types.Object) string {
+	m, ok := o.GetUserMetadata()
+	if !ok {
+		return ""
+	}
+	return m[metadataLinkTarget]
+}
+
+// getStorageClass returns the storage class in object's system metadata.
+//
+// Only services that have storage class will be handled here.
+func getStorageClass(o *types.Object) string {
+	sm, ok := o.GetSystemMetadata()
+	if !ok {
+		return ""
+	}
+	switch v := sm.(type) {
+	case s3.ObjectSystemMetadata:
+		return v.StorageClass
+	default:
+		return ""
+	}
+}
+
+// formatAttrMetadata will set the attributes of inode into user metadata.
+func formatAttrMetadata(ino *Inode, m map[string]string) {
+	if ino.HasMode {
+		m[metadataMode] = strconv.FormatUint(uint64(formatPosixMode(ino.Mode)), 10)
+	}
+	if ino.HasOwner {
+		m[metadataUid] = strconv.FormatUint(uint64(ino.Uid), 10)
+		m[metadataGid] = strconv.FormatUint(uint64(ino.Gid), 10)
+	}
+	if !ino.Mtime.IsZero() {
+		m[metadataMtime] = strconv.FormatInt(ino.Mtime.Unix(), 10)
+	}
+}
+
+// parseAttrMetadata will load the attributes stored in user metadata into inode.
+func parseAttrMetadata(ino *Inode, o *types.Object) {
+	if mode, ok := getMetadataMode(o); ok {
+		ino.Mode = ino.Mode&^permBits | parsePosixMode(mode)
+		ino.HasMode = true
+	}
+
+	uid, hasUid := getMetadataUint32(o, metadataUid)
+	gid, hasGid := getMetadataUint32(o, metadataGid)
+	if hasUid && hasGid {
+		ino.Uid, ino.Gid = uid, gid
+		ino.HasOwner = true
+	}
+
+	if m, ok := o.GetUserMetadata(); ok {
+		if sec, err := strconv.ParseInt(m[metadataMtime], 10, 64); err == nil {
+			ino.Mtime = time.Unix(sec, 0)
+		}
+	}
+}
+
+// formatPosixMode converts the os.FileMode into POSIX mode with file type bits.
+func formatPosixMode(mode uint32) uint32 {
+	m := os.FileMode(mode)
+
+	posix := uint32(m.Perm())
+	if m&os.ModeSticky != 0 {
+		posix |= syscall.S_ISVTX
+	}
+	switch {
+	case m.IsDir():
+		posix |= syscall.S_IFDIR
+	case m&os.ModeSymlink != 0:
+		posix |= syscall.S_IFLNK
+	default:
+		posix |= syscall.S_IFREG
+	}
+	return posix
+}
+
+// parsePosixMode converts the permission bits and the sticky bit of POSIX mode
+// into os.FileMode, file type bits are dropped.
+func parsePosixMode(mode uint32) uint32 {
+	m := mode & uint32(os.ModePerm)
+	if mode&syscall.S_ISVTX != 0 {
+		m |= uint32(os.ModeSticky)
+	}
+	return m
+}
+
+// formatWriteMetadata returns the user metadata of the object to be written.
+//
+// Object will be overwritten, carry the xattrs and attributes of inode along with it.
+func (fs *FS) formatWriteMetadata(ino *Inode) (m Metadata, err error) {
+	m, err = fs.getMetadata(ino.Path)
+	if err != nil {
+		return
+	}
+	if m == nil {
+		m = make(Metadata)
+	}
+	formatAttrMetadata(ino, m)
+	m[metadataMtime] = strconv.FormatInt(time.Now().Unix(), 10)
+	return m, nil
+}
+
+// getMetadata returns the user metadata of object, nil will be returned if
+// object doesn't have any.
+//
+// Metadata cached in meta service will be used, it's loaded from the object
+// for the first time if storage carries user metadata.
+func (fs *FS) getMetadata(path string) (m Metadata, err error) {
+	m, err = fs.getCachedMetadata(path)
+	if err != nil || m != nil {
+		return
+	}
+	if _, ok := fs.s.(metadataStorer); !ok || path == "" {
+		return nil, nil
+	}
+
+	o, err := fs.statObject(path)
+	if err != nil && errors.Is(err, services.ErrObjectNotExist) {
+		// Dir could be a virtual one without object.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = fs.loadMetadata(o)
+	if err != nil {
+		return
+	}
+	um, _ := o.GetUserMetadata()
+	return um, nil
+}
+
+func (fs *FS) getCachedMetadata(path string) (m Metadata, err error) {
+	bs, err := fs.meta.Get(meta.MetadataKey(path))
+	if err != nil {
+		return nil, fmt.Errorf("get metadata: %w", err)
+	}
+	if bs == nil {
+		return nil, nil
+	}
+
+	m = make(Metadata)
+	_, err = m.UnmarshalMsg(bs)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal metadata: %w", err)
+	}
+	return m, nil
+}
+
+// cacheMetadata keeps the user metadata of object in meta service, it's the
+// only place to keep metadata if storage doesn't carry it.
+func (fs *FS) cacheMetadata(path string, m Metadata) (err error) {
+	if m == nil {
+		m = make(Metadata)
+	}
+	bs, err := m.MarshalMsg(nil)
+	if err != nil {
+		return fmt.Errorf("marshal metadata: %w", err)
+	}
+
+	err = fs.meta.Set(meta.MetadataKey(path), bs)
+	if err != nil {
+		return fmt.Errorf("set metadata: %w", err)
+	}
+	return nil
+}
+
+// updateMetadata will replace the user metadata of inode's object with m.
+//
+// Object will be copied in place with m if storage carries user metadata, and
+// dir without object will be created. Root dir doesn't have an object, its
+// metadata is only kept in meta service.
+func (fs *FS) updateMetadata(ino *Inode, m Metadata) (err error) {
+	if ms, ok := fs.s.(metadataStorer); ok && ino.Path != "" {
+		err = ms.replaceMetadata(ino.Path, ino.IsDir(), m)
+		if err != nil && ino.IsDir() && errors.Is(err, services.ErrObjectNotExist) {
+			err = ms.createDirWithMetadata(ino.Path, m)
+		}
+		if err != nil {
+			return
+		}
+	}
+	return fs.cacheMetadata(ino.Path, m)
+}
+
+func (fs *FS) deleteMetadata(path string) (err error) {
+	err = fs.meta.Delete(meta.MetadataKey(path))
+	if err != nil {
+		return fmt.Errorf("del metadata: %w", err)
+	}
+	return nil
+}
+
+// moveMetadata will move the user metadata of object kept in meta service from
+// src to dst, metadata left at dst will be replaced. Metadata carried by object
+// should have been moved along with data.
+func (fs *FS) moveMetadata(src, dst string) (err error) {
+	m, err := fs.getCachedMetadata(src)
+	if err != nil {
+		return
+	}
+	if m == nil {
+		return fs.deleteMetadata(dst)
+	}
+	err = fs.cacheMetadata(dst, m)
+	if err != nil {
+		return
+	}
+	return fs.deleteMetadata(src)
+}
+
+// loadMetadata makes the user metadata of object available to newInode.
+//
+// Metadata carried by object will be cached, and objects without it like listed
+// ones will be filled with the cached metadata. loaded will be false if the
+// storage carries metadata but it's neither in object nor cached, object should
+// be stat later to get its attributes.
+func (fs *FS) loadMetadata(o *types.Object) (loaded bool, err error) {
+	path := strings.TrimSuffix(o.Path, "/")
+	if m, ok := o.GetUserMetadata(); ok {
+		return true, fs.cacheMetadata(path, m)
+	}
+
+	m, err := fs.getCachedMetadata(path)
+	if err != nil {
+		return
+	}
+	if m != nil {
+		o.SetUserMetadata(m)
+		return true, nil
+	}
+	_, ok := fs.s.(metadataStorer)
+	return !ok, nil
+}
@@ -0,0 +1,337 @@
+package vfs
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	memory "github.com/beyondstorage/go-service-memory"
+	"github.com/beyondstorage/go-storage/v4/services"
+	"github.com/beyondstorage/go-storage/v4/types"
+)
+
+// metaMemoryType is the memory storage whose objects carry user metadata like s3.
+const metaMemoryType = "metamemory"
+
+var (
+	metaMemoryLock     sync.Mutex
+	metaMemoryStorages = make(map[string]*metaMemoryStorage)
+)
+
+func init() {
+	services.RegisterSchema(metaMemoryType, map[string]string{})
+	services.RegisterStorager(metaMemoryType, newMetaMemoryStorage)
+}
+
+// metaMemoryStorage keeps user metadata of memory objects, storages are shared
+// by name so that they could be mounted again.
+type metaMemoryStorage struct {
+	*memory.Storage
+
+	mu       sync.Mutex
+	metadata map[string]Metadata
+}
+
+func newMetaMemoryStorage(ps ...types.Pair) (types.Storager, error) {
+	var name string
+	for _, v := range ps {
+		if v.Key == "name" {
+			name = v.Value.(string)
+		}
+	}
+
+	metaMemoryLock.Lock()
+	defer metaMemoryLock.Unlock()
+
+	if st, ok := metaMemoryStorages[name]; ok {
+		return st, nil
+	}
+	store, err := memory.NewStorager()
+	if err != nil {
+		return nil, err
+	}
+	st := &metaMemoryStorage{
+		Storage:  store.(*memory.Storage),
+		metadata: make(map[string]Metadata),
+	}
+	metaMemoryStorages[name] = st
+	return st, nil
+}
+
+func (st *metaMemoryStorage) getMetadata(path string) Metadata {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	m := make(Metadata)
+	for k, v := range st.metadata[strings.TrimSuffix(path, "/")] {
+		m[k] = v
+	}
+	return m
+}
+
+func (st *metaMemoryStorage) setMetadata(path string, m Metadata) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	path = strings.TrimSuffix(path, "/")
+	if m == nil {
+		delete(st.metadata, path)
+		return
+	}
+	st.metadata[path] = make(Metadata)
+	for k, v := range m {
+		st.metadata[path][k] = v
+	}
+}
+
+func (st *metaMemoryStorage) Stat(path string, ps ...types.Pair) (o *types.Object, err error) {
+	o, err = st.Storage.Stat(path, ps...)
+	if err != nil {
+		return
+	}
+	o.SetUserMetadata(st.getMetadata(path))
+	return o, nil
+}
+
+func (st *metaMemoryStorage) Write(path string, r io.Reader, size int64, ps ...types.Pair) (n int64, err error) {
+	return st.writeWithMetadata(path, r, size, nil)
+}
+
+func (st *metaMemoryStorage) Delete(path string, ps ...types.Pair) (err error) {
+	st.setMetadata(path, nil)
+	return st.Storage.Delete(path, ps...)
+}
+
+func (st *metaMemoryStorage) Move(src, dst string, ps ...types.Pair) (err error) {
+	err = st.Storage.Move(src, dst, ps...)
+	if err != nil {
+		return
+	}
+	st.setMetadata(dst, st.getMetadata(src))
+	st.setMetadata(src, nil)
+	return nil
+}
+
+func (st *metaMemoryStorage) writeWithMetadata(path string, r io.Reader, size int64, m Metadata, ps ...types.Pair) (n int64, err error) {
+	// Memory storage only reads once, and fails on empty reader.
+	data, err := ioutil.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return
+	}
+	n, err = st.Storage.Write(path, noEOFReader{bytes.NewReader(data)}, size)
+	if err != nil {
+		return
+	}
+	st.setMetadata(path, m)
+	return n, nil
+}
+
+// noEOFReader doesn't return io.EOF while reading nothing.
+type noEOFReader struct {
+	r io.Reader
+}
+
+func (r noEOFReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return r.r.Read(p)
+}
+
+func (st *metaMemoryStorage) createMultipartWithMetadata(path string, m Metadata) (o *types.Object, err error) {
+	return nil, services.ErrCapabilityInsufficient
+}
+
+func (st *metaMemoryStorage) createDirWithMetadata(path string, m Metadata) (err error) {
+	_, err = st.Storage.CreateDir(path)
+	if err != nil {
+		return
+	}
+	st.setMetadata(path, m)
+	return nil
+}
+
+func (st *metaMemoryStorage) replaceMetadata(path string, dir bool, m Metadata) (err error) {
+	_, err = st.Storage.Stat(path)
+	if err != nil {
+		return
+	}
+	st.setMetadata(path, m)
+	return nil
+}
+
+func TestAttrMetadata(t *testing.T) {
+	mtime := time.Unix(1600000000, 0)
+	attr := &CreateAttr{Mode: 0640, Uid: 1001, Gid: 1002}
+
+	m := attr.formatMetadata(0, mtime)
+	// s3fs stores mode with file type bits, S_IFREG|0640 here.
+	if m[metadataMode] != "33184" {
+		t.Errorf("expect mode 33184, got %s", m[metadataMode])
+	}
+
+	o := types.NewObject(nil, true)
+	o.Path = "a"
+	o.Mode = types.ModeRead
+	o.SetUserMetadata(m)
+
+	ino := newInode(1, o)
+	if !ino.HasMode || os.FileMode(ino.Mode) != 0640 {
+		t.Errorf("expect mode 0640, got %o", ino.Mode)
+	}
+	if !ino.HasOwner || ino.Uid != 1001 || ino.Gid != 1002 {
+		t.Errorf("expect owner 1001:1002, got %d:%d", ino.Uid, ino.Gid)
+	}
+	if !ino.Mtime.Equal(mtime) {
+		t.Errorf("expect mtime %v, got %v", mtime, ino.Mtime)
+	}
+
+	// Sticky bit of dirs should be kept.
+	attr = &CreateAttr{Mode: uint32(os.ModeSticky | 0777)}
+	m = attr.formatMetadata(os.ModeDir, mtime)
+	if m[metadataMode] != "17407" {
+		t.Errorf("expect mode 17407, got %s", m[metadataMode])
+	}
+	o = types.NewObject(nil, true)
+	o.Path = "tmp"
+	o.Mode = types.ModeDir
+	o.SetUserMetadata(m)
+	ino = newInode(1, o)
+	if os.FileMode(ino.Mode) != os.ModeDir|os.ModeSticky|0777 {
+		t.Errorf("expect sticky dir, got %v", os.FileMode(ino.Mode))
+	}
+
+	// Objects without attributes should fall back to defaults.
+	o = types.NewObject(nil, true)
+	o.Path = "b"
+	o.Mode = types.ModeRead
+	ino = newInode(1, o)
+	if ino.HasMode || ino.HasOwner {
+		t.Errorf("expect no attributes, got %+v", ino)
+	}
+}
+
+func TestAttrPersisted(t *testing.T) {
+	storagePath, metaDir := "fs://"+t.TempDir(), t.TempDir()
+
+	fs, root := newTestFS(t, storagePath, metaDir)
+	created, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0600, Uid: 1001, Gid: 1002}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Attributes are kept in inode even if storage doesn't carry them.
+	if !created.HasMode || os.FileMode(created.Mode) != 0600 || !created.HasOwner || created.Uid != 1001 {
+		t.Errorf("expect mode 0600 owned by 1001, got %+v", created)
+	}
+	dir, err := fs.CreateDir(root, "d", &CreateAttr{Mode: 0700, Uid: 1001, Gid: 1002})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !dir.HasMode || os.FileMode(dir.Mode) != os.ModeDir|0700 || !dir.HasOwner || dir.Gid != 1002 {
+		t.Errorf("expect dir mode 0700 owned by 1002, got %+v", dir)
+	}
+	_, err = fh.Write(0, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, root = newTestFS(t, storagePath, metaDir)
+	defer fs.Close()
+
+	o, err := fs.s.Stat("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.loadMetadata(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ino := newInode(root, o)
+	if !ino.HasMode || os.FileMode(ino.Mode) != 0600 {
+		t.Errorf("expect mode 0600, got %o", ino.Mode)
+	}
+	if !ino.HasOwner || ino.Uid != 1001 || ino.Gid != 1002 {
+		t.Errorf("expect owner 1001:1002, got %d:%d", ino.Uid, ino.Gid)
+	}
+	if ino.Mtime.IsZero() || ino.Size != 5 {
+		t.Errorf("expect mtime and size 5, got %v and %d", ino.Mtime, ino.Size)
+	}
+}
+
+func TestAttrMetadataListed(t *testing.T) {
+	storagePath := metaMemoryType + "://" + t.Name()
+
+	fs, root := newTestFS(t, storagePath, "")
+	defer fs.Close()
+
+	// Object written by s3fs with its attributes.
+	st := fs.s.(*metaMemoryStorage)
+	mtime := time.Unix(1600000000, 0)
+	attr := &CreateAttr{Mode: 0600, Uid: 1001, Gid: 1002}
+	_, err := st.writeWithMetadata("a", bytes.NewReader([]byte("hello")), 5, attr.formatMetadata(0, mtime))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := fs.GetInode(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dh, err := fs.CreateDirHandle(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed, err := dh.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listed == nil || listed.Name != "a" || !listed.Incomplete {
+		t.Fatalf("expect incomplete inode of a, got %+v", listed)
+	}
+
+	ino, err := fs.GetEntry(root, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ino.Incomplete || ino.ID != listed.ID {
+		t.Errorf("expect inode %d completed, got %+v", listed.ID, ino)
+	}
+	if !ino.HasMode || os.FileMode(ino.Mode) != 0600 {
+		t.Errorf("expect mode 0600, got %o", ino.Mode)
+	}
+	if !ino.HasOwner || ino.Uid != 1001 || ino.Gid != 1002 {
+		t.Errorf("expect owner 1001:1002, got %d:%d", ino.Uid, ino.Gid)
+	}
+	if !ino.Mtime.Equal(mtime) || ino.Size != 5 {
+		t.Errorf("expect mtime %v and size 5, got %v and %d", mtime, ino.Mtime, ino.Size)
+	}
+	if ino, err = fs.GetInode(listed.ID); err != nil || ino.Incomplete {
+		t.Errorf("expect completed inode stored, got %+v, %v", ino, err)
+	}
+
+	// Metadata has been loaded, listing again needs no stat.
+	dh, err = fs.CreateDirHandle(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listed, err = dh.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if listed == nil || listed.Incomplete || os.FileMode(listed.Mode) != 0600 {
+		t.Errorf("expect complete inode with mode 0600, got %+v", listed)
+	}
+}
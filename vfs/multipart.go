@@ -0,0 +1,195 @@
+package vfs
+
+import (
+	"errors"
+	"time"
+
+	"github.com/beyondstorage/go-storage/v4/pairs"
+	"github.com/beyondstorage/go-storage/v4/types"
+	"go.uber.org/zap"
+
+	"github.com/beyondstorage/beyond-fs/meta"
+)
+
+const (
+	// defaultMultipartMaxAge is the age of incomplete multiparts to be aborted
+	// if not specified.
+	defaultMultipartMaxAge = 24 * time.Hour
+	// multipartGCInterval is the interval of looking for expired multiparts.
+	multipartGCInterval = 10 * time.Minute
+)
+
+// abortMultipart aborts the multipart of session if created, so that parts
+// persisted will not be charged anymore. Errors will only be logged since the
+// multipart will be collected later.
+func (c *Cache) abortMultipart(chk *chunk) {
+	if chk.object == nil {
+		return
+	}
+	id, ok := chk.object.GetMultipartID()
+	if !ok {
+		return
+	}
+
+	err := c.deleteMultipart(chk.path, id)
+	if err != nil {
+		c.logger.Error("abort multipart",
+			zap.String("path", chk.path),
+			zap.String("multipart_id", id),
+			zap.Error(err))
+	}
+}
+
+func (c *Cache) deleteMultipart(path, id string) error {
+	return retry(c.logger, "abort multipart", func() error {
+		return c.s.Delete(path, pairs.WithMultipartID(id))
+	})
+}
+
+// activeMultiparts returns the ids of multiparts created by sessions in writing.
+func (c *Cache) activeMultiparts() map[string]bool {
+	c.chunkLock.Lock()
+	chunks := make([]*chunk, 0, len(c.chunks))
+	for _, chk := range c.chunks {
+		chunks = append(chunks, chk)
+	}
+	c.chunkLock.Unlock()
+
+	ids := make(map[string]bool)
+	for _, chk := range chunks {
+		chk.lock.Lock()
+		if chk.object != nil {
+			if id, ok := chk.object.GetMultipartID(); ok {
+				ids[id] = true
+			}
+		}
+		chk.lock.Unlock()
+	}
+	return ids
+}
+
+// collectMultiparts aborts incomplete multiparts under work dir periodically
+// until stop closed, they could be left by failed sessions or crashed mounts.
+//
+// Multiparts older than maxAge will be aborted, so maxAge should be longer than
+// the time to write a file by other mounts of the same storage.
+func (c *Cache) collectMultiparts(m meta.Service, maxAge time.Duration, stop <-chan struct{}) {
+	if _, ok := c.s.(types.Multiparter); !ok {
+		return
+	}
+	if maxAge == 0 {
+		maxAge = defaultMultipartMaxAge
+	}
+
+	for {
+		err := c.gcMultiparts(m, maxAge, time.Now())
+		if err != nil {
+			c.logger.Error("collect multiparts", zap.Error(err))
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(multipartGCInterval):
+		}
+	}
+}
+
+// gcMultiparts aborts incomplete multiparts older than maxAge at now.
+//
+// Storage could not return the time multipart created, the time multipart first
+// seen will be kept in m instead.
+func (c *Cache) gcMultiparts(m meta.Service, maxAge time.Duration, now time.Time) (err error) {
+	it, err := c.s.List("", pairs.WithListMode(types.ListModePart))
+	if err != nil {
+		return
+	}
+
+	active := c.activeMultiparts()
+	listed := make(map[string]bool)
+	for {
+		o, err := it.Next()
+		if err != nil && errors.Is(err, types.IterateDone) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		id, ok := o.GetMultipartID()
+		if !ok || active[id] {
+			continue
+		}
+		listed[id] = true
+
+		created, ok := o.GetLastModified()
+		if !ok {
+			created, err = firstSeen(m, id, now)
+			if err != nil {
+				return err
+			}
+		}
+		if now.Sub(created) < maxAge {
+			continue
+		}
+
+		err = c.deleteMultipart(o.Path, id)
+		if err != nil {
+			c.logger.Error("abort expired multipart",
+				zap.String("path", o.Path),
+				zap.String("multipart_id", id),
+				zap.Error(err))
+			continue
+		}
+		c.logger.Info("abort expired multipart",
+			zap.String("path", o.Path),
+			zap.String("multipart_id", id))
+	}
+
+	return forgetMultiparts(m, listed)
+}
+
+// firstSeen returns the time multipart first seen, now will be recorded if it's
+// never seen before.
+func firstSeen(m meta.Service, id string, now time.Time) (t time.Time, err error) {
+	bs, err := m.Get(meta.MultipartKey(id))
+	if err != nil {
+		return
+	}
+	if bs != nil {
+		err = t.UnmarshalBinary(bs)
+		return
+	}
+
+	bs, err = now.MarshalBinary()
+	if err != nil {
+		return
+	}
+	return now, m.Set(meta.MultipartKey(id), bs)
+}
+
+// forgetMultiparts removes the first seen time of multiparts not listed, they
+// have been completed or aborted.
+func forgetMultiparts(m meta.Service, listed map[string]bool) (err error) {
+	prefix := meta.MultipartPrefix()
+	it := m.Scan(prefix)
+	var keys [][]byte
+	for it.Next() {
+		k, _, err := it.Entry()
+		if err != nil {
+			it.Close()
+			return err
+		}
+		if !listed[string(k[len(prefix):])] {
+			keys = append(keys, k)
+		}
+	}
+	it.Close()
+
+	for _, k := range keys {
+		err = m.Delete(k)
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
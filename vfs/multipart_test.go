@@ -0,0 +1,106 @@
+package vfs
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/beyondstorage/beyond-fs/meta"
+)
+
+func TestAbortMultipartOnFailure(t *testing.T) {
+	s := newFakeMultiparter(t, 4)
+	s.fail = 1
+	c := newTestCache(t, s, 0, 4)
+
+	err := c.startWrite(1, "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.write(1, []byte("01234567"))
+	if err != nil && !errors.Is(err, ErrIO) {
+		t.Fatal(err)
+	}
+
+	err = c.endWrite(1)
+	if !errors.Is(err, ErrIO) {
+		t.Fatalf("expect ErrIO, got %v", err)
+	}
+	if s.aborted != 1 || len(s.parts) != 0 {
+		t.Errorf("expect multipart aborted, got %d aborted and %d left", s.aborted, len(s.parts))
+	}
+	if c.DirtyBytes() != 0 {
+		t.Errorf("expect no dirty bytes, got %d", c.DirtyBytes())
+	}
+}
+
+func TestGCMultiparts(t *testing.T) {
+	s := newFakeMultiparter(t, 4)
+	m, err := meta.NewBadger("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	orphan, err := s.CreateMultipart("orphan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	orphanID := orphan.MustGetMultipartID()
+
+	c := newTestCache(t, s, 0, 4)
+	err = c.startWrite(1, "active", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.write(1, []byte("01234567"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return s.partCount() == 2 })
+
+	now := time.Now()
+	err = c.gcMultiparts(m, time.Hour, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.aborted != 0 {
+		t.Fatalf("expect nothing aborted, got %d", s.aborted)
+	}
+	bs, err := m.Get(meta.MultipartKey(orphanID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs == nil {
+		t.Fatal("expect first seen time of orphan recorded")
+	}
+
+	// First seen time is kept in meta, so that it survives restarts.
+	restarted := newTestCache(t, s, 0, 4)
+	err = restarted.gcMultiparts(m, time.Hour, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.aborted != 1 {
+		t.Fatalf("expect orphan aborted, got %d aborted", s.aborted)
+	}
+	if _, ok := s.parts[orphanID]; ok {
+		t.Error("expect orphan removed")
+	}
+
+	err = c.endWrite(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.gcMultiparts(m, time.Hour, now.Add(2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err = m.Get(meta.MultipartKey(orphanID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bs != nil {
+		t.Error("expect first seen time of aborted multipart forgotten")
+	}
+}
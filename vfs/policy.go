@@ -0,0 +1,296 @@
+package vfs
+
+import (
+	"container/heap"
+	"container/list"
+	"fmt"
+)
+
+const (
+	// PolicyLRU evicts the least recently used block.
+	PolicyLRU = "lru"
+	// PolicyLFU evicts the least frequently used block, ties are broken by recency.
+	PolicyLFU = "lfu"
+	// Policy2Q keeps blocks accessed only once in a FIFO queue, so that a scan
+	// will not flush the hot set which has been accessed again.
+	Policy2Q = "2q"
+)
+
+const (
+	// twoQueueInRatio is the max ratio of blocks in A1in queue of 2Q.
+	twoQueueInRatio = 0.25
+	// twoQueueOutRatio is the max ratio of ghost keys in A1out queue of 2Q.
+	twoQueueOutRatio = 0.5
+)
+
+// EvictionPolicy decides which block to evict while cache is full.
+//
+// Policies are not required to be thread safe, cache will call them under its lock.
+type EvictionPolicy interface {
+	// Name returns the name of policy.
+	Name() string
+	// Add records a new key.
+	Add(key string)
+	// Access records a hit of key.
+	Access(key string)
+	// Remove forgets the key which has been dropped by cache.
+	Remove(key string)
+	// Evict removes and returns the key to evict, ok will be false if no key left.
+	Evict() (key string, ok bool)
+}
+
+// NewEvictionPolicy creates policy by name, LRU will be used if name is empty.
+func NewEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "", PolicyLRU:
+		return newLRUPolicy(), nil
+	case PolicyLFU:
+		return newLFUPolicy(), nil
+	case Policy2Q:
+		return new2QPolicy(), nil
+	default:
+		return nil, fmt.Errorf("eviction policy %s is not supported", name)
+	}
+}
+
+// lruList is a list of keys in order of recency, front is the most recent.
+type lruList struct {
+	l *list.List
+	m map[string]*list.Element
+}
+
+func newLRUList() *lruList {
+	return &lruList{
+		l: list.New(),
+		m: make(map[string]*list.Element),
+	}
+}
+
+func (ll *lruList) Len() int {
+	return ll.l.Len()
+}
+
+func (ll *lruList) Contains(key string) bool {
+	_, ok := ll.m[key]
+	return ok
+}
+
+func (ll *lruList) PushFront(key string) {
+	if e, ok := ll.m[key]; ok {
+		ll.l.MoveToFront(e)
+		return
+	}
+	ll.m[key] = ll.l.PushFront(key)
+}
+
+func (ll *lruList) MoveToFront(key string) {
+	if e, ok := ll.m[key]; ok {
+		ll.l.MoveToFront(e)
+	}
+}
+
+func (ll *lruList) Remove(key string) bool {
+	e, ok := ll.m[key]
+	if !ok {
+		return false
+	}
+	ll.l.Remove(e)
+	delete(ll.m, key)
+	return true
+}
+
+// PopBack removes and returns the least recent key.
+func (ll *lruList) PopBack() (key string, ok bool) {
+	e := ll.l.Back()
+	if e == nil {
+		return "", false
+	}
+	key = e.Value.(string)
+	ll.l.Remove(e)
+	delete(ll.m, key)
+	return key, true
+}
+
+type lruPolicy struct {
+	l *lruList
+}
+
+func newLRUPolicy() *lruPolicy {
+	return &lruPolicy{l: newLRUList()}
+}
+
+func (p *lruPolicy) Name() string {
+	return PolicyLRU
+}
+
+func (p *lruPolicy) Add(key string) {
+	p.l.PushFront(key)
+}
+
+func (p *lruPolicy) Access(key string) {
+	p.l.MoveToFront(key)
+}
+
+func (p *lruPolicy) Remove(key string) {
+	p.l.Remove(key)
+}
+
+func (p *lruPolicy) Evict() (key string, ok bool) {
+	return p.l.PopBack()
+}
+
+type lfuEntry struct {
+	key   string
+	freq  uint64
+	tick  uint64
+	index int
+}
+
+// lfuHeap is a min heap of entries by frequency, then by recency.
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int {
+	return len(h)
+}
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
+
+type lfuPolicy struct {
+	h    lfuHeap
+	m    map[string]*lfuEntry
+	tick uint64
+}
+
+func newLFUPolicy() *lfuPolicy {
+	return &lfuPolicy{
+		m: make(map[string]*lfuEntry),
+	}
+}
+
+func (p *lfuPolicy) Name() string {
+	return PolicyLFU
+}
+
+func (p *lfuPolicy) Add(key string) {
+	p.tick++
+	if e, ok := p.m[key]; ok {
+		e.freq++
+		e.tick = p.tick
+		heap.Fix(&p.h, e.index)
+		return
+	}
+	e := &lfuEntry{key: key, freq: 1, tick: p.tick}
+	heap.Push(&p.h, e)
+	p.m[key] = e
+}
+
+func (p *lfuPolicy) Access(key string) {
+	e, ok := p.m[key]
+	if !ok {
+		return
+	}
+	p.tick++
+	e.freq++
+	e.tick = p.tick
+	heap.Fix(&p.h, e.index)
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	e, ok := p.m[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&p.h, e.index)
+	delete(p.m, key)
+}
+
+func (p *lfuPolicy) Evict() (key string, ok bool) {
+	if p.h.Len() == 0 {
+		return "", false
+	}
+	e := heap.Pop(&p.h).(*lfuEntry)
+	delete(p.m, e.key)
+	return e.key, true
+}
+
+// twoQueuePolicy implements the full version of 2Q: new keys enter A1in, keys
+// evicted from A1in are remembered in A1out, and keys added again while in
+// A1out are considered hot and enter Am.
+type twoQueuePolicy struct {
+	in  *lruList
+	out *lruList
+	am  *lruList
+}
+
+func new2QPolicy() *twoQueuePolicy {
+	return &twoQueuePolicy{
+		in:  newLRUList(),
+		out: newLRUList(),
+		am:  newLRUList(),
+	}
+}
+
+func (p *twoQueuePolicy) Name() string {
+	return Policy2Q
+}
+
+func (p *twoQueuePolicy) Add(key string) {
+	if p.am.Contains(key) || p.in.Contains(key) {
+		p.Access(key)
+		return
+	}
+	if p.out.Remove(key) {
+		p.am.PushFront(key)
+		return
+	}
+	p.in.PushFront(key)
+}
+
+func (p *twoQueuePolicy) Access(key string) {
+	// Accesses in A1in are treated as correlated references, so only Am is updated.
+	p.am.MoveToFront(key)
+}
+
+func (p *twoQueuePolicy) Remove(key string) {
+	if !p.in.Remove(key) {
+		p.am.Remove(key)
+	}
+}
+
+func (p *twoQueuePolicy) Evict() (key string, ok bool) {
+	resident := p.in.Len() + p.am.Len()
+	if p.in.Len() > 0 && (float64(p.in.Len()) > twoQueueInRatio*float64(resident) || p.am.Len() == 0) {
+		key, ok = p.in.PopBack()
+		p.out.PushFront(key)
+		for float64(p.out.Len()) > twoQueueOutRatio*float64(resident) && p.out.Len() > 1 {
+			p.out.PopBack()
+		}
+		return key, ok
+	}
+	return p.am.PopBack()
+}
@@ -0,0 +1,86 @@
+package vfs
+
+import (
+	"testing"
+)
+
+func evictAll(p EvictionPolicy) []string {
+	keys := make([]string, 0)
+	for {
+		key, ok := p.Evict()
+		if !ok {
+			return keys
+		}
+		keys = append(keys, key)
+	}
+}
+
+func TestLRUPolicy(t *testing.T) {
+	p := newLRUPolicy()
+	for _, k := range []string{"a", "b", "c"} {
+		p.Add(k)
+	}
+	p.Access("a")
+	p.Remove("c")
+
+	keys := evictAll(p)
+	if len(keys) != 2 || keys[0] != "b" || keys[1] != "a" {
+		t.Errorf("expect [b a], got %v", keys)
+	}
+}
+
+func TestLFUPolicy(t *testing.T) {
+	p := newLFUPolicy()
+	for _, k := range []string{"a", "b", "c", "d"} {
+		p.Add(k)
+	}
+	p.Access("a")
+	p.Access("a")
+	p.Access("c")
+	p.Remove("d")
+
+	// b is used only once, c is used less than a.
+	keys := evictAll(p)
+	if len(keys) != 3 || keys[0] != "b" || keys[1] != "c" || keys[2] != "a" {
+		t.Errorf("expect [b c a], got %v", keys)
+	}
+}
+
+func Test2QPolicy(t *testing.T) {
+	p := new2QPolicy()
+	for _, k := range []string{"a", "b", "c", "d"} {
+		p.Add(k)
+	}
+
+	// All keys are in A1in, the oldest one will be evicted and remembered.
+	key, _ := p.Evict()
+	if key != "a" {
+		t.Fatalf("expect a, got %s", key)
+	}
+	// a is added again while remembered, so it's hot now.
+	p.Add("a")
+	// Scan through new keys should not evict the hot key.
+	for _, k := range []string{"e", "f", "g"} {
+		p.Add(k)
+		key, _ = p.Evict()
+		if key == "a" {
+			t.Fatalf("expect hot key kept while adding %s", k)
+		}
+	}
+	if !p.am.Contains("a") {
+		t.Error("expect a in Am")
+	}
+}
+
+func TestNewEvictionPolicy(t *testing.T) {
+	for _, name := range []string{"", PolicyLRU, PolicyLFU, Policy2Q} {
+		_, err := NewEvictionPolicy(name)
+		if err != nil {
+			t.Errorf("new policy %q: %v", name, err)
+		}
+	}
+	_, err := NewEvictionPolicy("fifo")
+	if err == nil {
+		t.Error("expect error for unsupported policy")
+	}
+}
@@ -0,0 +1,189 @@
+package vfs
+
+import (
+	"bytes"
+
+	"github.com/beyondstorage/go-storage/v4/pairs"
+	"go.uber.org/zap"
+)
+
+const (
+	// readAheadBlockSize is the size of each prefetch request.
+	readAheadBlockSize = 1024 * 1024
+	// minReadAheadWindow is the window size after sequential access detected.
+	minReadAheadWindow = 2 * readAheadBlockSize
+	// maxReadAheadWindow is the max size of data prefetched for a handle.
+	maxReadAheadWindow = 16 * readAheadBlockSize
+	// readAheadTrigger is the count of sequential reads before prefetching.
+	readAheadTrigger = 2
+	// readAheadConcurrency is the max number of prefetch requests of all handles,
+	// prefetching will be skipped while all workers are busy.
+	readAheadConcurrency = 32
+)
+
+// readAheadBlock is a range of file being fetched in the background.
+type readAheadBlock struct {
+	offset uint64
+	size   uint64
+
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// readAhead detects sequential reads of a handle and prefetches the data after
+// them, the window grows while access keeps sequential and will be dropped once
+// random access detected.
+type readAhead struct {
+	// nextOffset is the offset where last read ended.
+	nextOffset uint64
+	seqCount   int
+	window     uint64
+	// windowStart is nextOffset while the window was sized, the window grows
+	// only after data in it has been read since then.
+	windowStart uint64
+
+	// blocks are prefetched blocks in order of offset.
+	blocks []*readAheadBlock
+}
+
+// observe records the read and updates the window.
+//
+// Kernel could send reads concurrently, so reads slightly out of order are
+// still treated as sequential.
+func (ra *readAhead) observe(offset, size uint64) {
+	if offset+readAheadBlockSize >= ra.nextOffset && offset <= ra.nextOffset+readAheadBlockSize {
+		ra.seqCount++
+	} else {
+		ra.reset()
+	}
+	if end := offset + size; end > ra.nextOffset || ra.seqCount == 0 {
+		ra.nextOffset = end
+	}
+
+	if ra.seqCount < readAheadTrigger {
+		return
+	}
+	if ra.window == 0 {
+		ra.window = minReadAheadWindow
+		ra.windowStart = ra.nextOffset
+	} else if ra.window < maxReadAheadWindow && ra.nextOffset >= ra.windowStart+ra.window {
+		// Small reads should not grow the window faster than it's consumed.
+		ra.window *= 2
+		ra.windowStart = ra.nextOffset
+	}
+}
+
+// reset drops the prefetched data, running prefetches will be discarded.
+func (ra *readAhead) reset() {
+	ra.seqCount = 0
+	ra.window = 0
+	ra.windowStart = 0
+	ra.blocks = nil
+}
+
+// read serves read from prefetched blocks, ok will be false if the range is
+// not fully prefetched.
+func (ra *readAhead) read(offset uint64, buf []byte) (n int, ok bool) {
+	// Blocks before offset will never be read in sequential access.
+	for len(ra.blocks) > 0 && ra.blocks[0].offset+ra.blocks[0].size <= offset {
+		ra.blocks = ra.blocks[1:]
+	}
+
+	for _, b := range ra.blocks {
+		if n == len(buf) {
+			return n, true
+		}
+		if b.offset > offset+uint64(n) {
+			return 0, false
+		}
+
+		<-b.done
+		if b.err != nil {
+			ra.reset()
+			return 0, false
+		}
+		if uint64(len(b.data)) < b.size {
+			// Block is shorter than expected, the file could have been changed.
+			ra.reset()
+			return 0, false
+		}
+		n += copy(buf[n:], b.data[offset+uint64(n)-b.offset:])
+	}
+	return n, n == len(buf)
+}
+
+// readAhead prefetches data in window after the read.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) readAhead() {
+	ra := &fh.ra
+	if ra.window == 0 {
+		return
+	}
+
+	next := ra.nextOffset
+	if l := len(ra.blocks); l > 0 {
+		b := ra.blocks[l-1]
+		if b.offset+b.size > next {
+			next = b.offset + b.size
+		}
+	}
+
+	end := ra.nextOffset + ra.window
+	if end > fh.size {
+		end = fh.size
+	}
+	for next < end {
+		size := uint64(readAheadBlockSize)
+		if size > end-next {
+			size = end - next
+		}
+
+		b := &readAheadBlock{
+			offset: next,
+			size:   size,
+			done:   make(chan struct{}),
+		}
+		path, version := fh.ino.Path, objectVersion(fh.ino)
+		err := fh.fs.readAheadPool.Submit(func() {
+			fh.fs.fetchBlock(path, version, b)
+		})
+		if err != nil {
+			// All workers are busy, try again in next read.
+			return
+		}
+		ra.blocks = append(ra.blocks, b)
+		next += size
+	}
+}
+
+func (fs *FS) fetchBlock(path, version string, b *readAheadBlock) {
+	defer close(b.done)
+
+	var err error
+	if fs.blockCache != nil {
+		// Prefetched data will be kept in block cache as well.
+		data := make([]byte, b.size)
+		var n int
+		n, err = fs.readCached(path, version, b.offset, data)
+		b.data = data[:n]
+	} else {
+		var buf bytes.Buffer
+		_, err = fs.s.Read(path, &buf,
+			pairs.WithOffset(int64(b.offset)),
+			pairs.WithSize(int64(b.size)))
+		b.data = buf.Bytes()
+		// Storage could ignore the size.
+		if uint64(len(b.data)) > b.size {
+			b.data = b.data[:b.size]
+		}
+	}
+	if err != nil {
+		fs.logger.Error("read ahead",
+			zap.String("path", path),
+			zap.Uint64("offset", b.offset),
+			zap.Error(err))
+		b.err = err
+	}
+}
@@ -0,0 +1,146 @@
+package vfs
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestReadAheadObserve(t *testing.T) {
+	const bs = readAheadBlockSize
+
+	cases := []struct {
+		name   string
+		reads  [][2]uint64
+		window uint64
+	}{
+		{"single read", [][2]uint64{{0, bs}}, 0},
+		{"sequential", [][2]uint64{{0, bs}, {bs, bs}}, minReadAheadWindow},
+		{"window kept until consumed", [][2]uint64{{0, bs}, {bs, bs}, {2 * bs, bs}}, minReadAheadWindow},
+		{"window grows", [][2]uint64{{0, bs}, {bs, bs}, {2 * bs, bs}, {3 * bs, bs}}, 2 * minReadAheadWindow},
+		{"slightly out of order", [][2]uint64{{0, bs / 2}, {bs, bs / 2}, {bs / 2, bs / 2}}, minReadAheadWindow},
+		{"random resets", [][2]uint64{{0, bs}, {bs, bs}, {100 * bs, bs}}, 0},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			ra := &readAhead{}
+			for _, r := range tt.reads {
+				ra.observe(r[0], r[1])
+			}
+			if ra.window != tt.window {
+				t.Errorf("expect window %d, got %d", tt.window, ra.window)
+			}
+		})
+	}
+
+	// Small reads grow the window as slow as big ones.
+	ra := &readAhead{}
+	const small = 4096
+	for i := uint64(0); i < 4*bs/small; i++ {
+		ra.observe(i*small, small)
+	}
+	if ra.window != 2*minReadAheadWindow {
+		t.Errorf("expect window %d after 4 blocks read, got %d", 2*minReadAheadWindow, ra.window)
+	}
+
+	ra = &readAhead{}
+	for i := uint64(0); i < 64; i++ {
+		ra.observe(i*bs, bs)
+	}
+	if ra.window != maxReadAheadWindow {
+		t.Errorf("expect window capped at %d, got %d", maxReadAheadWindow, ra.window)
+	}
+}
+
+func TestReadAheadRead(t *testing.T) {
+	block := func(offset uint64, data string) *readAheadBlock {
+		b := &readAheadBlock{
+			offset: offset,
+			size:   uint64(len(data)),
+			done:   make(chan struct{}),
+			data:   []byte(data),
+		}
+		close(b.done)
+		return b
+	}
+
+	ra := &readAhead{
+		window: minReadAheadWindow,
+		blocks: []*readAheadBlock{block(0, "0123"), block(4, "4567")},
+	}
+	buf := make([]byte, 4)
+	// Read across blocks.
+	n, ok := ra.read(2, buf)
+	if !ok || string(buf[:n]) != "2345" {
+		t.Errorf("expect 2345, got %q, %v", buf[:n], ok)
+	}
+	// Range not prefetched.
+	_, ok = ra.read(6, buf)
+	if ok {
+		t.Error("expect read beyond blocks missed")
+	}
+	if len(ra.blocks) != 1 {
+		t.Errorf("expect blocks before offset dropped, got %d blocks", len(ra.blocks))
+	}
+
+	// Short block means the file has been changed.
+	ra.blocks = []*readAheadBlock{block(8, "89")}
+	ra.blocks[0].size = 4
+	_, ok = ra.read(8, buf)
+	if ok || ra.window != 0 || ra.blocks != nil {
+		t.Error("expect read ahead reset after short block")
+	}
+}
+
+func TestReadAheadInvalidated(t *testing.T) {
+	fs, root := newTestFS(t, "fs://"+t.TempDir(), "")
+	defer fs.Close()
+
+	ino, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fh.Write(0, bytes.Repeat([]byte{'a'}, 4*readAheadBlockSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ino, err = fs.GetInode(ino.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, err = fs.OpenFileHandle(ino, os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.DeleteFileHandle(fh.ID)
+
+	buf := make([]byte, readAheadBlockSize)
+	for i := uint64(0); i < readAheadTrigger; i++ {
+		_, err = fh.Read(i*readAheadBlockSize, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fh.ra.blocks) == 0 {
+		t.Fatal("expect data prefetched after sequential reads")
+	}
+
+	// Object is rewritten by others.
+	_, err = fs.writeObject("a", bytes.NewReader(bytes.Repeat([]byte{'b'}, 4*readAheadBlockSize)), 4*readAheadBlockSize, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fh.Read(readAheadTrigger*readAheadBlockSize, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != 'b' {
+		t.Errorf("expect data written after prefetched, got %q", buf[0])
+	}
+}
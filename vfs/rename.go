@@ -0,0 +1,517 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/beyondstorage/go-storage/v4/pairs"
+	"github.com/beyondstorage/go-storage/v4/services"
+	"github.com/beyondstorage/go-storage/v4/types"
+	"github.com/panjf2000/ants/v2"
+	"go.uber.org/zap"
+
+	"github.com/beyondstorage/beyond-fs/meta"
+)
+
+//go:generate go run github.com/tinylib/msgp
+
+// renameConcurrency is the max number of objects moved at the same time during dir rename.
+const renameConcurrency = 16
+
+const (
+	// RenamePrepared means the journal has been recorded, and dst dir may have been
+	// created if it didn't exist, but no object has been moved.
+	RenamePrepared uint8 = iota + 1
+	// RenameMoving means objects under Src are being moved to Dst.
+	RenameMoving
+)
+
+// RenameJournal records a dir rename in progress.
+//
+// Dir rename needs to move every object under the dir, we record the journal
+// before moving so that an interrupted rename could be resumed or rolled back
+// in next mount.
+type RenameJournal struct {
+	ID    uint64
+	Src   string
+	Dst   string
+	State uint8
+	// Created means dst dir didn't exist before, and will be created by rename.
+	// An existing dst dir must be kept while rolling back.
+	Created bool
+}
+
+func (fs *FS) Rename(oldParent uint64, oldName string, newParent uint64, newName string) (err error) {
+	ino, err := fs.GetEntry(oldParent, oldName)
+	if err != nil {
+		return
+	}
+
+	np, err := fs.GetInode(newParent)
+	if err != nil {
+		return
+	}
+	dst := np.GetEntryPath(newName)
+
+	replaced, err := fs.GetEntry(newParent, newName)
+	if err != nil && !errors.Is(err, services.ErrObjectNotExist) {
+		return
+	}
+	err = nil
+
+	// Open handles will follow the file, unless data written is bound to src.
+	err = fs.checkRenameHandles(ino.Path)
+	if err != nil {
+		return
+	}
+
+	var replacedChunks []string
+	if ino.IsDir() {
+		if replaced != nil {
+			if !replaced.IsDir() {
+				return ErrNotDir
+			}
+			empty, err := fs.isEmptyDir(replaced.Path)
+			if err != nil {
+				return err
+			}
+			if !empty {
+				return ErrNotEmpty
+			}
+		}
+		err = fs.renameDir(ino.Path, dst, replaced == nil)
+	} else {
+		if replaced != nil && replaced.IsDir() {
+			return ErrIsDir
+		}
+		if replaced != nil && replaced.ID != ino.ID {
+			replacedChunks = fs.getChunks(replaced)
+		}
+		err = fs.moveObject(ino.Path, dst)
+	}
+	if err != nil {
+		fs.logger.Error("rename",
+			zap.String("src", ino.Path),
+			zap.String("dst", dst),
+			zap.Error(err))
+		return
+	}
+
+	// The old entry at dst has been replaced, its inode is no longer valid.
+	if replaced != nil {
+		fs.retireChunks(replacedChunks)
+		err = fs.DeleteInode(replaced)
+		if err != nil {
+			return
+		}
+	}
+
+	err = fs.DeleteEntry(oldParent, oldName)
+	if err != nil {
+		return
+	}
+
+	// Keep the inode id so that kernel could still use it after rename.
+	src := ino.Path
+	ino.ParentID = newParent
+	ino.Path = dst
+	ino.Name = newName
+	err = fs.SetInode(ino)
+	if err != nil {
+		return
+	}
+	fs.renameHandles(src, dst)
+
+	if ino.IsDir() {
+		return fs.rewriteEntries(ino.ID, src, dst)
+	}
+	return
+}
+
+// checkRenameHandles returns ErrBusy if any handle opened for src or files under
+// it has written data bound to the path.
+func (fs *FS) checkRenameHandles(src string) error {
+	for _, fh := range fs.fhm.All() {
+		if fh.boundTo(src) {
+			return ErrBusy
+		}
+	}
+	return nil
+}
+
+// renameHandles makes handles opened for src or files under it follow the rename.
+func (fs *FS) renameHandles(src, dst string) {
+	for _, fh := range fs.fhm.All() {
+		fh.rename(src, dst)
+	}
+}
+
+// renamedPath returns the path of p after src renamed to dst, ok will be false
+// if p is not src or under it.
+func renamedPath(p, src, dst string) (string, bool) {
+	if p == src {
+		return dst, true
+	}
+	if strings.HasPrefix(p, src+"/") {
+		return dst + p[len(src):], true
+	}
+	return "", false
+}
+
+// boundTo checks whether data written by this handle will be persisted to the
+// path of src or file under it anyway: the multipart of write session has been
+// created, or data has been appended via Appender.
+func (fh *FileHandle) boundTo(src string) bool {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if _, ok := renamedPath(fh.ino.Path, src, ""); !ok {
+		return false
+	}
+	if fh.appendObject != nil && fh.dirty {
+		return true
+	}
+	return fh.writing && fh.cache.multipartCreated(fh.ID)
+}
+
+// rename changes the path of this handle if its file has been moved, staging
+// file and dirty chunks will be persisted to the new path.
+func (fh *FileHandle) rename(src, dst string) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	p, ok := renamedPath(fh.ino.Path, src, dst)
+	if !ok {
+		return
+	}
+	fh.fs.fhm.SetPath(fh, p)
+	if fh.writing && !fh.cache.renameWrite(fh.ID, p) {
+		// Multipart has been created after checked, data will be persisted to src.
+		fh.fs.logger.Error("rename write session",
+			zap.String("src", src),
+			zap.String("dst", dst))
+	}
+}
+
+// moveObject will move object and its user metadata from src to dst.
+func (fs *FS) moveObject(src, dst string) (err error) {
+	defer func() {
+		fs.invalidateBlocks(src)
+		fs.invalidateBlocks(dst)
+	}()
+
+	err = fs.moveData(src, dst)
+	if err != nil {
+		return
+	}
+	return fs.moveMetadata(src, dst)
+}
+
+// moveData will move data from src to dst via the best way the storage supports:
+//
+//   - Mover: move object in server side.
+//   - Copier: copy object in server side and delete the src.
+//   - Otherwise: stream data from src to dst and delete the src.
+func (fs *FS) moveData(src, dst string) (err error) {
+	if m, ok := fs.s.(types.Mover); ok {
+		return m.Move(src, dst)
+	}
+
+	if c, ok := fs.s.(types.Copier); ok {
+		err = c.Copy(src, dst)
+		if err != nil {
+			return
+		}
+		return fs.s.Delete(src)
+	}
+
+	o, err := fs.s.Stat(src)
+	if err != nil {
+		return
+	}
+	size, _ := o.GetContentLength()
+
+	r, w := io.Pipe()
+	go func() {
+		_, err := fs.s.Read(src, w)
+		// CloseWithError(nil) equals to Close.
+		_ = w.CloseWithError(err)
+	}()
+
+	if ms, ok := fs.s.(metadataStorer); ok {
+		// Carry the metadata and content type of src.
+		m, _ := o.GetUserMetadata()
+		var ps []types.Pair
+		if v, ok := o.GetContentType(); ok {
+			ps = append(ps, pairs.WithContentType(v))
+		}
+		_, err = ms.writeWithMetadata(dst, r, size, m, ps...)
+	} else {
+		_, err = fs.s.Write(dst, r, size)
+	}
+	// Make sure the read goroutine could exit if write returned early.
+	_ = r.Close()
+	if err != nil {
+		return
+	}
+	return fs.s.Delete(src)
+}
+
+// renameDir moves all objects under src to dst, create means dst doesn't exist.
+func (fs *FS) renameDir(src, dst string, create bool) (err error) {
+	if !fs.metaPersistent {
+		fs.logger.Warn("rename journal will be lost after unmount without meta path, "+
+			"interrupted rename could not be recovered",
+			zap.String("src", src),
+			zap.String("dst", dst))
+	}
+
+	j := &RenameJournal{
+		ID:      uint64(time.Now().UnixNano()),
+		Src:     src,
+		Dst:     dst,
+		State:   RenamePrepared,
+		Created: create,
+	}
+	err = fs.setRenameJournal(j)
+	if err != nil {
+		return
+	}
+
+	err = fs.createDirObject(dst, nil)
+	if err != nil {
+		return
+	}
+
+	j.State = RenameMoving
+	err = fs.setRenameJournal(j)
+	if err != nil {
+		return
+	}
+
+	// Keep the journal if migrate failed, so that it could be resumed in next mount.
+	err = fs.migrateDir(src, dst)
+	if err != nil {
+		return
+	}
+	return fs.deleteRenameJournal(j)
+}
+
+// migrateDir will move all objects under src to dst.
+//
+// migrateDir is idempotent: objects that have been moved will not be listed under
+// src again, so it's safe to call it again after interrupted.
+func (fs *FS) migrateDir(src, dst string) (err error) {
+	p, err := ants.NewPool(renameConcurrency)
+	if err != nil {
+		return fmt.Errorf("new pool: %w", err)
+	}
+	defer p.Release()
+
+	return fs.migrateDirWithPool(p, src, dst)
+}
+
+func (fs *FS) migrateDirWithPool(p *ants.Pool, src, dst string) (err error) {
+	m, err := fs.getMetadata(src)
+	if err != nil {
+		return
+	}
+	err = fs.createDirObject(dst, m)
+	if err != nil {
+		return
+	}
+
+	it, err := fs.s.List(src+"/", pairs.WithListMode(types.ListModeDir))
+	if err != nil {
+		return
+	}
+
+	var files, dirs []string
+	for {
+		o, err := it.Next()
+		if err != nil && errors.Is(err, types.IterateDone) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		path := strings.TrimSuffix(o.Path, "/")
+		// Dir marker object could be listed as well, skip it.
+		if path == src {
+			continue
+		}
+		if o.Mode.IsDir() {
+			dirs = append(dirs, path)
+		} else {
+			files = append(files, path)
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errLock  sync.Mutex
+		firstErr error
+	)
+	for _, v := range files {
+		from, to := v, dst+strings.TrimPrefix(v, src)
+
+		wg.Add(1)
+		err = p.Submit(func() {
+			defer wg.Done()
+
+			err := fs.moveObject(from, to)
+			if err != nil {
+				errLock.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("move %s to %s: %w", from, to, err)
+				}
+				errLock.Unlock()
+			}
+		})
+		if err != nil {
+			wg.Done()
+			break
+		}
+	}
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("submit task: %w", err)
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	for _, v := range dirs {
+		err = fs.migrateDirWithPool(p, v, dst+strings.TrimPrefix(v, src))
+		if err != nil {
+			return
+		}
+	}
+	return fs.deleteDirObject(src)
+}
+
+// rewriteEntries will update the path of all cached entries under the renamed dir.
+func (fs *FS) rewriteEntries(id uint64, src, dst string) (err error) {
+	it := fs.meta.Scan(meta.EntryPrefix(id))
+
+	children := make([]*Inode, 0)
+	for it.Next() {
+		_, bs, err := it.Entry()
+		if err != nil {
+			it.Close()
+			return fmt.Errorf("get entry: %w", err)
+		}
+
+		ino := &Inode{}
+		_, err = ino.UnmarshalMsg(bs)
+		if err != nil {
+			it.Close()
+			return fmt.Errorf("unmarshal inode: %w", err)
+		}
+		children = append(children, ino)
+	}
+	it.Close()
+
+	for _, ino := range children {
+		ino.Path = dst + strings.TrimPrefix(ino.Path, src)
+		err = fs.SetInode(ino)
+		if err != nil {
+			return
+		}
+		if ino.IsDir() {
+			err = fs.rewriteEntries(ino.ID, src, dst)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return nil
+}
+
+// recoverRenames will resume or roll back dir renames interrupted in last mount.
+func (fs *FS) recoverRenames() (err error) {
+	it := fs.meta.Scan(meta.RenamePrefix())
+
+	journals := make([]*RenameJournal, 0)
+	for it.Next() {
+		_, bs, err := it.Entry()
+		if err != nil {
+			it.Close()
+			return fmt.Errorf("get rename journal: %w", err)
+		}
+
+		j := &RenameJournal{}
+		_, err = j.UnmarshalMsg(bs)
+		if err != nil {
+			it.Close()
+			return fmt.Errorf("unmarshal rename journal: %w", err)
+		}
+		journals = append(journals, j)
+	}
+	it.Close()
+
+	for _, j := range journals {
+		switch j.State {
+		case RenamePrepared:
+			fs.logger.Info("roll back rename",
+				zap.String("src", j.Src),
+				zap.String("dst", j.Dst))
+
+			// No object has been moved, only need to remove the dst dir we may have created.
+			if !j.Created {
+				break
+			}
+			empty, err := fs.isEmptyDir(j.Dst)
+			if err != nil {
+				return err
+			}
+			if empty {
+				err = fs.deleteDirObject(j.Dst)
+				if err != nil {
+					return err
+				}
+			}
+		case RenameMoving:
+			fs.logger.Info("resume rename",
+				zap.String("src", j.Src),
+				zap.String("dst", j.Dst))
+
+			err = fs.migrateDir(j.Src, j.Dst)
+			if err != nil {
+				return fmt.Errorf("resume rename from %s to %s: %w", j.Src, j.Dst, err)
+			}
+		}
+
+		err = fs.deleteRenameJournal(j)
+		if err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+func (fs *FS) setRenameJournal(j *RenameJournal) (err error) {
+	bs, err := j.MarshalMsg(nil)
+	if err != nil {
+		return fmt.Errorf("marshal rename journal: %w", err)
+	}
+
+	err = fs.meta.Set(meta.RenameKey(j.ID), bs)
+	if err != nil {
+		return fmt.Errorf("set rename journal: %w", err)
+	}
+	return nil
+}
+
+func (fs *FS) deleteRenameJournal(j *RenameJournal) (err error) {
+	err = fs.meta.Delete(meta.RenameKey(j.ID))
+	if err != nil {
+		return fmt.Errorf("del rename journal: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package vfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	fsstore "github.com/beyondstorage/go-service-fs/v3"
+	"github.com/beyondstorage/go-storage/v4/services"
+	"github.com/beyondstorage/go-storage/v4/types"
+
+	"github.com/beyondstorage/beyond-fs/meta"
+)
+
+func TestRenameOpenHandle(t *testing.T) {
+	fs, root := newTestFS(t, "fs://"+t.TempDir(), "")
+	defer fs.Close()
+
+	_, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fh.Write(0, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.Rename(root, "a", root, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Data written after rename should go to the new path as well.
+	_, err = fh.Write(5, []byte(" world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	_, err = fs.s.Read("b", &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "hello world" {
+		t.Errorf("expect hello world, got %q", buf.String())
+	}
+	if _, err = fs.s.Stat("a"); err == nil {
+		t.Error("expect a removed")
+	}
+}
+
+func TestRenameBusy(t *testing.T) {
+	fs, root := newTestFS(t, "fs://"+t.TempDir(), "")
+	defer fs.Close()
+
+	// Multiparts collector has returned since fs storage doesn't support multipart.
+	fs.wg.Wait()
+	s := &fakeMultiparter{
+		Storager:    fs.s,
+		minPartSize: 4,
+		parts:       make(map[string]map[int][]byte),
+	}
+	fs.s = s
+	fs.cache.s = s
+	fs.cache.partSize = 4
+	fs.cache.minPartSize = 4
+
+	_, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fh.Write(0, []byte("01234567"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return s.partCount() > 0 })
+
+	// Multipart has been created for a.
+	err = fs.Rename(root, "a", root, "b")
+	if !errors.Is(err, ErrBusy) {
+		t.Errorf("expect ErrBusy, got %v", err)
+	}
+
+	err = fs.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Rename(root, "a", root, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecoverPreparedRename(t *testing.T) {
+	cases := []struct {
+		name    string
+		created bool
+		kept    bool
+	}{
+		{"created dst", true, false},
+		{"existing dst", false, true},
+	}
+
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, metaDir := t.TempDir(), t.TempDir()
+			fs, _ := newTestFS(t, "fs://"+dir, metaDir)
+			for _, p := range []string{"src", "dst"} {
+				err := fs.createDirObject(p, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Rename is interrupted before moving anything.
+			err := fs.setRenameJournal(&RenameJournal{
+				ID:      1,
+				Src:     "src",
+				Dst:     "dst",
+				State:   RenamePrepared,
+				Created: tt.created,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = fs.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fs, _ = newTestFS(t, "fs://"+dir, metaDir)
+			defer fs.Close()
+
+			_, err = os.Stat(dir + "/dst")
+			if tt.kept && err != nil {
+				t.Errorf("expect dst kept, got %v", err)
+			}
+			if !tt.kept && !os.IsNotExist(err) {
+				t.Errorf("expect dst removed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRecoverMovingRename(t *testing.T) {
+	dir, metaDir := t.TempDir(), t.TempDir()
+	fs, _ := newTestFS(t, "fs://"+dir, metaDir)
+	for _, p := range []string{"src", "src/d", "dst"} {
+		err := fs.createDirObject(p, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []string{"src/b", "src/d/c", "dst/a"} {
+		_, err := fs.s.Write(p, bytes.NewReader([]byte(p)), int64(len(p)))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Rename is interrupted after dst/a moved.
+	err := fs.setRenameJournal(&RenameJournal{
+		ID:      1,
+		Src:     "src",
+		Dst:     "dst",
+		State:   RenameMoving,
+		Created: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, _ = newTestFS(t, "fs://"+dir, metaDir)
+	for p, content := range map[string]string{"dst/a": "dst/a", "dst/b": "src/b", "dst/d/c": "src/d/c"} {
+		var buf bytes.Buffer
+		_, err = fs.s.Read(p, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != content {
+			t.Errorf("expect %s in %s, got %q", content, p, buf.String())
+		}
+	}
+	if _, err = os.Stat(dir + "/src"); !os.IsNotExist(err) {
+		t.Errorf("expect src removed, got %v", err)
+	}
+	it := fs.meta.Scan(meta.RenamePrefix())
+	if it.Next() {
+		t.Error("expect journal deleted")
+	}
+	it.Close()
+
+	// Rename is finished, new src should not be moved by next mount.
+	err = fs.createDirObject("src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fs.s.Write("src/e", bytes.NewReader([]byte("e")), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, _ = newTestFS(t, "fs://"+dir, metaDir)
+	defer fs.Close()
+	if _, err = fs.s.Stat("src/e"); err != nil {
+		t.Errorf("expect src/e kept, got %v", err)
+	}
+	if _, err = fs.s.Stat("dst/e"); !errors.Is(err, services.ErrObjectNotExist) {
+		t.Errorf("expect dst/e not exist, got %v", err)
+	}
+}
+
+// countMoveStorage records the max number of moves at the same time.
+type countMoveStorage struct {
+	*fsstore.Storage
+
+	mu       sync.Mutex
+	inflight int
+	max      int
+}
+
+func (st *countMoveStorage) Move(src, dst string, ps ...types.Pair) (err error) {
+	st.mu.Lock()
+	st.inflight++
+	if st.inflight > st.max {
+		st.max = st.inflight
+	}
+	st.mu.Unlock()
+
+	// Keep moves overlapped.
+	time.Sleep(10 * time.Millisecond)
+	err = st.Storage.Move(src, dst, ps...)
+
+	st.mu.Lock()
+	st.inflight--
+	st.mu.Unlock()
+	return
+}
+
+func TestRenameDirConcurrency(t *testing.T) {
+	fs, _ := newTestFS(t, "fs://"+t.TempDir(), "")
+	defer fs.Close()
+
+	st := &countMoveStorage{Storage: fs.s.(*fsstore.Storage)}
+	fs.s = st
+
+	err := fs.createDirObject("src", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := renameConcurrency * 4
+	for i := 0; i < files; i++ {
+		_, err = fs.s.Write(fmt.Sprintf("src/%d", i), bytes.NewReader([]byte("x")), 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = fs.migrateDir("src", "dst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < files; i++ {
+		if _, err = fs.s.Stat(fmt.Sprintf("dst/%d", i)); err != nil {
+			t.Errorf("expect dst/%d moved, got %v", i, err)
+		}
+	}
+	if st.max > renameConcurrency || st.max < 2 {
+		t.Errorf("expect moves bounded by %d in parallel, got %d", renameConcurrency, st.max)
+	}
+}
@@ -0,0 +1,67 @@
+package vfs
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/beyondstorage/go-storage/v4/services"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxRetries is the max times to retry a failed upload operation.
+	maxRetries = 5
+	// retryBaseDelay is the max delay before the first retry, it will be
+	// doubled for every following retry.
+	retryBaseDelay = 100 * time.Millisecond
+	// retryMaxDelay caps the max delay between retries.
+	retryMaxDelay = 10 * time.Second
+)
+
+// retry calls fn until it succeeded, failed with an error not retryable or
+// failed maxRetries times.
+//
+// Delays grow exponentially with full jitter, so that operations failed
+// together will not retry at the same time.
+func retry(logger *zap.Logger, op string, fn func() error) (err error) {
+	for i := 0; ; i++ {
+		err = fn()
+		if err == nil || !retryable(err) || i >= maxRetries {
+			return
+		}
+
+		delay := backoff(i)
+		logger.Warn("retry",
+			zap.String("op", op),
+			zap.Int("attempt", i+1),
+			zap.Duration("delay", delay),
+			zap.Error(err))
+		time.Sleep(delay)
+	}
+}
+
+// backoff returns a random delay before the retry after attempt failed.
+func backoff(attempt int) time.Duration {
+	d := retryBaseDelay << uint(attempt)
+	if d <= 0 || d > retryMaxDelay {
+		d = retryMaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// retryable returns false for errors which will not be fixed by retrying.
+func retryable(err error) bool {
+	for _, v := range []error{
+		services.ErrCapabilityInsufficient,
+		services.ErrRestrictionDissatisfied,
+		services.ErrObjectNotExist,
+		services.ErrObjectModeInvalid,
+		services.ErrPermissionDenied,
+	} {
+		if errors.Is(err, v) {
+			return false
+		}
+	}
+	return true
+}
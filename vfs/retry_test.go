@@ -0,0 +1,45 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/beyondstorage/go-storage/v4/services"
+	"go.uber.org/zap"
+)
+
+func TestRetry(t *testing.T) {
+	calls := 0
+	err := retry(zap.NewNop(), "test", func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("temporary")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("expect succeeded after 3 calls, got %d calls: %v", calls, err)
+	}
+
+	calls = 0
+	err = retry(zap.NewNop(), "test", func() error {
+		calls++
+		return fmt.Errorf("write: %w", services.ErrPermissionDenied)
+	})
+	if !errors.Is(err, services.ErrPermissionDenied) || calls != 1 {
+		t.Errorf("expect no retry, got %d calls: %v", calls, err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		d := backoff(i)
+		if d < 0 || d >= retryMaxDelay {
+			t.Errorf("attempt %d: delay %s out of range", i, d)
+		}
+		if i == 0 && d >= retryBaseDelay {
+			t.Errorf("attempt 0: expect delay less than %s, got %s", retryBaseDelay, d)
+		}
+	}
+}
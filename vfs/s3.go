@@ -0,0 +1,443 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	v4 "github.com/aws/aws-sdk-go/aws/signer/v4"
+	awss3 "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/beyondstorage/go-endpoint"
+	s3 "github.com/beyondstorage/go-service-s3/v2"
+	"github.com/beyondstorage/go-storage/v4/pkg/credential"
+	"github.com/beyondstorage/go-storage/v4/pkg/httpclient"
+	"github.com/beyondstorage/go-storage/v4/services"
+	"github.com/beyondstorage/go-storage/v4/types"
+)
+
+const (
+	// s3LinkTargetMetadata is the user metadata used by go-service-s3 to mark
+	// virtual links, the target is relative to the bucket root.
+	s3LinkTargetMetadata = "x-amz-meta-bs-link-target"
+	// s3WriteSizeMaximum is the max size of objects written or copied by a single request.
+	s3WriteSizeMaximum = 5 * 1024 * 1024 * 1024
+	// s3CopyPartSize is the size of parts while copying objects larger than s3WriteSizeMaximum.
+	s3CopyPartSize = 1024 * 1024 * 1024
+)
+
+// s3Storage is the s3 storage whose objects carry user metadata.
+//
+// go-service-s3 neither writes nor returns user metadata, so requests involving
+// user metadata are sent via a client built from the same pairs, and others are
+// served by go-service-s3. Metadata keys are lower-cased by s3, and they should
+// be valid HTTP header names.
+type s3Storage struct {
+	*s3.Storage
+
+	client  *awss3.S3
+	bucket  string
+	workDir string
+}
+
+func init() {
+	// Replace the s3 storager registered by go-service-s3, so that attributes
+	// and xattrs could be kept along with objects.
+	services.RegisterStorager(s3.Type, newS3Storage)
+}
+
+func newS3Storage(ps ...types.Pair) (types.Storager, error) {
+	store, err := s3.NewStorager(ps...)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &s3Storage{
+		Storage: store.(*s3.Storage),
+		workDir: "/",
+	}
+	client, err := st.newClient(ps)
+	if err != nil {
+		return nil, services.InitError{Op: "new_storager", Type: s3.Type, Err: err, Pairs: ps}
+	}
+	st.client = client
+	return st, nil
+}
+
+// newClient builds the s3 client in the same way as go-service-s3. Pairs have
+// been validated by go-service-s3 already.
+func (st *s3Storage) newClient(ps []types.Pair) (client *awss3.S3, err error) {
+	cfg := aws.NewConfig()
+	cfg.S3DisableContentMD5Validation = aws.Bool(true)
+	// Keys of user metadata will be lower-cased, which are the same as s3fs.
+	cfg.LowerCaseHeaderMaps = aws.Bool(true)
+
+	var opts *httpclient.Options
+	for _, v := range ps {
+		switch v.Key {
+		case "name":
+			st.bucket = v.Value.(string)
+		case "work_dir":
+			st.workDir = v.Value.(string)
+		case "location":
+			cfg = cfg.WithRegion(v.Value.(string))
+		case "force_path_style":
+			cfg = cfg.WithS3ForcePathStyle(v.Value.(bool))
+		case "http_client_options":
+			opts = v.Value.(*httpclient.Options)
+		case "endpoint":
+			ep, err := endpoint.Parse(v.Value.(string))
+			if err != nil {
+				return nil, err
+			}
+			var u string
+			switch ep.Protocol() {
+			case endpoint.ProtocolHTTP:
+				u, _, _ = ep.HTTP()
+			case endpoint.ProtocolHTTPS:
+				u, _, _ = ep.HTTPS()
+			default:
+				return nil, services.PairUnsupportedError{Pair: v}
+			}
+			cfg = cfg.WithEndpoint(u)
+		case "credential":
+			cp, err := credential.Parse(v.Value.(string))
+			if err != nil {
+				return nil, err
+			}
+			switch cp.Protocol() {
+			case credential.ProtocolHmac:
+				ak, sk := cp.Hmac()
+				cfg = cfg.WithCredentials(credentials.NewStaticCredentials(ak, sk, ""))
+			case credential.ProtocolEnv:
+				cfg = cfg.WithCredentials(credentials.NewEnvCredentials())
+			default:
+				return nil, services.PairUnsupportedError{Pair: v}
+			}
+		}
+	}
+	cfg.HTTPClient = httpclient.New(opts)
+
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	client = awss3.New(sess)
+	// Payload is not signed, so that readers without seek support could be uploaded.
+	client.Handlers.Sign.SwapNamed(v4.BuildNamedHandler(v4.SignRequestHandler.Name, func(s *v4.Signer) {
+		s.DisableURIPathEscaping = true
+		s.UnsignedPayload = true
+	}))
+	return client, nil
+}
+
+func (st *s3Storage) getAbsPath(path string) string {
+	return strings.TrimPrefix(st.workDir, "/") + path
+}
+
+func (st *s3Storage) getRelPath(path string) string {
+	return strings.TrimPrefix(path, strings.TrimPrefix(st.workDir, "/"))
+}
+
+func (st *s3Storage) formatError(op string, err error, path ...string) error {
+	if err == nil {
+		return nil
+	}
+
+	e, ok := err.(awserr.RequestFailure)
+	switch {
+	case !ok:
+		err = fmt.Errorf("%w: %v", services.ErrUnexpected, err)
+	case e.Code() == "NoSuchKey" || e.Code() == "NotFound":
+		err = fmt.Errorf("%w: %v", services.ErrObjectNotExist, err)
+	case e.Code() == "AccessDenied":
+		err = fmt.Errorf("%w: %v", services.ErrPermissionDenied, err)
+	default:
+		err = fmt.Errorf("%w: %v", services.ErrUnexpected, err)
+	}
+	return services.StorageError{Op: op, Err: err, Storager: st, Path: path}
+}
+
+// Stat returns the object with its user metadata, which is always set even
+// if the object doesn't have any. Stat with pairs is served by go-service-s3.
+func (st *s3Storage) Stat(path string, ps ...types.Pair) (o *types.Object, err error) {
+	if len(ps) > 0 {
+		return st.Storage.Stat(path, ps...)
+	}
+
+	rp := st.getAbsPath(path)
+	output, err := st.client.HeadObject(&awss3.HeadObjectInput{
+		Bucket: aws.String(st.bucket),
+		Key:    aws.String(rp),
+	})
+	if err != nil {
+		return nil, st.formatError("stat", err, path)
+	}
+
+	o = types.NewObject(st, true)
+	o.ID = rp
+	o.Path = path
+	o.Mode = types.ModeRead
+	if strings.HasSuffix(rp, "/") {
+		o.Mode = types.ModeDir
+	}
+
+	m := make(map[string]string, len(output.Metadata))
+	for k, v := range output.Metadata {
+		m[k] = aws.StringValue(v)
+	}
+	// Keep links created by go-service-s3 readable.
+	if target, ok := m[s3LinkTargetMetadata]; ok {
+		delete(m, s3LinkTargetMetadata)
+		o.Mode = types.ModeLink
+		o.SetLinkTarget("/" + target)
+	}
+	o.SetUserMetadata(m)
+
+	o.SetContentLength(aws.Int64Value(output.ContentLength))
+	o.SetLastModified(aws.TimeValue(output.LastModified))
+	if output.ContentType != nil {
+		o.SetContentType(*output.ContentType)
+	}
+	if output.ETag != nil {
+		o.SetEtag(*output.ETag)
+	}
+	o.SetSystemMetadata(s3.ObjectSystemMetadata{StorageClass: aws.StringValue(output.StorageClass)})
+	return o, nil
+}
+
+// List lists objects in dir mode with all facts returned by listing set, so
+// that getting them will not stat each object. Other modes are served by
+// go-service-s3.
+func (st *s3Storage) List(path string, ps ...types.Pair) (oi *types.ObjectIterator, err error) {
+	if len(ps) != 1 || ps[0].Key != "list_mode" || !ps[0].Value.(types.ListMode).IsDir() {
+		return st.Storage.List(path, ps...)
+	}
+
+	status := &s3ListStatus{prefix: st.getAbsPath(path)}
+	return types.NewObjectIterator(context.Background(), st.nextObjectPage, status), nil
+}
+
+type s3ListStatus struct {
+	prefix string
+	token  string
+}
+
+func (s *s3ListStatus) ContinuationToken() string {
+	return s.token
+}
+
+func (st *s3Storage) nextObjectPage(ctx context.Context, page *types.ObjectPage) error {
+	status := page.Status.(*s3ListStatus)
+
+	input := &awss3.ListObjectsV2Input{
+		Bucket:    aws.String(st.bucket),
+		Delimiter: aws.String("/"),
+		MaxKeys:   aws.Int64(200),
+		Prefix:    aws.String(status.prefix),
+	}
+	if status.token != "" {
+		input.ContinuationToken = aws.String(status.token)
+	}
+	output, err := st.client.ListObjectsV2WithContext(ctx, input)
+	if err != nil {
+		return st.formatError("list", err, status.prefix)
+	}
+
+	for _, v := range output.CommonPrefixes {
+		o := types.NewObject(st, true)
+		o.ID = aws.StringValue(v.Prefix)
+		o.Path = st.getRelPath(o.ID)
+		o.Mode = types.ModeDir
+		page.Data = append(page.Data, o)
+	}
+	for _, v := range output.Contents {
+		o := types.NewObject(st, true)
+		o.ID = aws.StringValue(v.Key)
+		o.Path = st.getRelPath(o.ID)
+		o.Mode = types.ModeRead
+		o.SetContentLength(aws.Int64Value(v.Size))
+		o.SetLastModified(aws.TimeValue(v.LastModified))
+		if v.ETag != nil {
+			o.SetEtag(*v.ETag)
+		}
+		o.SetSystemMetadata(s3.ObjectSystemMetadata{StorageClass: aws.StringValue(v.StorageClass)})
+		page.Data = append(page.Data, o)
+	}
+
+	if !aws.BoolValue(output.IsTruncated) {
+		return types.IterateDone
+	}
+	status.token = aws.StringValue(output.NextContinuationToken)
+	return nil
+}
+
+func (st *s3Storage) writeWithMetadata(path string, r io.Reader, size int64, m Metadata, ps ...types.Pair) (n int64, err error) {
+	if size > s3WriteSizeMaximum {
+		return 0, fmt.Errorf("size limit exceeded: %w", services.ErrRestrictionDissatisfied)
+	}
+	if r == nil || size == 0 {
+		r = bytes.NewReader([]byte{})
+	} else {
+		r = io.LimitReader(r, size)
+	}
+
+	input := &awss3.PutObjectInput{
+		Bucket:        aws.String(st.bucket),
+		Key:           aws.String(st.getAbsPath(path)),
+		ContentLength: aws.Int64(size),
+		Body:          aws.ReadSeekCloser(r),
+		Metadata:      aws.StringMap(m),
+	}
+	for _, v := range ps {
+		if v.Key != "content_type" {
+			return 0, services.PairUnsupportedError{Pair: v}
+		}
+		input.ContentType = aws.String(v.Value.(string))
+	}
+
+	_, err = st.client.PutObject(input)
+	if err != nil {
+		return 0, st.formatError("write", err, path)
+	}
+	return size, nil
+}
+
+func (st *s3Storage) createMultipartWithMetadata(path string, m Metadata) (o *types.Object, err error) {
+	rp := st.getAbsPath(path)
+	output, err := st.client.CreateMultipartUpload(&awss3.CreateMultipartUploadInput{
+		Bucket:   aws.String(st.bucket),
+		Key:      aws.String(rp),
+		Metadata: aws.StringMap(m),
+	})
+	if err != nil {
+		return nil, st.formatError("create_multipart", err, path)
+	}
+
+	// Parts will be written and completed by go-service-s3.
+	o = types.NewObject(st.Storage, true)
+	o.ID = rp
+	o.Path = path
+	o.Mode = types.ModePart
+	o.SetMultipartID(aws.StringValue(output.UploadId))
+	return o, nil
+}
+
+func (st *s3Storage) createDirWithMetadata(path string, m Metadata) (err error) {
+	_, err = st.client.PutObject(&awss3.PutObjectInput{
+		Bucket:        aws.String(st.bucket),
+		Key:           aws.String(st.getAbsPath(path) + "/"),
+		ContentLength: aws.Int64(0),
+		Body:          aws.ReadSeekCloser(bytes.NewReader([]byte{})),
+		Metadata:      aws.StringMap(m),
+	})
+	if err != nil {
+		return st.formatError("create_dir", err, path)
+	}
+	return nil
+}
+
+// replaceMetadata copies the object onto itself with new user metadata, content
+// type, storage class and link target of the object are kept.
+func (st *s3Storage) replaceMetadata(path string, dir bool, m Metadata) (err error) {
+	rp := st.getAbsPath(path)
+	if dir {
+		rp += "/"
+	}
+
+	head, err := st.client.HeadObject(&awss3.HeadObjectInput{
+		Bucket: aws.String(st.bucket),
+		Key:    aws.String(rp),
+	})
+	if err != nil {
+		return st.formatError("replace_metadata", err, path)
+	}
+
+	metadata := aws.StringMap(m)
+	if v, ok := head.Metadata[s3LinkTargetMetadata]; ok {
+		metadata[s3LinkTargetMetadata] = v
+	}
+	// Standard storage class is not returned by s3.
+	storageClass := head.StorageClass
+	if aws.StringValue(storageClass) == "" {
+		storageClass = nil
+	}
+	source := (&url.URL{Path: st.bucket + "/" + rp}).EscapedPath()
+
+	if aws.Int64Value(head.ContentLength) > s3WriteSizeMaximum {
+		err = st.copyLarge(rp, source, aws.Int64Value(head.ContentLength), metadata, head.ContentType, storageClass)
+	} else {
+		_, err = st.client.CopyObject(&awss3.CopyObjectInput{
+			Bucket:            aws.String(st.bucket),
+			Key:               aws.String(rp),
+			CopySource:        aws.String(source),
+			MetadataDirective: aws.String(awss3.MetadataDirectiveReplace),
+			Metadata:          metadata,
+			ContentType:       head.ContentType,
+			StorageClass:      storageClass,
+		})
+	}
+	if err != nil {
+		return st.formatError("replace_metadata", err, path)
+	}
+	return nil
+}
+
+// copyLarge copies objects that could not be copied by a single request via
+// multipart copy.
+func (st *s3Storage) copyLarge(key, source string, size int64, metadata map[string]*string, contentType, storageClass *string) (err error) {
+	created, err := st.client.CreateMultipartUpload(&awss3.CreateMultipartUploadInput{
+		Bucket:       aws.String(st.bucket),
+		Key:          aws.String(key),
+		Metadata:     metadata,
+		ContentType:  contentType,
+		StorageClass: storageClass,
+	})
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			_, _ = st.client.AbortMultipartUpload(&awss3.AbortMultipartUploadInput{
+				Bucket:   aws.String(st.bucket),
+				Key:      aws.String(key),
+				UploadId: created.UploadId,
+			})
+		}
+	}()
+
+	var parts []*awss3.CompletedPart
+	for offset := int64(0); offset < size; offset += s3CopyPartSize {
+		end := offset + s3CopyPartSize
+		if end > size {
+			end = size
+		}
+		number := aws.Int64(int64(len(parts) + 1))
+		output, err := st.client.UploadPartCopy(&awss3.UploadPartCopyInput{
+			Bucket:          aws.String(st.bucket),
+			Key:             aws.String(key),
+			UploadId:        created.UploadId,
+			PartNumber:      number,
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end-1)),
+		})
+		if err != nil {
+			return err
+		}
+		parts = append(parts, &awss3.CompletedPart{ETag: output.CopyPartResult.ETag, PartNumber: number})
+	}
+
+	_, err = st.client.CompleteMultipartUpload(&awss3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(st.bucket),
+		Key:             aws.String(key),
+		UploadId:        created.UploadId,
+		MultipartUpload: &awss3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
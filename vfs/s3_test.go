@@ -0,0 +1,165 @@
+package vfs
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	s3 "github.com/beyondstorage/go-service-s3/v2"
+	"github.com/beyondstorage/go-storage/v4/pairs"
+	"github.com/beyondstorage/go-storage/v4/types"
+)
+
+// fakeS3 records requests and serves the object "a" with user metadata.
+type fakeS3 struct {
+	mu   sync.Mutex
+	reqs []*http.Request
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.reqs = append(f.reqs, r)
+	f.mu.Unlock()
+
+	switch {
+	case r.Method == http.MethodHead:
+		w.Header().Set("Content-Length", "5")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"etag"`)
+		w.Header().Set("Last-Modified", "Mon, 14 Sep 2020 12:26:40 GMT")
+		// Attributes written by s3fs.
+		w.Header().Set("X-Amz-Meta-Mode", "33216")
+		w.Header().Set("X-Amz-Meta-Uid", "1001")
+		w.Header().Set("X-Amz-Meta-Gid", "1002")
+		w.Header().Set("X-Amz-Meta-Mtime", "1600000000")
+		w.Header().Set("X-Amz-Meta-Color", "red")
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		_, _ = w.Write([]byte(`<CopyObjectResult><ETag>"etag"</ETag></CopyObjectResult>`))
+	case r.Method == http.MethodPut:
+		w.Header().Set("ETag", `"etag"`)
+	case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+		_, _ = w.Write([]byte(`<ListBucketResult>
+<IsTruncated>false</IsTruncated>
+<Contents><Key>a</Key><Size>5</Size><ETag>"etag"</ETag><LastModified>2020-09-14T12:26:40.000Z</LastModified></Contents>
+<CommonPrefixes><Prefix>d/</Prefix></CommonPrefixes>
+</ListBucketResult>`))
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) requests() []*http.Request {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	reqs := f.reqs
+	f.reqs = nil
+	return reqs
+}
+
+func newFakeS3Storage(t *testing.T) (*s3Storage, *fakeS3) {
+	f := &fakeS3{}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+
+	store, err := newS3Storage(
+		pairs.WithName("bucket"),
+		pairs.WithEndpoint("http:"+strings.TrimPrefix(srv.URL, "http://")),
+		pairs.WithCredential("hmac:ak:sk"),
+		pairs.WithLocation("us-east-1"),
+		s3.WithForcePathStyle(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store.(*s3Storage), f
+}
+
+func TestS3StorageMetadata(t *testing.T) {
+	st, f := newFakeS3Storage(t)
+
+	m := Metadata{metadataMode: "33188", "color": "blue"}
+	_, err := st.writeWithMetadata("a", bytes.NewReader([]byte("hello")), 5, m,
+		pairs.WithContentType("text/plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := f.requests()
+	if len(reqs) != 1 || reqs[0].Method != http.MethodPut || reqs[0].URL.Path != "/bucket/a" {
+		t.Fatalf("expect object put, got %v", reqs)
+	}
+	if h := reqs[0].Header; h.Get("X-Amz-Meta-Mode") != "33188" || h.Get("X-Amz-Meta-Color") != "blue" ||
+		h.Get("Content-Type") != "text/plain" {
+		t.Errorf("expect metadata and content type in headers, got %v", h)
+	}
+
+	o, err := st.Stat("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ino := newInode(1, o)
+	if !ino.HasMode || ino.Mode != 0700 || !ino.HasOwner || ino.Uid != 1001 || ino.Gid != 1002 {
+		t.Errorf("expect attributes of s3fs, got %+v", ino)
+	}
+	if um, _ := o.GetUserMetadata(); um["color"] != "red" {
+		t.Errorf("expect user metadata, got %v", um)
+	}
+	f.requests()
+
+	err = st.replaceMetadata("a", false, Metadata{"color": "green"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs = f.requests()
+	if len(reqs) != 2 || reqs[1].Method != http.MethodPut {
+		t.Fatalf("expect head and copy, got %v", reqs)
+	}
+	h := reqs[1].Header
+	if h.Get("X-Amz-Copy-Source") != "bucket/a" || h.Get("X-Amz-Metadata-Directive") != "REPLACE" {
+		t.Errorf("expect object copied onto itself, got %v", h)
+	}
+	if h.Get("X-Amz-Meta-Color") != "green" || h.Get("Content-Type") != "text/plain" {
+		t.Errorf("expect metadata replaced and content type kept, got %v", h)
+	}
+}
+
+func TestS3StorageList(t *testing.T) {
+	st, f := newFakeS3Storage(t)
+
+	it, err := st.List("", pairs.WithListMode(types.ListModeDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var objects []*types.Object
+	for {
+		o, err := it.Next()
+		if err == types.IterateDone {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, o)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("expect 2 objects, got %d", len(objects))
+	}
+	for _, o := range objects {
+		// Getting facts of listed objects should not stat them.
+		_, _ = o.GetContentLength()
+		_, _ = o.GetContentType()
+		_, _ = o.GetUserMetadata()
+	}
+	if !objects[0].Mode.IsDir() || objects[0].Path != "d/" {
+		t.Errorf("expect dir d/, got %s", objects[0].Path)
+	}
+	if n, _ := objects[1].GetContentLength(); objects[1].Path != "a" || n != 5 {
+		t.Errorf("expect file a in size 5, got %s in %d", objects[1].Path, n)
+	}
+	if reqs := f.requests(); len(reqs) != 1 {
+		t.Errorf("expect only the list request, got %d requests", len(reqs))
+	}
+}
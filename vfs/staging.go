@@ -0,0 +1,180 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/beyondstorage/go-storage/v4/services"
+	"go.uber.org/zap"
+)
+
+// stagingCopySize is the size of pieces while copying streamed data into staging file.
+const stagingCopySize = 4 * 1024 * 1024
+
+// startStaging will materialise the file in a local staging file, so that
+// reads and writes could happen at any offset.
+//
+// Data that has been streamed is still kept in cache, it will be copied into
+// the staging file and the write session will be dropped. If parts have been
+// uploaded, the session will be completed first. Otherwise, the staging file
+// starts from the object in storage.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) startStaging() (err error) {
+	f, err := ioutil.TempFile(fh.fs.stagingDir, "beyondfs-staging-")
+	if err != nil {
+		return
+	}
+
+	if fh.writing && fh.cache.multipartCreated(fh.ID) {
+		// Data persisted as parts has been removed from cache, it could only
+		// be read back after the session completed.
+		err = fh.endWrite()
+		if err != nil {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+			return
+		}
+	}
+
+	var n int64
+	if fh.writing && fh.idx > 0 {
+		err = fh.copySession(f)
+		n = int64(fh.size)
+	} else {
+		n, err = fh.fs.s.Read(fh.ino.Path, f)
+		if err != nil && errors.Is(err, services.ErrObjectNotExist) {
+			err = nil
+		}
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+		return
+	}
+
+	if fh.writing {
+		// Data streamed only lives in staging file now.
+		fh.cache.abortWrite(fh.ID)
+		fh.dirty = fh.idx > 0
+		fh.writing = false
+		fh.idx = 0
+	}
+
+	fh.fs.logger.Info("start staging",
+		zap.String("path", fh.ino.Path),
+		zap.String("staging", f.Name()),
+		zap.Int64("size", n))
+
+	fh.staging = f
+	fh.size = uint64(n)
+	return nil
+}
+
+// copySession copies data of the write session into staging file.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) copySession(f *os.File) (err error) {
+	buf := make([]byte, stagingCopySize)
+	for offset := uint64(0); offset < fh.size; {
+		n, err := fh.readSession(offset, buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		_, err = f.WriteAt(buf[:n], int64(offset))
+		if err != nil {
+			return err
+		}
+		offset += uint64(n)
+	}
+	return nil
+}
+
+func (fh *FileHandle) readStaging(offset uint64, buf []byte) (n int, err error) {
+	n, err = fh.staging.ReadAt(buf, int64(offset))
+	if err != nil && errors.Is(err, io.EOF) {
+		return n, nil
+	}
+	return
+}
+
+func (fh *FileHandle) writeStaging(offset uint64, buf []byte) (n int, err error) {
+	n, err = fh.staging.WriteAt(buf, int64(offset))
+	if err != nil {
+		return
+	}
+
+	fh.dirty = true
+	fh.offset = offset + uint64(n)
+	if fh.offset > fh.size {
+		fh.size = fh.offset
+	}
+	return n, nil
+}
+
+// truncateStaging resizes the staging file, it will be uploaded while flushing.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) truncateStaging(size uint64) (err error) {
+	err = fh.staging.Truncate(int64(size))
+	if err != nil {
+		return
+	}
+
+	fh.dirty = true
+	fh.size = size
+	return nil
+}
+
+// uploadStaging will upload the whole staging file if it's dirty.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) uploadStaging() (err error) {
+	if !fh.dirty {
+		return nil
+	}
+
+	m, err := fh.formatMetadata()
+	if err != nil {
+		return
+	}
+
+	_, err = fh.staging.Seek(0, io.SeekStart)
+	if err != nil {
+		return
+	}
+	_, err = fh.fs.writeObject(fh.ino.Path, fh.staging, int64(fh.size), m)
+	if err != nil {
+		return
+	}
+	fh.dirty = false
+
+	fh.ino.Size = fh.size
+	fh.ino.Mtime = time.Now()
+	fh.fs.refreshObject(fh.ino)
+	return fh.fs.SetInode(fh.ino)
+}
+
+// closeStaging will upload and remove the staging file.
+//
+// Caller must hold fh.mu.
+func (fh *FileHandle) closeStaging() (err error) {
+	err = fh.uploadStaging()
+	if err != nil {
+		return
+	}
+
+	_ = fh.staging.Close()
+	err = os.Remove(fh.staging.Name())
+	if err != nil {
+		return
+	}
+	fh.staging = nil
+	return nil
+}
@@ -0,0 +1,164 @@
+package vfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// newStagingFS returns fs with a dedicated staging dir.
+func newStagingFS(t *testing.T) (*FS, uint64, string) {
+	stagingDir := t.TempDir()
+	fs, err := NewFS(&Config{
+		StoragePath: "fs://" + t.TempDir(),
+		StagingDir:  stagingDir,
+		Logger:      zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = fs.Close() })
+	// Root is the last inode allocated by NewFS.
+	return fs, nextInode.Load(), stagingDir
+}
+
+// readObject reads the whole object from storage.
+func readObject(t *testing.T, fs *FS, path string) string {
+	var buf bytes.Buffer
+	_, err := fs.s.Read(path, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// countStaging returns the number of staging files left in dir.
+func countStaging(t *testing.T, dir string) int {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(fis)
+}
+
+func TestStagingRandomReadWrite(t *testing.T) {
+	fs, root, stagingDir := newStagingFS(t)
+
+	ino, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, fh, 0, "0123456789")
+
+	fh, err = fs.OpenFileHandle(ino, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Writes at any offset start staging from the object.
+	_, err = fh.Write(3, []byte("ab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fh.Write(12, []byte("xyz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countStaging(t, stagingDir); n != 1 {
+		t.Errorf("expect 1 staging file, got %d", n)
+	}
+
+	cases := []struct {
+		offset uint64
+		size   int
+		expect string
+	}{
+		{2, 4, "2ab5"},
+		{9, 4, "9\x00\x00x"},
+		{13, 8, "yz"},
+		{20, 4, ""},
+	}
+	for _, tt := range cases {
+		buf := make([]byte, tt.size)
+		n, err := fh.Read(tt.offset, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != tt.expect {
+			t.Errorf("read %d at %d: expect %q, got %q", tt.size, tt.offset, tt.expect, buf[:n])
+		}
+	}
+	// Staging file is only uploaded while flushing.
+	if got := readObject(t, fs, "a"); got != "0123456789" {
+		t.Errorf("expect object unchanged before close, got %q", got)
+	}
+
+	err = fs.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "012ab56789\x00\x00xyz"
+	if got := readObject(t, fs, "a"); got != expect {
+		t.Errorf("expect %q, got %q", expect, got)
+	}
+	if ino, err = fs.GetInode(ino.ID); err != nil || ino.Size != uint64(len(expect)) {
+		t.Errorf("expect size %d, got %+v, %v", len(expect), ino, err)
+	}
+	if n := countStaging(t, stagingDir); n != 0 {
+		t.Errorf("expect staging file removed, got %d", n)
+	}
+}
+
+func TestStagingTruncate(t *testing.T) {
+	fs, root, _ := newStagingFS(t)
+
+	ino, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, fh, 0, "0123456789")
+
+	fh, err = fs.OpenFileHandle(ino, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fh.Write(1, []byte("ab"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Truncate while staging only changes the staging file.
+	err = fh.Truncate(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fh.Truncate(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := fh.Read(0, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "0ab3\x00\x00" {
+		t.Errorf("expect 0ab3 with zeros, got %q", buf[:n])
+	}
+	if got := readObject(t, fs, "a"); got != "0123456789" {
+		t.Errorf("expect object unchanged before flush, got %q", got)
+	}
+
+	// Flush uploads the staging file, and the handle keeps working.
+	err = fh.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readObject(t, fs, "a"); got != "0ab3\x00\x00" {
+		t.Errorf("expect 0ab3 with zeros flushed, got %q", got)
+	}
+	writeFile(t, fs, fh, 6, "z")
+	if got := readObject(t, fs, "a"); got != "0ab3\x00\x00z" {
+		t.Errorf("expect 0ab3 with zeros and z, got %q", got)
+	}
+}
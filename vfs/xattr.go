@@ -0,0 +1,79 @@
+package vfs
+
+//go:generate go run github.com/tinylib/msgp
+
+// XAttrs is the extended attributes of an inode, mapped to the object's user metadata.
+type XAttrs map[string]string
+
+// GetXAttrs returns all extended attributes of this inode, there is none if
+// storage doesn't carry user metadata.
+func (fs *FS) GetXAttrs(ino *Inode) (xattrs XAttrs, err error) {
+	if _, ok := fs.s.(metadataStorer); !ok {
+		return XAttrs{}, nil
+	}
+
+	m, err := fs.getMetadata(ino.Path)
+	if err != nil {
+		return
+	}
+
+	xattrs = make(XAttrs, len(m))
+	for k, v := range m {
+		if isReservedMetadata(k) {
+			continue
+		}
+		xattrs[k] = v
+	}
+	return xattrs, nil
+}
+
+func (fs *FS) SetXAttr(ino *Inode, name, value string) (err error) {
+	xattrs, err := fs.GetXAttrs(ino)
+	if err != nil {
+		return
+	}
+
+	xattrs[name] = value
+	return fs.updateXAttrs(ino, xattrs)
+}
+
+func (fs *FS) RemoveXAttr(ino *Inode, name string) (err error) {
+	xattrs, err := fs.GetXAttrs(ino)
+	if err != nil {
+		return
+	}
+	if _, ok := xattrs[name]; !ok {
+		return ErrNoXAttr
+	}
+
+	delete(xattrs, name)
+	return fs.updateXAttrs(ino, xattrs)
+}
+
+// updateXAttrs will replace the xattrs in object's user metadata, attributes
+// used by BeyondFS will be kept.
+//
+// Xattrs are only supported on storage carrying user metadata, and root dir
+// doesn't support them since it has no object.
+func (fs *FS) updateXAttrs(ino *Inode, xattrs XAttrs) (err error) {
+	if _, ok := fs.s.(metadataStorer); !ok || ino.Path == "" {
+		return ErrNotSupported
+	}
+
+	m, err := fs.getMetadata(ino.Path)
+	if err != nil {
+		return
+	}
+	for k := range m {
+		if !isReservedMetadata(k) {
+			delete(m, k)
+		}
+	}
+	if m == nil {
+		m = make(Metadata, len(xattrs))
+	}
+	for k, v := range xattrs {
+		m[k] = v
+	}
+	return fs.updateMetadata(ino, m)
+}
@@ -0,0 +1,132 @@
+package vfs
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+// newTestFS creates a fs on storage, and returns it with the id of root.
+func newTestFS(t *testing.T, storagePath, metaDir string) (*FS, uint64) {
+	fs, err := NewFS(&Config{
+		StoragePath: storagePath,
+		MetaPath:    metaDir,
+		Logger:      zap.NewNop(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Root is the last inode allocated by NewFS.
+	return fs, nextInode.Load()
+}
+
+func TestXAttrPersisted(t *testing.T) {
+	storagePath := metaMemoryType + "://" + t.Name()
+
+	// Xattrs are kept in object, meta service is not required.
+	fs, root := newTestFS(t, storagePath, "")
+	ino, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fh.Write(0, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.SetXAttr(ino, "k", "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := fs.CreateDir(root, "d", &CreateAttr{Mode: 0755})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.SetXAttr(dir, "k", "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := fs.s.(*metaMemoryStorage).getMetadata("a")
+	if m["k"] != "v" || m[metadataMode] == "" {
+		t.Errorf("expect xattr and attributes in object, got %v", m)
+	}
+	err = fs.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs, root = newTestFS(t, storagePath, "")
+	defer fs.Close()
+
+	for name, expect := range map[string]string{"a": "v", "d": "dir"} {
+		ino, err = fs.GetEntry(root, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		xattrs, err := fs.GetXAttrs(ino)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if xattrs["k"] != expect {
+			t.Errorf("expect xattr k=%s of %s, got %v", expect, name, xattrs)
+		}
+	}
+
+	// Rewriting data should keep xattrs.
+	ino, err = fs.GetEntry(root, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh, err = fs.OpenFileHandle(ino, os.O_RDWR|os.O_TRUNC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fh.Write(0, []byte("world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := fs.s.(*metaMemoryStorage).getMetadata("a"); m["k"] != "v" {
+		t.Errorf("expect xattr kept after rewrite, got %v", m)
+	}
+	err = fs.RemoveXAttr(ino, "k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := fs.s.(*metaMemoryStorage).getMetadata("a"); m["k"] != "" || m[metadataMode] == "" {
+		t.Errorf("expect xattr removed and attributes kept, got %v", m)
+	}
+}
+
+func TestXAttrNotSupported(t *testing.T) {
+	// Storage without user metadata doesn't support xattrs even with MetaPath.
+	fs, root := newTestFS(t, "fs://"+t.TempDir(), t.TempDir())
+	defer fs.Close()
+
+	ino, fh, err := fs.Create(root, "a", &CreateAttr{Mode: 0644}, os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.DeleteFileHandle(fh.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = fs.SetXAttr(ino, "k", "v")
+	if !errors.Is(err, ErrNotSupported) {
+		t.Errorf("expect ErrNotSupported, got %v", err)
+	}
+	xattrs, err := fs.GetXAttrs(ino)
+	if err != nil || len(xattrs) != 0 {
+		t.Errorf("expect no xattrs, got %v, %v", xattrs, err)
+	}
+}